@@ -0,0 +1,393 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/util/workqueue"
+	csitrans "k8s.io/csi-translation-lib"
+	"k8s.io/klog/v2"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/connection"
+	"github.com/kubernetes-csi/csi-lib-utils/metrics"
+	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+	"google.golang.org/grpc"
+)
+
+// csiDriver is a CSI driver served by the external-attacher. Each driver has
+// its own connection, metrics manager and controller.
+type csiDriver struct {
+	address        string
+	name           string
+	conn           *grpc.ClientConn
+	metricsManager metrics.CSIMetricsManager
+	// connectionLost receives a notification each time the connection to the
+	// driver is lost, see handleConnectionLoss.
+	connectionLost chan struct{}
+
+	ctrl    *controller.CSIAttachController
+	caps    driverCapabilities
+	capsMux sync.Mutex
+	// operations is shared by all handlers of the driver, so operations
+	// started by a handler replaced after capability change are tracked too.
+	operations *controller.OperationTracker
+	// handlerState is shared by all CSI handlers of the driver for the same
+	// reason.
+	handlerState *controller.CSIHandlerState
+	// secretCache is shared by all drivers. It's nil when Secrets are not
+	// watched.
+	secretCache *controller.SecretCache
+}
+
+// driverCapabilities are capabilities of the CSI driver used by the
+// external-attacher.
+type driverCapabilities struct {
+	controllerService         bool
+	controllerPublish         bool
+	publishReadOnly           bool
+	singleNodeMultiWriter     bool
+	volumeCondition           bool
+	listVolumesPublishedNodes bool
+	getVolumePublishedNodes   bool
+}
+
+// connectDriver connects to the CSI driver at given address, waits until it
+// is ready and discovers its name and capabilities. Only one of the drivers
+// should register process start time metric, all drivers share the same HTTP
+// endpoint.
+func connectDriver(address string, registerProcessStartTime bool) (*csiDriver, error) {
+	d := &csiDriver{
+		address:        address,
+		connectionLost: make(chan struct{}, 1),
+		operations:     controller.NewOperationTracker(*parallelPerVolume),
+		handlerState:   controller.NewCSIHandlerState(),
+	}
+	onConnectionLoss := connection.ExitOnConnectionLoss()
+	if !*exitOnConnectionLoss {
+		onConnectionLoss = d.onConnectionLoss
+	}
+
+	// Connect to CSI.
+	d.metricsManager = metrics.NewCSIMetricsManagerWithOptions("" /* driverName */, metrics.WithProcessStartTime(registerProcessStartTime))
+	csiConn, err := connection.Connect(address, d.metricsManager, connection.OnConnectionLoss(onConnectionLoss))
+	if err != nil {
+		return nil, err
+	}
+
+	err = rpc.ProbeForever(csiConn, *timeout)
+	if err != nil {
+		csiConn.Close()
+		return nil, err
+	}
+
+	// Find driver name.
+	ctx, cancel := context.WithTimeout(context.Background(), csiTimeout)
+	defer cancel()
+	d.name, err = rpc.GetDriverName(ctx, csiConn)
+	if err != nil {
+		csiConn.Close()
+		return nil, err
+	}
+	klog.V(2).Infof("CSI driver name: %q", d.name)
+
+	translator := csitrans.New()
+	if translator.IsMigratedCSIDriverByName(d.name) {
+		d.metricsManager = metrics.NewCSIMetricsManagerWithOptions(d.name, metrics.WithMigration(), metrics.WithProcessStartTime(registerProcessStartTime))
+		migratedCsiClient, err := connection.Connect(address, d.metricsManager, connection.OnConnectionLoss(onConnectionLoss))
+		csiConn.Close()
+		if err != nil {
+			return nil, err
+		}
+		csiConn = migratedCsiClient
+
+		err = rpc.ProbeForever(csiConn, *timeout)
+		if err != nil {
+			csiConn.Close()
+			return nil, err
+		}
+	}
+	d.metricsManager.SetDriverName(d.name)
+	d.conn = csiConn
+
+	d.caps, err = getDriverCapabilities(ctx, csiConn)
+	if err != nil {
+		csiConn.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// onConnectionLoss is the connection.OnConnectionLoss callback of the driver
+// when the external-attacher does not exit on connection loss.
+func (d *csiDriver) onConnectionLoss() bool {
+	select {
+	case d.connectionLost <- struct{}{}:
+	default:
+		// The previous loss has not been handled yet.
+	}
+	return true
+}
+
+// newController creates the controller of the driver. The informers used by
+// the handlers must be already registered in the factory.
+func (d *csiDriver) newController(clientset kubernetes.Interface, factory informers.SharedInformerFactory) {
+	handler, shouldReconcile := d.newHandler(clientset, factory, d.caps)
+	var nodeInformer coreinformers.NodeInformer
+	if watchNodes() {
+		// Attaches to unhealthy nodes wait for the nodes to get healthy
+		// and VolumeAttachments are filtered by node labels. The
+		// controller also waits for the Node cache to sync, the handler
+		// would see all nodes as deleted and force detach their volumes
+		// otherwise.
+		nodeInformer = factory.Core().V1().Nodes()
+	}
+	d.ctrl = controller.NewCSIAttachController(
+		clientset,
+		d.name,
+		handler,
+		factory.Storage().V1().VolumeAttachments(),
+		factory.Core().V1().PersistentVolumes(),
+		nodeInformer,
+		factory.Storage().V1().CSINodes(),
+		d.secretCache,
+		nodeSelector,
+		workqueue.NewItemExponentialFailureRateLimiter(*retryIntervalStart, *retryIntervalMax),
+		workqueue.NewItemExponentialFailureRateLimiter(*retryIntervalStart, *retryIntervalMax),
+		shouldReconcile,
+		*reconcileSync,
+		int(*maxOperationsPerNode),
+	)
+}
+
+// newHandler returns a handler for the given driver capabilities and whether
+// VolumeAttachments should be reconciled with the driver.
+func (d *csiDriver) newHandler(clientset kubernetes.Interface, factory informers.SharedInformerFactory, caps driverCapabilities) (controller.Handler, bool) {
+	if caps.listVolumesPublishedNodes {
+		klog.V(2).Infof("CSI driver %s supports list volumes published nodes. Using capability to reconcile volume attachment objects with actual backend state", d.name)
+	}
+
+	useGetVolume := false
+	if *reconcileWithGetVolume {
+		if caps.getVolumePublishedNodes {
+			klog.V(2).Infof("CSI driver %s supports get volume with published nodes. Using ControllerGetVolume to reconcile volume attachment objects with actual backend state", d.name)
+			useGetVolume = true
+		} else {
+			klog.Warningf("CSI driver %s does not support GET_VOLUME and LIST_VOLUMES_PUBLISHED_NODES capabilities, --reconcile-with-get-volume is ignored", d.name)
+		}
+	}
+	shouldReconcile := caps.listVolumesPublishedNodes || useGetVolume
+	if *dryRun && shouldReconcile {
+		// Dry run attaches nothing, the driver state would never match
+		// VolumeAttachments.
+		klog.V(2).Infof("Reconciliation with CSI driver %s is disabled in dry run mode", d.name)
+		shouldReconcile = false
+	}
+
+	if !caps.controllerService {
+		klog.V(2).Infof("CSI driver %s does not support Plugin Controller Service, using trivial handler", d.name)
+		return controller.NewTrivialHandler(clientset), shouldReconcile
+	}
+	if !caps.controllerPublish {
+		klog.V(2).Infof("CSI driver %s does not support ControllerPublishUnpublish, using trivial handler", d.name)
+		return controller.NewTrivialHandler(clientset), shouldReconcile
+	}
+	if caps.singleNodeMultiWriter {
+		klog.V(2).Infof("CSI driver %s supports SINGLE_NODE_MULTI_WRITER access modes", d.name)
+	}
+	if caps.volumeCondition {
+		klog.V(2).Infof("CSI driver %s supports VOLUME_CONDITION, reporting condition of attached volumes", d.name)
+	}
+	pvLister := factory.Core().V1().PersistentVolumes().Lister()
+	vaIndexer := factory.Storage().V1().VolumeAttachments().Informer().GetIndexer()
+	csiNodeLister := factory.Storage().V1().CSINodes().Lister()
+	var nodeLister corelisters.NodeLister
+	if watchNodes() {
+		// Lister() registers the informer, watch nodes only when needed.
+		nodeLister = factory.Core().V1().Nodes().Lister()
+	}
+	var volAttacher attacher.Attacher
+	var CSIVolumeLister controller.VolumeLister
+	if *dryRun {
+		volAttacher = attacher.NewDryRunAttacher()
+		CSIVolumeLister = attacher.NewDryRunVolumeLister()
+	} else {
+		volAttacher = attacher.NewAttacher(d.conn)
+		CSIVolumeLister = attacher.NewVolumeLister(d.conn, int32(*listVolumesMaxEntries), *timeout)
+	}
+	klog.V(2).Infof("CSI driver %s supports ControllerPublishUnpublish, using real CSI handler", d.name)
+	return controller.NewCSIHandler(controller.CSIHandlerOptions{
+		Client:                        clientset,
+		AttacherName:                  d.name,
+		Attacher:                      volAttacher,
+		VolumeLister:                  CSIVolumeLister,
+		PVLister:                      pvLister,
+		CSINodeLister:                 csiNodeLister,
+		VAIndexer:                     vaIndexer,
+		NodeLister:                    nodeLister,
+		SecretCache:                   d.secretCache,
+		Timeout:                       *timeout,
+		SupportsPublishReadOnly:       caps.publishReadOnly,
+		SupportsSingleNodeMultiWriter: caps.singleNodeMultiWriter,
+		ReconcileWithGetVolume:        useGetVolume,
+		SupportsVolumeCondition:       caps.volumeCondition,
+		Translator:                    csitrans.New(),
+		Operations:                    d.operations,
+		UnhealthyNodePolicy:           unhealthyNodePolicy,
+		ForceDetachGracePeriod:        *forceDetachGracePeriod,
+		NodeSelector:                  nodeSelector,
+		State:                         d.handlerState,
+	}), shouldReconcile
+}
+
+// watchCapabilities starts goroutines that pause the controller while the
+// driver is not available and apply changes of the driver capabilities to the
+// controller.
+func (d *csiDriver) watchCapabilities(clientset kubernetes.Interface, factory informers.SharedInformerFactory) {
+	if !*exitOnConnectionLoss {
+		go d.handleConnectionLoss(clientset, factory)
+	}
+	if *capabilitiesResync > 0 {
+		go wait.Forever(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), csiTimeout)
+			defer cancel()
+			newCaps, err := getDriverCapabilities(ctx, d.conn)
+			if err != nil {
+				klog.Warningf("Failed to re-discover capabilities of CSI driver %s: %v", d.name, err)
+				return
+			}
+			d.updateCapabilities(clientset, factory, newCaps)
+		}, *capabilitiesResync)
+	}
+}
+
+// updateCapabilities replaces the handler of the controller when the driver
+// capabilities change.
+func (d *csiDriver) updateCapabilities(clientset kubernetes.Interface, factory informers.SharedInformerFactory, newCaps driverCapabilities) {
+	d.capsMux.Lock()
+	defer d.capsMux.Unlock()
+	if newCaps == d.caps {
+		return
+	}
+	klog.Infof("CSI driver %s capabilities changed from %+v to %+v", d.name, d.caps, newCaps)
+	d.ctrl.SetHandler(d.newHandler(clientset, factory, newCaps))
+	d.caps = newCaps
+}
+
+// handleConnectionLoss pauses the controller each time the connection to the
+// CSI driver is lost and resumes it when the driver is ready again. The driver
+// must keep its name, the external-attacher exits otherwise. New driver
+// capabilities are applied before resuming.
+func (d *csiDriver) handleConnectionLoss(clientset kubernetes.Interface, factory informers.SharedInformerFactory) {
+	for range d.connectionLost {
+		klog.Warningf("Lost connection to CSI driver %s, pausing processing of VolumeAttachments", d.name)
+		d.ctrl.Pause()
+		newDriverName, newCaps := d.waitForDriver()
+		if newDriverName != d.name {
+			klog.Fatalf("CSI driver name changed from %q to %q after reconnect, exiting", d.name, newDriverName)
+		}
+		d.updateCapabilities(clientset, factory, newCaps)
+		klog.Infof("CSI driver %s is ready again, resuming processing of VolumeAttachments", d.name)
+		d.ctrl.Resume()
+	}
+}
+
+// waitForDriver calls probeDriver until it succeeds.
+func (d *csiDriver) waitForDriver() (string, driverCapabilities) {
+	for {
+		name, caps, err := d.probeDriver()
+		if err == nil {
+			return name, caps
+		}
+		klog.Warningf("CSI driver at %s is not ready, retrying: %v", d.address, err)
+		time.Sleep(csiTimeout)
+	}
+}
+
+// probeDriver waits until the CSI driver is ready and returns its name and
+// capabilities, or an error when a call to the driver fails.
+func (d *csiDriver) probeDriver() (string, driverCapabilities, error) {
+	if err := rpc.ProbeForever(d.conn, *timeout); err != nil {
+		return "", driverCapabilities{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), csiTimeout)
+	defer cancel()
+	name, err := rpc.GetDriverName(ctx, d.conn)
+	if err != nil {
+		return "", driverCapabilities{}, err
+	}
+	caps, err := getDriverCapabilities(ctx, d.conn)
+	if err != nil {
+		return "", driverCapabilities{}, err
+	}
+	return name, caps, nil
+}
+
+// getDriverCapabilities discovers capabilities of the CSI driver.
+func getDriverCapabilities(ctx context.Context, csiConn *grpc.ClientConn) (driverCapabilities, error) {
+	caps := driverCapabilities{}
+
+	pluginCaps, err := rpc.GetPluginCapabilities(ctx, csiConn)
+	if err != nil {
+		return caps, err
+	}
+	caps.controllerService = pluginCaps[csi.PluginCapability_Service_CONTROLLER_SERVICE]
+	if !caps.controllerService {
+		return caps, nil
+	}
+
+	controllerCaps, err := rpc.GetControllerCapabilities(ctx, csiConn)
+	if err != nil {
+		return caps, fmt.Errorf("failed to get controller capabilities: %v", err)
+	}
+	caps.controllerPublish = controllerCaps[csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME]
+	caps.publishReadOnly = controllerCaps[csi.ControllerServiceCapability_RPC_PUBLISH_READONLY]
+	caps.singleNodeMultiWriter = controllerCaps[csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER]
+	caps.volumeCondition = controllerCaps[csi.ControllerServiceCapability_RPC_VOLUME_CONDITION]
+
+	// Reconciliation is optional, a driver whose reconcile capabilities
+	// can't be checked is used without it until the capabilities are
+	// re-discovered.
+	caps.listVolumesPublishedNodes, caps.getVolumePublishedNodes, err = supportsPublishedNodes(ctx, csiConn)
+	if err != nil {
+		klog.Errorf("Failed to check if driver supports ListVolumesPublishedNodes, assuming it does not: %v", err)
+	}
+	return caps, nil
+}
+
+// supportsPublishedNodes returns whether the driver reports published nodes
+// of volumes in ListVolumes and in ControllerGetVolume.
+func supportsPublishedNodes(ctx context.Context, csiConn *grpc.ClientConn) (bool, bool, error) {
+	caps, err := rpc.GetControllerCapabilities(ctx, csiConn)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to get controller capabilities: %v", err)
+	}
+	listVolumes := caps[csi.ControllerServiceCapability_RPC_LIST_VOLUMES] && caps[csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES]
+	getVolume := caps[csi.ControllerServiceCapability_RPC_GET_VOLUME] && caps[csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES]
+	return listVolumes, getVolume, nil
+}
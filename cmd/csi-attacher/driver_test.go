@@ -0,0 +1,97 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/csi-lib-utils/connection"
+	"github.com/kubernetes-csi/csi-lib-utils/metrics"
+	"github.com/kubernetes-csi/csi-test/v4/driver"
+)
+
+func controllerCapabilities(rpcs ...csi.ControllerServiceCapability_RPC_Type) *csi.ControllerGetCapabilitiesResponse {
+	rsp := &csi.ControllerGetCapabilitiesResponse{}
+	for _, rpc := range rpcs {
+		rsp.Capabilities = append(rsp.Capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: rpc},
+			},
+		})
+	}
+	return rsp
+}
+
+func TestGetDriverCapabilitiesReconcileError(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "external-attacher-test-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	mockController := gomock.NewController(t)
+	defer mockController.Finish()
+	identityServer := driver.NewMockIdentityServer(mockController)
+	controllerServer := driver.NewMockControllerServer(mockController)
+	drv := driver.NewMockCSIDriver(&driver.MockCSIDriverServers{
+		Identity:   identityServer,
+		Controller: controllerServer,
+	})
+	drv.StartOnAddress("unix", filepath.Join(tmpdir, "csi.sock"))
+	defer drv.Stop()
+	csiConn, err := connection.Connect(drv.Address(), metrics.NewCSIMetricsManager("test.csi.driver.io"))
+	if err != nil {
+		t.Fatalf("Failed to connect to the driver: %s", err)
+	}
+	defer csiConn.Close()
+
+	identityServer.EXPECT().GetPluginCapabilities(gomock.Any(), gomock.Any()).Return(&csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{Type: csi.PluginCapability_Service_CONTROLLER_SERVICE},
+				},
+			},
+		},
+	}, nil)
+	gomock.InOrder(
+		controllerServer.EXPECT().ControllerGetCapabilities(gomock.Any(), gomock.Any()).Return(controllerCapabilities(
+			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		), nil),
+		controllerServer.EXPECT().ControllerGetCapabilities(gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("mock error")),
+	)
+
+	// Failed check of reconcile capabilities is not fatal, reconciliation
+	// is disabled until the capabilities are re-discovered.
+	caps, err := getDriverCapabilities(context.Background(), csiConn)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := driverCapabilities{controllerService: true, controllerPublish: true}
+	if caps != expected {
+		t.Errorf("expected capabilities %+v, got %+v", expected, caps)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/kubernetes-csi/csi-lib-utils/leaderelection"
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	k8sleaderelection "k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// runWithLeaderElection calls run while this process holds the leader Lease.
+// It's similar to leader election from csi-lib-utils, but it does not exit as
+// soon as the leadership ends. run gets a context that is cancelled when stop
+// is done or when the Lease is lost, and the Lease is released only after run
+// returns, i.e. after running operations finished.
+func runWithLeaderElection(stop context.Context, clientset kubernetes.Interface, lockName string, mux *http.ServeMux, run func(ctx context.Context)) error {
+	identity, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("error getting the default leader identity: %v", err)
+	}
+	namespace := *leaderElectionNamespace
+	if namespace == "" {
+		namespace = inClusterNamespace()
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: clientset.CoreV1().Events(namespace)})
+	eventRecorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: fmt.Sprintf("%s/%s", lockName, identity)})
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, namespace, controller.SanitizeDriverName(lockName), clientset.CoreV1(), clientset.CoordinationV1(), resourcelock.ResourceLockConfig{
+		Identity:      controller.SanitizeDriverName(identity),
+		EventRecorder: eventRecorder,
+	})
+	if err != nil {
+		return err
+	}
+
+	var healthCheck *k8sleaderelection.HealthzAdaptor
+	if *httpEndpoint != "" {
+		healthCheck = k8sleaderelection.NewLeaderHealthzAdaptor(leaderelection.DefaultHealthCheckTimeout)
+		mux.Handle(leaderelection.HealthCheckerAddress, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := healthCheck.Check(r); err != nil {
+				http.Error(w, fmt.Sprintf("internal server error: %v", err), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, "ok")
+		}))
+	}
+
+	// The leader election context is cancelled by run when it's done, or on
+	// stop when run has not started yet. The Lease is released then.
+	leCtx, leCancel := context.WithCancel(context.Background())
+	defer leCancel()
+	var startedMux sync.Mutex
+	started := false
+	runDone := make(chan struct{})
+	go func() {
+		<-stop.Done()
+		startedMux.Lock()
+		defer startedMux.Unlock()
+		if !started {
+			leCancel()
+		}
+	}()
+
+	config := k8sleaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   *leaderElectionLeaseDuration,
+		RenewDeadline:   *leaderElectionRenewDeadline,
+		RetryPeriod:     *leaderElectionRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            lockName,
+		WatchDog:        healthCheck,
+		Callbacks: k8sleaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				startedMux.Lock()
+				started = true
+				startedMux.Unlock()
+				defer close(runDone)
+				defer leCancel()
+				klog.V(2).Info("became leader, starting")
+
+				// Stop on either lost leadership or stop.
+				ctx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				go func() {
+					select {
+					case <-stop.Done():
+						cancel()
+					case <-ctx.Done():
+					}
+				}()
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				startedMux.Lock()
+				wasStarted := started
+				startedMux.Unlock()
+				if wasStarted {
+					// Let running operations finish.
+					<-runDone
+				}
+				if stop.Err() == nil {
+					klog.Fatal("stopped leading")
+				}
+				klog.V(2).Info("stopped leading after shutdown")
+			},
+			OnNewLeader: func(identity string) {
+				klog.V(3).Infof("new leader detected, current leader: %s", identity)
+			},
+		},
+	}
+	k8sleaderelection.RunOrDie(leCtx, config)
+	return nil
+}
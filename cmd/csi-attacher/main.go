@@ -20,26 +20,29 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/workqueue"
-	csitrans "k8s.io/csi-translation-lib"
+	k8smetrics "k8s.io/component-base/metrics"
 	"k8s.io/klog/v2"
 
-	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/kubernetes-csi/csi-lib-utils/connection"
-	"github.com/kubernetes-csi/csi-lib-utils/leaderelection"
-	"github.com/kubernetes-csi/csi-lib-utils/metrics"
-	"github.com/kubernetes-csi/csi-lib-utils/rpc"
-	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
 	"github.com/kubernetes-csi/external-attacher/pkg/controller"
-	"google.golang.org/grpc"
+	"github.com/kubernetes-csi/external-attacher/pkg/sharding"
 )
 
 const (
@@ -54,11 +57,17 @@ const (
 var (
 	kubeconfig    = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
 	resync        = flag.Duration("resync", 10*time.Minute, "Resync interval of the controller.")
-	csiAddress    = flag.String("csi-address", "/run/csi/socket", "Address of the CSI driver socket.")
+	csiAddress    = flag.String("csi-address", "/run/csi/socket", "Address of the CSI driver socket. Comma separated list of addresses serves several CSI drivers.")
 	showVersion   = flag.Bool("version", false, "Show version.")
 	timeout       = flag.Duration("timeout", 15*time.Second, "Timeout for waiting for attaching or detaching the volume.")
 	workerThreads = flag.Uint("worker-threads", 10, "Number of attacher worker threads")
 
+	maxOperationsPerNode    = flag.Uint("max-operations-per-node", 0, "Maximum number of VolumeAttachments of a single node that are attached or detached at the same time. Other VolumeAttachments of the node wait until an operation finishes. 0 means no limit.")
+	unhealthyNodePolicyFlag = flag.String("unhealthy-node-policy", string(controller.UnhealthyNodeAllow), "What to do with VolumeAttachments of nodes that are NotReady, being deleted or have one of --unhealthy-node-taints: \"allow\" attaches the volumes, \"delay\" re-tries the attach with exponential backoff, \"refuse\" does not attach the volumes until the node changes.")
+	unhealthyNodeTaints     = flag.String("unhealthy-node-taints", "ToBeDeletedByClusterAutoscaler", "Comma separated list of keys of taints that make a node unhealthy, see --unhealthy-node-policy.")
+	forceDetachGracePeriod  = flag.Duration("force-detach-grace-period", 0, "Enables force detach of volumes from nodes with node.kubernetes.io/out-of-service taint and from deleted nodes. When ControllerUnpublish of such a volume keeps failing for this period after the VolumeAttachment was deleted, the VolumeAttachment is marked as detached anyway. 0 disables force detach.")
+	parallelPerVolume       = flag.Bool("parallel-per-volume", false, "Allow ControllerPublish / ControllerUnpublish calls of the same volume on different nodes at the same time. By default, only one call per volume runs at a time.")
+
 	retryIntervalStart = flag.Duration("retry-interval-start", time.Second, "Initial retry interval of failed create volume or deletion. It doubles with each failure, up to retry-interval-max.")
 	retryIntervalMax   = flag.Duration("retry-interval-max", 5*time.Minute, "Maximum retry interval of failed create volume or deletion.")
 
@@ -68,7 +77,20 @@ var (
 	leaderElectionRenewDeadline = flag.Duration("leader-election-renew-deadline", 10*time.Second, "Duration, in seconds, that the acting leader will retry refreshing leadership before giving up. Defaults to 10 seconds.")
 	leaderElectionRetryPeriod   = flag.Duration("leader-election-retry-period", 5*time.Second, "Duration, in seconds, the LeaderElector clients should wait between tries of actions. Defaults to 5 seconds.")
 
-	reconcileSync = flag.Duration("reconcile-sync", 1*time.Minute, "Resync interval of the VolumeAttachment reconciler.")
+	shards   = flag.Int("shards", 0, "Number of shards that VolumeAttachments are split into. When greater than 1, all replicas of the attacher process VolumeAttachments at the same time, each replica the shards whose Leases it holds, and --leader-election is ignored. All replicas must use the same value.")
+	shardKey = flag.String("shard-key", string(controller.ShardByVolume), "What VolumeAttachments are sharded by, see --shards: \"volume\" assigns all VolumeAttachments of a volume to the same shard, \"node\" assigns all VolumeAttachments of a node to the same shard.")
+
+	nodeSelectorFlag = flag.String("node-selector", "", "Label selector of nodes whose VolumeAttachments are processed, e.g. when several attacher instances with the same driver name serve different nodes. The selector is part of the leader election lock name. Empty selector processes VolumeAttachments of all nodes.")
+	nodeDeployment   = flag.Bool("node-deployment", false, "Run the attacher on each node, e.g. in a DaemonSet, and process only VolumeAttachments of the node named by the NODE_NAME environment variable. --leader-election is ignored.")
+
+	watchSecrets        = flag.Bool("watch-secrets", false, "Watch Secrets and read ControllerPublishSecretRef secrets from the informer cache instead of the API server. Only namespaces referenced by ControllerPublishSecretRef of PersistentVolumes are watched. VolumeAttachments that failed because their secret did not exist are retried as soon as the secret is created, instead of after exponential backoff. Use --secret-label-selector to limit the watched Secrets.")
+	secretLabelSelector = flag.String("secret-label-selector", "", "Label selector of Secrets watched with --watch-secrets. Empty selector watches all Secrets.")
+
+	shutdownGracePeriod = flag.Duration("shutdown-grace-period", 10*time.Second, "How long to wait for running ControllerPublish / ControllerUnpublish calls to finish and save their results after SIGTERM or lost leadership, before the leader election Lease is released and the attacher exits.")
+
+	reconcileSync          = flag.Duration("reconcile-sync", 1*time.Minute, "Resync interval of the VolumeAttachment reconciler.")
+	listVolumesMaxEntries  = flag.Int("list-volumes-max-entries", 0, "Maximum number of volumes returned by a single ListVolumes call of the VolumeAttachment reconciler. 0 lets the CSI driver choose.")
+	reconcileWithGetVolume = flag.Bool("reconcile-with-get-volume", false, "Reconcile VolumeAttachments by calling ControllerGetVolume for each volume referenced by a VolumeAttachment instead of listing all volumes in the CSI driver. Used only when the driver supports GET_VOLUME and LIST_VOLUMES_PUBLISHED_NODES capabilities.")
 
 	metricsAddress = flag.String("metrics-address", "", "(deprecated) The TCP network address where the prometheus metrics endpoint will listen (example: `:8080`). The default is empty string, which means metrics endpoint is disabled. Only one of `--metrics-address` and `--http-endpoint` can be set.")
 	httpEndpoint   = flag.String("http-endpoint", "", "The TCP network address where the HTTP server for diagnostics, including metrics and leader election health check, will listen (example: `:8080`). The default is empty string, which means the server is disabled. Only one of `--metrics-address` and `--http-endpoint` can be set.")
@@ -76,10 +98,21 @@ var (
 
 	kubeAPIQPS   = flag.Float64("kube-api-qps", 5, "QPS to use while communicating with the kubernetes apiserver. Defaults to 5.0.")
 	kubeAPIBurst = flag.Int("kube-api-burst", 10, "Burst to use while communicating with the kubernetes apiserver. Defaults to 10.")
+
+	capabilitiesResync   = flag.Duration("capabilities-resync", 0, "Interval of re-discovering capabilities of the CSI driver. Capabilities are re-discovered also after reconnecting to the driver, see --exit-on-connection-loss. 0 disables the periodic re-discovery.")
+	dryRun               = flag.Bool("dry-run", false, "Log ControllerPublish and ControllerUnpublish requests instead of sending them to the CSI driver. All changes of Kubernetes objects are sent with server-side dry run, so nothing is persisted. Reconciliation with the CSI driver is disabled. It can't be used together with --leader-election and --shards.")
+	exitOnConnectionLoss = flag.Bool("exit-on-connection-loss", true, "Exit when connection to the CSI driver is lost. When false, processing of VolumeAttachments is paused until the driver is available again.")
 )
 
 var (
 	version = "unknown"
+
+	// unhealthyNodePolicy is parsed from --unhealthy-node-policy and
+	// --unhealthy-node-taints.
+	unhealthyNodePolicy controller.UnhealthyNodePolicy
+	// nodeSelector is parsed from --node-selector. It's nil when the
+	// attacher processes VolumeAttachments of all nodes.
+	nodeSelector labels.Selector
 )
 
 type leaderElection interface {
@@ -116,67 +149,139 @@ func main() {
 	config.QPS = (float32)(*kubeAPIQPS)
 	config.Burst = *kubeAPIBurst
 
-	if *workerThreads == 0 {
-		klog.Error("option -worker-threads must be greater than zero")
+	if *dryRun {
+		// Leases would not be persisted either, the attacher would think
+		// it holds Leases it never wrote.
+		if *enableLeaderElection {
+			klog.Error("only one of --dry-run and --leader-election can be set")
+			os.Exit(1)
+		}
+		if *shards > 1 {
+			klog.Error("only one of --dry-run and --shards can be set")
+			os.Exit(1)
+		}
+		klog.Warning("Running in dry run mode, CSI driver and Kubernetes objects won't be modified")
+		config.Wrap(newDryRunRoundTripper)
+	}
+
+	if *listVolumesMaxEntries < 0 {
+		klog.Error("option -list-volumes-max-entries must not be negative")
 		os.Exit(1)
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	unhealthyNodePolicy.Action, err = controller.ParseUnhealthyNodeAction(*unhealthyNodePolicyFlag)
 	if err != nil {
 		klog.Error(err.Error())
 		os.Exit(1)
 	}
+	for _, key := range strings.Split(*unhealthyNodeTaints, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			unhealthyNodePolicy.TaintKeys = append(unhealthyNodePolicy.TaintKeys, key)
+		}
+	}
 
-	factory := informers.NewSharedInformerFactory(clientset, *resync)
-	var handler controller.Handler
-	metricsManager := metrics.NewCSIMetricsManager("" /* driverName */)
+	if *nodeSelectorFlag != "" {
+		nodeSelector, err = labels.Parse(*nodeSelectorFlag)
+		if err != nil {
+			klog.Errorf("Failed to parse --node-selector: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	if *secretLabelSelector != "" {
+		if _, err := labels.Parse(*secretLabelSelector); err != nil {
+			klog.Errorf("Failed to parse --secret-label-selector: %s", err)
+			os.Exit(1)
+		}
+	}
 
-	// Connect to CSI.
-	csiConn, err := connection.Connect(*csiAddress, metricsManager, connection.OnConnectionLoss(connection.ExitOnConnectionLoss()))
+	shardKeyValue, err := controller.ParseShardKey(*shardKey)
 	if err != nil {
 		klog.Error(err.Error())
 		os.Exit(1)
 	}
+	if *shards > 1 && *enableLeaderElection {
+		// Replicas coordinate through shard Leases instead.
+		klog.Warning("Leader election is disabled when --shards is set")
+		*enableLeaderElection = false
+	}
 
-	err = rpc.ProbeForever(csiConn, *timeout)
-	if err != nil {
-		klog.Error(err.Error())
+	var nodeName string
+	if *nodeDeployment {
+		nodeName = os.Getenv("NODE_NAME")
+		if nodeName == "" {
+			klog.Error("NODE_NAME environment variable must be set with --node-deployment")
+			os.Exit(1)
+		}
+		if *shards > 1 {
+			klog.Error("only one of --node-deployment and --shards can be set")
+			os.Exit(1)
+		}
+		if *enableLeaderElection {
+			// Each node has its own attacher, there is nothing to
+			// compete for.
+			klog.Warning("Leader election is disabled with --node-deployment")
+			*enableLeaderElection = false
+		}
+	}
+
+	if *workerThreads == 0 {
+		klog.Error("option -worker-threads must be greater than zero")
 		os.Exit(1)
 	}
 
-	// Find driver name.
-	ctx, cancel := context.WithTimeout(context.Background(), csiTimeout)
-	defer cancel()
-	csiAttacher, err := rpc.GetDriverName(ctx, csiConn)
+	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		klog.Error(err.Error())
 		os.Exit(1)
 	}
-	klog.V(2).Infof("CSI driver name: %q", csiAttacher)
 
-	translator := csitrans.New()
-	if translator.IsMigratedCSIDriverByName(csiAttacher) {
-		metricsManager = metrics.NewCSIMetricsManagerWithOptions(csiAttacher, metrics.WithMigration())
-		migratedCsiClient, err := connection.Connect(*csiAddress, metricsManager, connection.OnConnectionLoss(connection.ExitOnConnectionLoss()))
-		if err != nil {
-			klog.Error(err.Error())
-			os.Exit(1)
-		}
-		csiConn.Close()
-		csiConn = migratedCsiClient
+	factory := informers.NewSharedInformerFactory(clientset, *resync)
+	// Secrets are watched only in namespaces referenced by PVs, filtered by
+	// labels.
+	var secretCache *controller.SecretCache
+	if *watchSecrets {
+		secretCache = controller.NewSecretCache(clientset, factory.Core().V1().PersistentVolumes(), *resync, *secretLabelSelector)
+	}
 
-		err = rpc.ProbeForever(csiConn, *timeout)
+	var drivers []*csiDriver
+	var driverNames []string
+	for _, address := range strings.Split(*csiAddress, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		// All drivers share one HTTP endpoint, only the first one
+		// registers process start time.
+		d, err := connectDriver(address, len(drivers) == 0)
 		if err != nil {
-			klog.Error(err.Error())
+			klog.Errorf("Failed to connect to CSI driver at %s: %v", address, err)
 			os.Exit(1)
 		}
+		for _, other := range drivers {
+			if other.name == d.name {
+				klog.Errorf("CSI driver %q is available both at %s and %s", d.name, other.address, d.address)
+				os.Exit(1)
+			}
+		}
+		d.secretCache = secretCache
+		drivers = append(drivers, d)
+		driverNames = append(driverNames, d.name)
+	}
+	if len(drivers) == 0 {
+		klog.Error("option -csi-address must not be empty")
+		os.Exit(1)
 	}
 
 	// Prepare http endpoint for metrics + leader election healthz
 	mux := http.NewServeMux()
 	if addr != "" {
-		metricsManager.RegisterToServer(mux, *metricsPath)
-		metricsManager.SetDriverName(csiAttacher)
+		registries := prometheus.Gatherers{}
+		for _, d := range drivers {
+			registries = append(registries, d.metricsManager.GetRegistry())
+		}
+		controller.RegisterMetrics(drivers[0].metricsManager.GetRegistry())
+		mux.Handle(*metricsPath, k8smetrics.HandlerFor(registries, k8smetrics.HandlerOpts{ErrorHandling: k8smetrics.ContinueOnError}))
 		go func() {
 			klog.Infof("ServeMux listening at %q", addr)
 			err := http.ListenAndServe(addr, mux)
@@ -186,64 +291,86 @@ func main() {
 		}()
 	}
 
-	supportsService, err := supportsPluginControllerService(ctx, csiConn)
-	if err != nil {
-		klog.Error(err.Error())
+	// Register the informers used by the handlers before the informer
+	// factory is started, the handlers may be replaced later.
+	factory.Core().V1().PersistentVolumes().Informer()
+	if err := controller.AddVAIndexers(factory.Storage().V1().VolumeAttachments().Informer()); err != nil {
+		klog.Errorf("Failed to add VolumeAttachment indexers: %s", err)
 		os.Exit(1)
 	}
-	if !supportsService {
-		handler = controller.NewTrivialHandler(clientset)
-		klog.V(2).Infof("CSI driver does not support Plugin Controller Service, using trivial handler")
-	} else {
-		// Find out if the driver supports attach/detach.
-		supportsAttach, supportsReadOnly, err := supportsControllerPublish(ctx, csiConn)
-		if err != nil {
-			klog.Error(err.Error())
-			os.Exit(1)
-		}
-		if supportsAttach {
-			pvLister := factory.Core().V1().PersistentVolumes().Lister()
-			vaLister := factory.Storage().V1().VolumeAttachments().Lister()
-			csiNodeLister := factory.Storage().V1().CSINodes().Lister()
-			volAttacher := attacher.NewAttacher(csiConn)
-			CSIVolumeLister := attacher.NewVolumeLister(csiConn)
-			handler = controller.NewCSIHandler(clientset, csiAttacher, volAttacher, CSIVolumeLister, pvLister, csiNodeLister, vaLister, timeout, supportsReadOnly, csitrans.New())
-			klog.V(2).Infof("CSI driver supports ControllerPublishUnpublish, using real CSI handler")
-		} else {
-			handler = controller.NewTrivialHandler(clientset)
-			klog.V(2).Infof("CSI driver does not support ControllerPublishUnpublish, using trivial handler")
-		}
+	factory.Storage().V1().CSINodes().Informer()
+	if watchNodes() {
+		factory.Core().V1().Nodes().Informer()
 	}
 
-	slvpn, err := supportsListVolumesPublishedNodes(ctx, csiConn)
-	if err != nil {
-		klog.Errorf("Failed to check if driver supports ListVolumesPublishedNodes, assuming it does not: %v", err)
+	for _, d := range drivers {
+		d.newController(clientset, factory)
+		if nodeName != "" {
+			d.ctrl.SetNodeName(nodeName)
+		}
+		d.ctrl.SetShutdownGracePeriod(*shutdownGracePeriod)
+		d.watchCapabilities(clientset, factory)
 	}
 
-	if slvpn {
-		klog.V(2).Infof("CSI driver supports list volumes published nodes. Using capability to reconcile volume attachment objects with actual backend state")
+	var shardManager *sharding.Manager
+	if *shards > 1 {
+		identity, err := os.Hostname()
+		if err != nil {
+			klog.Fatalf("Failed to get hostname: %v", err)
+		}
+		namespace := *leaderElectionNamespace
+		if namespace == "" {
+			namespace = inClusterNamespace()
+		}
+		shardManager = sharding.NewManager(clientset, namespace, "external-attacher-"+lockSuffix(driverNames, nodeSelector), identity, *shards, *leaderElectionLeaseDuration, *leaderElectionRetryPeriod, func() {
+			for _, d := range drivers {
+				d.ctrl.ShardsChanged()
+			}
+		})
+		for _, d := range drivers {
+			d.ctrl.SetSharding(shardManager, shardKeyValue)
+		}
 	}
 
-	ctrl := controller.NewCSIAttachController(
-		clientset,
-		csiAttacher,
-		handler,
-		factory.Storage().V1().VolumeAttachments(),
-		factory.Core().V1().PersistentVolumes(),
-		workqueue.NewItemExponentialFailureRateLimiter(*retryIntervalStart, *retryIntervalMax),
-		workqueue.NewItemExponentialFailureRateLimiter(*retryIntervalStart, *retryIntervalMax),
-		slvpn,
-		*reconcileSync,
-	)
-
 	run := func(ctx context.Context) {
 		stopCh := ctx.Done()
 		factory.Start(stopCh)
-		ctrl.Run(int(*workerThreads), stopCh)
+		if secretCache != nil {
+			go secretCache.Run(stopCh)
+		}
+		if shardManager != nil {
+			// Acquire shards only after the informers are synced,
+			// ShardsChanged needs all VolumeAttachments. Release them
+			// only after running operations finished.
+			factory.WaitForCacheSync(stopCh)
+			shardCtx, shardCancel := context.WithCancel(context.Background())
+			shardDone := make(chan struct{})
+			go func() {
+				defer close(shardDone)
+				shardManager.Run(shardCtx)
+			}()
+			defer func() {
+				shardCancel()
+				<-shardDone
+			}()
+		}
+		var wg sync.WaitGroup
+		for _, d := range drivers {
+			wg.Add(1)
+			go func(d *csiDriver) {
+				defer wg.Done()
+				d.ctrl.Run(int(*workerThreads), stopCh)
+			}(d)
+		}
+		wg.Wait()
 	}
 
+	// Stop on SIGTERM, e.g. during a rolling update, and on SIGINT.
+	stop, stopCancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stopCancel()
+
 	if !*enableLeaderElection {
-		run(context.TODO())
+		run(stop)
 	} else {
 		// Create a new clientset for leader election. When the attacher
 		// gets busy and its client gets throttled, the leader election
@@ -253,59 +380,78 @@ func main() {
 			klog.Fatalf("Failed to create leaderelection client: %v", err)
 		}
 
-		// Name of config map with leader election lock
-		lockName := "external-attacher-leader-" + csiAttacher
-		le := leaderelection.NewLeaderElection(leClientset, lockName, run)
-		if *httpEndpoint != "" {
-			le.PrepareHealthCheck(mux, leaderelection.DefaultHealthCheckTimeout)
-		}
-
-		if *leaderElectionNamespace != "" {
-			le.WithNamespace(*leaderElectionNamespace)
-		}
-
-		le.WithLeaseDuration(*leaderElectionLeaseDuration)
-		le.WithRenewDeadline(*leaderElectionRenewDeadline)
-		le.WithRetryPeriod(*leaderElectionRetryPeriod)
-
-		if err := le.Run(); err != nil {
+		// Name of the leader election Lease
+		lockName := "external-attacher-leader-" + lockSuffix(driverNames, nodeSelector)
+		if err := runWithLeaderElection(stop, leClientset, lockName, mux, run); err != nil {
 			klog.Fatalf("failed to initialize leader election: %v", err)
 		}
 	}
+	klog.Info("Shut down")
 }
 
-func buildConfig(kubeconfig string) (*rest.Config, error) {
-	if kubeconfig != "" {
-		return clientcmd.BuildConfigFromFlags("", kubeconfig)
-	}
-	return rest.InClusterConfig()
+// dryRunRoundTripper sends all requests that modify objects with server-side
+// dry run. The API server validates them, but it does not persist them.
+type dryRunRoundTripper struct {
+	rt http.RoundTripper
 }
 
-func supportsControllerPublish(ctx context.Context, csiConn *grpc.ClientConn) (supportsControllerPublish bool, supportsPublishReadOnly bool, err error) {
-	caps, err := rpc.GetControllerCapabilities(ctx, csiConn)
-	if err != nil {
-		return false, false, err
+func newDryRunRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	return &dryRunRoundTripper{rt: rt}
+}
+
+func (d *dryRunRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return d.rt.RoundTrip(req)
 	}
+	req = req.Clone(req.Context())
+	query := req.URL.Query()
+	query.Set("dryRun", metav1.DryRunAll)
+	req.URL.RawQuery = query.Encode()
+	klog.V(4).Infof("Dry run: %s %s", req.Method, req.URL.Path)
+	return d.rt.RoundTrip(req)
+}
 
-	supportsControllerPublish = caps[csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME]
-	supportsPublishReadOnly = caps[csi.ControllerServiceCapability_RPC_PUBLISH_READONLY]
-	return supportsControllerPublish, supportsPublishReadOnly, nil
+// watchNodes returns true when the handlers or the controllers need a Node
+// lister.
+func watchNodes() bool {
+	return unhealthyNodePolicy.Action != controller.UnhealthyNodeAllow || *forceDetachGracePeriod > 0 || nodeSelector != nil
 }
 
-func supportsListVolumesPublishedNodes(ctx context.Context, csiConn *grpc.ClientConn) (bool, error) {
-	caps, err := rpc.GetControllerCapabilities(ctx, csiConn)
-	if err != nil {
-		return false, fmt.Errorf("failed to get controller capabilities: %v", err)
+// lockSuffix returns the part of Lease names that identifies this attacher
+// instance: sorted names of its drivers and a hash of its node selector.
+// Instances of the same drivers with different node selectors don't share
+// Leases, instances with the same drivers in --csi-address in a different
+// order do.
+func lockSuffix(driverNames []string, selector labels.Selector) string {
+	sorted := append([]string(nil), driverNames...)
+	sort.Strings(sorted)
+	suffix := strings.Join(sorted, "-")
+	if selector == nil {
+		return suffix
 	}
-
-	return caps[csi.ControllerServiceCapability_RPC_LIST_VOLUMES] && caps[csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES], nil
+	h := fnv.New32a()
+	h.Write([]byte(selector.String()))
+	return fmt.Sprintf("%s-%08x", suffix, h.Sum32())
 }
 
-func supportsPluginControllerService(ctx context.Context, csiConn *grpc.ClientConn) (bool, error) {
-	caps, err := rpc.GetPluginCapabilities(ctx, csiConn)
-	if err != nil {
-		return false, err
+// inClusterNamespace returns the namespace of the pod, or "default" when
+// running out of cluster.
+func inClusterNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
 	}
+	if data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		if ns := strings.TrimSpace(string(data)); len(ns) > 0 {
+			return ns
+		}
+	}
+	return "default"
+}
 
-	return caps[csi.PluginCapability_Service_CONTROLLER_SERVICE], nil
+func buildConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	return rest.InClusterConfig()
 }
@@ -0,0 +1,86 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestLockSuffix(t *testing.T) {
+	zoneA := labels.SelectorFromSet(labels.Set{"zone": "a"})
+	zoneB := labels.SelectorFromSet(labels.Set{"zone": "b"})
+	tests := []struct {
+		name             string
+		driverNames      []string
+		otherDriverNames []string
+		selector         labels.Selector
+		otherSelector    labels.Selector
+		expectSame       bool
+	}{
+		{
+			name:             "same drivers in a different order",
+			driverNames:      []string{"csi.a", "csi.b"},
+			otherDriverNames: []string{"csi.b", "csi.a"},
+			expectSame:       true,
+		},
+		{
+			name:             "same drivers in a different order with selector",
+			driverNames:      []string{"csi.a", "csi.b"},
+			otherDriverNames: []string{"csi.b", "csi.a"},
+			selector:         zoneA,
+			otherSelector:    zoneA,
+			expectSame:       true,
+		},
+		{
+			name:             "different drivers",
+			driverNames:      []string{"csi.a"},
+			otherDriverNames: []string{"csi.b"},
+		},
+		{
+			name:             "different selectors",
+			driverNames:      []string{"csi.a"},
+			otherDriverNames: []string{"csi.a"},
+			selector:         zoneA,
+			otherSelector:    zoneB,
+		},
+		{
+			name:             "selector and no selector",
+			driverNames:      []string{"csi.a"},
+			otherDriverNames: []string{"csi.a"},
+			selector:         zoneA,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			driverNames := append([]string(nil), test.driverNames...)
+			suffix := lockSuffix(test.driverNames, test.selector)
+			otherSuffix := lockSuffix(test.otherDriverNames, test.otherSelector)
+			if same := suffix == otherSuffix; same != test.expectSame {
+				t.Errorf("expected same suffix %v, got %q and %q", test.expectSame, suffix, otherSuffix)
+			}
+			for i := range driverNames {
+				if test.driverNames[i] != driverNames[i] {
+					t.Errorf("expected driver names not to be modified, got %v", test.driverNames)
+					break
+				}
+			}
+		})
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/mock/gomock"
@@ -382,3 +383,152 @@ func TestDetachAttach(t *testing.T) {
 		}
 	}
 }
+
+func TestListVolumes(t *testing.T) {
+	page := func(next string, volumes ...string) *csi.ListVolumesResponse {
+		rsp := &csi.ListVolumesResponse{NextToken: next}
+		for _, v := range volumes {
+			rsp.Entries = append(rsp.Entries, &csi.ListVolumesResponse_Entry{
+				Volume: &csi.Volume{VolumeId: v},
+				Status: &csi.ListVolumesResponse_VolumeStatus{
+					PublishedNodeIds: []string{"node-" + v},
+					VolumeCondition:  &csi.VolumeCondition{Abnormal: v == "c", Message: "condition-" + v},
+				},
+			})
+		}
+		return rsp
+	}
+	request := func(tok string) *csi.ListVolumesRequest {
+		return &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: tok}
+	}
+	volumeStatus := func(v string) VolumeStatus {
+		return VolumeStatus{
+			PublishedNodeIDs: []string{"node-" + v},
+			Condition:        &csi.VolumeCondition{Abnormal: v == "c", Message: "condition-" + v},
+		}
+	}
+	type call struct {
+		request  *csi.ListVolumesRequest
+		response *csi.ListVolumesResponse
+		err      codes.Code
+	}
+
+	tests := []struct {
+		name          string
+		calls         []call
+		expectedPages []map[string]VolumeStatus
+		expectError   bool
+	}{
+		{
+			name: "pages",
+			calls: []call{
+				{request(""), page("2", "a", "b"), codes.OK},
+				{request("2"), page("", "c"), codes.OK},
+			},
+			expectedPages: []map[string]VolumeStatus{
+				{"a": volumeStatus("a"), "b": volumeStatus("b")},
+				{"c": volumeStatus("c")},
+			},
+		},
+		{
+			name: "transient error is retried from the last token",
+			calls: []call{
+				{request(""), page("2", "a", "b"), codes.OK},
+				{request("2"), nil, codes.Unavailable},
+				{request("2"), nil, codes.DeadlineExceeded},
+				{request("2"), page("", "c"), codes.OK},
+			},
+			expectedPages: []map[string]VolumeStatus{
+				{"a": volumeStatus("a"), "b": volumeStatus("b")},
+				{"c": volumeStatus("c")},
+			},
+		},
+		{
+			name: "final error is not retried",
+			calls: []call{
+				{request(""), page("2", "a", "b"), codes.OK},
+				{request("2"), nil, codes.Aborted},
+			},
+			expectedPages: []map[string]VolumeStatus{
+				{"a": volumeStatus("a"), "b": volumeStatus("b")},
+			},
+			expectError: true,
+		},
+		{
+			name: "retries are exhausted",
+			calls: []call{
+				{request(""), nil, codes.Unavailable},
+				{request(""), nil, codes.Unavailable},
+				{request(""), nil, codes.Unavailable},
+			},
+			expectError: true,
+		},
+	}
+
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	for _, test := range tests {
+		var expectations []*gomock.Call
+		for _, c := range test.calls {
+			var injectedErr error
+			if c.err != codes.OK {
+				injectedErr = status.Error(c.err, fmt.Sprintf("Injecting error %d", c.err))
+			}
+			expectations = append(expectations, controllerServer.EXPECT().ListVolumes(gomock.Any(), pbMatch(c.request)).Return(c.response, injectedErr).Times(1))
+		}
+		gomock.InOrder(expectations...)
+
+		l := NewVolumeLister(csiConn, 2, time.Second)
+		l.retries = 2
+		l.retryInterval = time.Millisecond
+		var pages []map[string]VolumeStatus
+		err := l.ListVolumes(context.Background(), func(page map[string]VolumeStatus) {
+			pages = append(pages, page)
+		})
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(pages, test.expectedPages) {
+			t.Errorf("test %q: expected pages %v, got %v", test.name, test.expectedPages, pages)
+		}
+	}
+}
+
+func TestDryRunAttacher(t *testing.T) {
+	a := NewDryRunAttacher()
+	secrets := map[string]string{"password": "secret"}
+	caps := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+
+	metadata, detached, err := a.Attach(context.Background(), "vol", false, "node", caps, nil, secrets)
+	if err != nil || detached || metadata != nil {
+		t.Errorf("expected dry run attach to succeed, got metadata %v, detached %v, error %v", metadata, detached, err)
+	}
+	if err := a.Detach(context.Background(), "vol", "node", secrets); err != nil {
+		t.Errorf("expected dry run detach to succeed, got %v", err)
+	}
+
+	l := NewDryRunVolumeLister()
+	err = l.ListVolumes(context.Background(), func(page map[string]VolumeStatus) {
+		t.Errorf("expected no volumes, got %v", page)
+	})
+	if err != nil {
+		t.Errorf("expected dry run ListVolumes to succeed, got %v", err)
+	}
+}
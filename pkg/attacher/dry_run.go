@@ -0,0 +1,81 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package attacher
+
+import (
+	"context"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"k8s.io/klog/v2"
+)
+
+// dryRunAttacher is an Attacher that logs ControllerPublish / ControllerUnpublish
+// requests instead of sending them to the CSI driver. All calls succeed.
+type dryRunAttacher struct{}
+
+var _ Attacher = &dryRunAttacher{}
+
+// NewDryRunAttacher provides a new Attacher that only logs requests it would
+// send to the CSI driver.
+func NewDryRunAttacher() Attacher {
+	return &dryRunAttacher{}
+}
+
+func (a *dryRunAttacher) Attach(ctx context.Context, volumeID string, readOnly bool, nodeID string, caps *csi.VolumeCapability, context, secrets map[string]string) (metadata map[string]string, detached bool, err error) {
+	req := csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           nodeID,
+		VolumeCapability: caps,
+		Readonly:         readOnly,
+		VolumeContext:    context,
+		Secrets:          secrets,
+	}
+	klog.Infof("Dry run: ControllerPublishVolume request: %s", protosanitizer.StripSecrets(&req))
+	return nil, false, nil
+}
+
+func (a *dryRunAttacher) Detach(ctx context.Context, volumeID string, nodeID string, secrets map[string]string) error {
+	req := csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   nodeID,
+		Secrets:  secrets,
+	}
+	klog.Infof("Dry run: ControllerUnpublishVolume request: %s", protosanitizer.StripSecrets(&req))
+	return nil
+}
+
+// DryRunVolumeLister is a volume lister that does not call the CSI driver and
+// reports no volumes.
+type DryRunVolumeLister struct{}
+
+// NewDryRunVolumeLister provides a new DryRunVolumeLister.
+func NewDryRunVolumeLister() *DryRunVolumeLister {
+	return &DryRunVolumeLister{}
+}
+
+// ListVolumes does not call processPage, there are no volumes.
+func (l *DryRunVolumeLister) ListVolumes(ctx context.Context, processPage func(page map[string]VolumeStatus)) error {
+	klog.V(4).Infof("Dry run: skipping ListVolumes")
+	return nil
+}
+
+// GetVolumeStatus reports the volume as published on no nodes.
+func (l *DryRunVolumeLister) GetVolumeStatus(ctx context.Context, volumeID string) (*VolumeStatus, error) {
+	klog.V(4).Infof("Dry run: skipping ControllerGetVolume of %s", volumeID)
+	return &VolumeStatus{}, nil
+}
@@ -19,40 +19,78 @@ package attacher
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
 )
 
+const (
+	// Number of retries of a ListVolumes page that failed with a transient
+	// error.
+	listVolumesRetries = 5
+	// Initial delay between retries of a ListVolumes page, it doubles with
+	// each retry.
+	listVolumesRetryInterval = time.Second
+)
+
+// VolumeStatus is the state of a volume reported by the CSI driver.
+type VolumeStatus struct {
+	// PublishedNodeIDs are IDs of nodes the volume is published on.
+	PublishedNodeIDs []string
+	// Condition is the health of the volume. It is nil when the driver does
+	// not report it.
+	Condition *csi.VolumeCondition
+}
+
 type CSIVolumeLister struct {
 	conn *grpc.ClientConn
+	// maxEntries is the page size of ListVolumes calls, 0 lets the driver
+	// choose.
+	maxEntries int32
+	// pageTimeout is the timeout of a single ListVolumes call.
+	pageTimeout   time.Duration
+	retries       int
+	retryInterval time.Duration
 }
 
 // NewVolumeLister provides a new VolumeLister object.
-func NewVolumeLister(conn *grpc.ClientConn) *CSIVolumeLister {
+func NewVolumeLister(conn *grpc.ClientConn, maxEntries int32, pageTimeout time.Duration) *CSIVolumeLister {
 	return &CSIVolumeLister{
-		conn: conn,
+		conn:          conn,
+		maxEntries:    maxEntries,
+		pageTimeout:   pageTimeout,
+		retries:       listVolumesRetries,
+		retryInterval: listVolumesRetryInterval,
 	}
 }
 
-func (a *CSIVolumeLister) ListVolumes(ctx context.Context) (map[string]([]string), error) {
+// ListVolumes pages through all volumes in the driver and calls processPage
+// with each page as a map with keys of VolumeID and values of the volume
+// status. A page that fails with a transient error is retried from the last
+// good token.
+func (a *CSIVolumeLister) ListVolumes(ctx context.Context, processPage func(page map[string]VolumeStatus)) error {
 	client := csi.NewControllerClient(a.conn)
 
-	p := map[string][]string{}
-
 	tok := ""
 	for {
-		rsp, err := client.ListVolumes(ctx, &csi.ListVolumesRequest{
-			StartingToken: tok,
-		})
+		rsp, err := a.listVolumesPage(ctx, client, tok)
 		if err != nil {
-			return nil, fmt.Errorf("failed to list volumes: %v", err)
+			return fmt.Errorf("failed to list volumes: %v", err)
 		}
 
+		p := make(map[string]VolumeStatus, len(rsp.Entries))
 		for _, e := range rsp.Entries {
-			p[e.GetVolume().VolumeId] = e.Status.PublishedNodeIds
+			p[e.GetVolume().GetVolumeId()] = VolumeStatus{
+				PublishedNodeIDs: e.GetStatus().GetPublishedNodeIds(),
+				Condition:        e.GetStatus().GetVolumeCondition(),
+			}
 		}
+		processPage(p)
 		tok = rsp.NextToken
 
 		if len(tok) == 0 {
@@ -60,5 +98,74 @@ func (a *CSIVolumeLister) ListVolumes(ctx context.Context) (map[string]([]string
 		}
 	}
 
-	return p, nil
+	return nil
+}
+
+// listVolumesPage gets one page of ListVolumes starting at the given token,
+// re-trying transient errors with exponential backoff.
+func (a *CSIVolumeLister) listVolumesPage(ctx context.Context, client csi.ControllerClient, tok string) (*csi.ListVolumesResponse, error) {
+	delay := a.retryInterval
+	for i := 0; ; i++ {
+		var pageCtx context.Context
+		var cancel context.CancelFunc
+		if a.pageTimeout > 0 {
+			pageCtx, cancel = context.WithTimeout(ctx, a.pageTimeout)
+		} else {
+			pageCtx, cancel = context.WithCancel(ctx)
+		}
+		rsp, err := client.ListVolumes(pageCtx, &csi.ListVolumesRequest{
+			MaxEntries:    a.maxEntries,
+			StartingToken: tok,
+		})
+		cancel()
+		if err == nil {
+			return rsp, nil
+		}
+		if i >= a.retries || !isTransientError(err) {
+			return nil, err
+		}
+		klog.V(4).Infof("ListVolumes page with starting token %q failed, retrying in %s: %v", tok, delay, err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// isTransientError returns true if a ListVolumes call failed with an error
+// that may go away when the same call is re-tried.
+func isTransientError(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch st.Code() {
+	case codes.Unavailable,
+		codes.DeadlineExceeded,
+		codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// GetVolumeStatus returns status of a single volume. A volume that the driver
+// does not know is not published anywhere.
+func (a *CSIVolumeLister) GetVolumeStatus(ctx context.Context, volumeID string) (*VolumeStatus, error) {
+	client := csi.NewControllerClient(a.conn)
+
+	rsp, err := client.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{
+		VolumeId: volumeID,
+	})
+	if err != nil {
+		if st, ok := status.FromError(err); ok && st.Code() == codes.NotFound {
+			return &VolumeStatus{}, nil
+		}
+		return nil, fmt.Errorf("failed to get volume %s: %v", volumeID, err)
+	}
+	return &VolumeStatus{
+		PublishedNodeIDs: rsp.GetStatus().GetPublishedNodeIds(),
+		Condition:        rsp.GetStatus().GetVolumeCondition(),
+	}, nil
 }
@@ -0,0 +1,166 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// attachReservations tracks VolumeAttachments that passed the attach limit
+// check of their node, but the informer may not show them as attached or
+// being attached yet. Without them, two workers could both see the last free
+// slot of a node and attach one volume over the limit.
+type attachReservations struct {
+	mux sync.Mutex
+	// reserved maps nodes to VolumeAttachments that reserved a slot there.
+	reserved map[string]sets.String
+	// nodes maps VolumeAttachments to the node of their reservation.
+	nodes map[string]string
+	// refused maps nodes to VolumeAttachments refused because the node had
+	// reached its limit, in the order they were refused.
+	refused map[string][]string
+}
+
+func newAttachReservations() *attachReservations {
+	return &attachReservations{
+		reserved: map[string]sets.String{},
+		nodes:    map[string]string{},
+		refused:  map[string][]string{},
+	}
+}
+
+// reserve takes a slot of the node for the VolumeAttachment when the node has
+// less than limit volumes attached. count returns VolumeAttachments of the
+// node that are attached or being attached according to the informer, except
+// the given one. It's called under the lock, so concurrent reservations of
+// the same node are serialized. A refused VolumeAttachment is returned by
+// waiting when a slot of the node gets free.
+func (r *attachReservations) reserve(nodeName, vaName string, limit int, count func() (sets.String, error)) (bool, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	counted, err := count()
+	if err != nil {
+		return false, err
+	}
+	if r.attachedLocked(nodeName, vaName, counted) >= limit {
+		r.refuseLocked(nodeName, vaName)
+		return false, nil
+	}
+	r.releaseLocked(vaName)
+	r.unrefuseLocked(nodeName, vaName)
+	if _, found := r.reserved[nodeName]; !found {
+		r.reserved[nodeName] = sets.NewString()
+	}
+	r.reserved[nodeName].Insert(vaName)
+	r.nodes[vaName] = nodeName
+	return true, nil
+}
+
+// waiting returns refused VolumeAttachments of the node, as many as there
+// are free slots, in the order they were refused. count returns all
+// VolumeAttachments of the node that are attached or being attached
+// according to the informer.
+func (r *attachReservations) waiting(nodeName string, limit int, count func() (sets.String, error)) ([]string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	refused := r.refused[nodeName]
+	if len(refused) == 0 {
+		return nil, nil
+	}
+	counted, err := count()
+	if err != nil {
+		return nil, err
+	}
+	free := limit - r.attachedLocked(nodeName, "", counted)
+	if free <= 0 {
+		return nil, nil
+	}
+	if free > len(refused) {
+		free = len(refused)
+	}
+	return append([]string(nil), refused[:free]...), nil
+}
+
+// release removes reservation of the VolumeAttachment, if there is any, and
+// forgets that it was refused. It returns the node of the released
+// reservation, or an empty string when there was none.
+func (r *attachReservations) release(vaName string) string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	nodeName := r.nodes[vaName]
+	r.releaseLocked(vaName)
+	for refusedNode := range r.refused {
+		r.unrefuseLocked(refusedNode, vaName)
+	}
+	return nodeName
+}
+
+// attachedLocked returns the number of volumes attached or being attached to
+// the node, except the given VolumeAttachment. Reservations of
+// VolumeAttachments that the informer already counts are not needed any
+// longer, they're released.
+func (r *attachReservations) attachedLocked(nodeName, vaName string, counted sets.String) int {
+	attached := counted.Len()
+	for _, other := range r.reserved[nodeName].UnsortedList() {
+		switch {
+		case counted.Has(other):
+			r.releaseLocked(other)
+		case other != vaName:
+			attached++
+		}
+	}
+	return attached
+}
+
+func (r *attachReservations) releaseLocked(vaName string) {
+	nodeName, found := r.nodes[vaName]
+	if !found {
+		return
+	}
+	delete(r.nodes, vaName)
+	r.reserved[nodeName].Delete(vaName)
+	if r.reserved[nodeName].Len() == 0 {
+		delete(r.reserved, nodeName)
+	}
+}
+
+func (r *attachReservations) refuseLocked(nodeName, vaName string) {
+	for _, refused := range r.refused[nodeName] {
+		if refused == vaName {
+			return
+		}
+	}
+	r.refused[nodeName] = append(r.refused[nodeName], vaName)
+}
+
+func (r *attachReservations) unrefuseLocked(nodeName, vaName string) {
+	refused := r.refused[nodeName]
+	for i := range refused {
+		if refused[i] != vaName {
+			continue
+		}
+		refused = append(refused[:i:i], refused[i+1:]...)
+		if len(refused) == 0 {
+			delete(r.refused, nodeName)
+		} else {
+			r.refused[nodeName] = refused
+		}
+		return
+	}
+}
@@ -18,12 +18,14 @@ package controller
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	coreinformers "k8s.io/client-go/informers/core/v1"
@@ -48,24 +50,64 @@ const (
 type CSIAttachController struct {
 	client        kubernetes.Interface
 	attacherName  string
-	handler       Handler
 	eventRecorder record.EventRecorder
 	vaQueue       workqueue.RateLimitingInterface
 	pvQueue       workqueue.RateLimitingInterface
 
 	vaLister       storagelisters.VolumeAttachmentLister
 	vaListerSynced cache.InformerSynced
+	// vaIndexer indexes VolumeAttachments by PV name, node name and
+	// attacher, see AddVAIndexers.
+	vaIndexer      cache.Indexer
 	pvLister       corelisters.PersistentVolumeLister
 	pvListerSynced cache.InformerSynced
-
+	// nodeLister and nodeListerSynced are nil when the controller does not
+	// watch nodes.
+	nodeLister       corelisters.NodeLister
+	nodeListerSynced cache.InformerSynced
+	// csiNodeListerSynced is nil when the controller does not watch
+	// CSINodes.
+	csiNodeListerSynced cache.InformerSynced
+	// nodeSelector is nil when the controller processes VolumeAttachments of
+	// all nodes.
+	nodeSelector labels.Selector
+
+	reconcileSync time.Duration
+	translator    AttacherCSITranslator
+
+	// handler and shouldReconcileVolumeAttachment can be changed at runtime
+	// by SetHandler, when capabilities of the CSI driver change.
+	handler                         Handler
 	shouldReconcileVolumeAttachment bool
-	reconcileSync                   time.Duration
-	translator                      AttacherCSITranslator
+	handlerMux                      sync.RWMutex
+
+	// resumed is closed while the controller processes its queues. It's
+	// replaced by a new channel when the controller is paused.
+	resumed    chan struct{}
+	resumedMux sync.Mutex
+
+	// nodeLimiter limits the number of VolumeAttachments processed per node.
+	nodeLimiter *nodeLimiter
+
+	// nodeName is set when the controller processes only VolumeAttachments
+	// of a single node.
+	nodeName string
+
+	// inFlight tracks running syncs of VolumeAttachments and PVs. Run waits
+	// up to shutdownGracePeriod for them after stopCh is closed.
+	inFlight            *inFlightTracker
+	shutdownGracePeriod time.Duration
+
+	// sharder is nil when the controller processes all VolumeAttachments.
+	sharder  Sharder
+	shardKey ShardKey
 }
 
 // Handler is responsible for handling VolumeAttachment events from informer.
 type Handler interface {
-	Init(vaQueue workqueue.RateLimitingInterface, pvQueue workqueue.RateLimitingInterface)
+	// Init provides the handler with the controller queues and the recorder
+	// used to report attach / detach progress as Kubernetes events.
+	Init(vaQueue workqueue.RateLimitingInterface, pvQueue workqueue.RateLimitingInterface, eventRecorder record.EventRecorder)
 
 	// SyncNewOrUpdatedVolumeAttachment processes one Add/Updated event from
 	// VolumeAttachment informers. It runs in a workqueue, guaranting that only
@@ -81,8 +123,12 @@ type Handler interface {
 	ReconcileVA() error
 }
 
-// NewCSIAttachController returns a new *CSIAttachController
-func NewCSIAttachController(client kubernetes.Interface, attacherName string, handler Handler, volumeAttachmentInformer storageinformers.VolumeAttachmentInformer, pvInformer coreinformers.PersistentVolumeInformer, vaRateLimiter, paRateLimiter workqueue.RateLimiter, shouldReconcileVolumeAttachment bool, reconcileSync time.Duration) *CSIAttachController {
+// NewCSIAttachController returns a new *CSIAttachController. nodeInformer may
+// be nil, unless nodeSelector is set or the handler reads Nodes, so workers
+// don't start before the Node cache is synced. csiNodeInformer and
+// secretCache may be nil, VolumeAttachments that wait for a CSINode or a
+// Secret are then retried only with exponential backoff.
+func NewCSIAttachController(client kubernetes.Interface, attacherName string, handler Handler, volumeAttachmentInformer storageinformers.VolumeAttachmentInformer, pvInformer coreinformers.PersistentVolumeInformer, nodeInformer coreinformers.NodeInformer, csiNodeInformer storageinformers.CSINodeInformer, secretCache *SecretCache, nodeSelector labels.Selector, vaRateLimiter, paRateLimiter workqueue.RateLimiter, shouldReconcileVolumeAttachment bool, reconcileSync time.Duration, maxInFlightPerNode int) *CSIAttachController {
 	broadcaster := record.NewBroadcaster()
 	broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: client.CoreV1().Events(v1.NamespaceAll)})
 	var eventRecorder record.EventRecorder
@@ -93,12 +139,19 @@ func NewCSIAttachController(client kubernetes.Interface, attacherName string, ha
 		attacherName:                    attacherName,
 		handler:                         handler,
 		eventRecorder:                   eventRecorder,
-		vaQueue:                         workqueue.NewNamedRateLimitingQueue(vaRateLimiter, "csi-attacher-va"),
-		pvQueue:                         workqueue.NewNamedRateLimitingQueue(paRateLimiter, "csi-attacher-pv"),
+		pvQueue:                         workqueue.NewNamedRateLimitingQueue(paRateLimiter, "csi-attacher-pv-"+SanitizeDriverName(attacherName)),
 		shouldReconcileVolumeAttachment: shouldReconcileVolumeAttachment,
 		reconcileSync:                   reconcileSync,
 		translator:                      csitrans.New(),
+		resumed:                         make(chan struct{}),
+		nodeLimiter:                     newNodeLimiter(maxInFlightPerNode),
+		nodeSelector:                    nodeSelector,
+		inFlight:                        newInFlightTracker(),
 	}
+	close(ctrl.resumed)
+	// Queue names include the driver name, so metrics of controllers of
+	// different drivers in one process are not merged.
+	ctrl.vaQueue = newVAQueue(vaRateLimiter, "csi-attacher-va-"+SanitizeDriverName(attacherName), ctrl.vaPriority)
 
 	volumeAttachmentInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    ctrl.vaAdded,
@@ -107,6 +160,7 @@ func NewCSIAttachController(client kubernetes.Interface, attacherName string, ha
 	})
 	ctrl.vaLister = volumeAttachmentInformer.Lister()
 	ctrl.vaListerSynced = volumeAttachmentInformer.Informer().HasSynced
+	ctrl.vaIndexer = volumeAttachmentInformer.Informer().GetIndexer()
 
 	pvInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    ctrl.pvAdded,
@@ -115,11 +169,63 @@ func NewCSIAttachController(client kubernetes.Interface, attacherName string, ha
 	})
 	ctrl.pvLister = pvInformer.Lister()
 	ctrl.pvListerSynced = pvInformer.Informer().HasSynced
-	ctrl.handler.Init(ctrl.vaQueue, ctrl.pvQueue)
+	if nodeInformer != nil {
+		nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    ctrl.nodeAdded,
+			UpdateFunc: ctrl.nodeUpdated,
+		})
+		ctrl.nodeLister = nodeInformer.Lister()
+		ctrl.nodeListerSynced = nodeInformer.Informer().HasSynced
+	}
+	if csiNodeInformer != nil {
+		csiNodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    ctrl.csiNodeAdded,
+			UpdateFunc: ctrl.csiNodeUpdated,
+		})
+		ctrl.csiNodeListerSynced = csiNodeInformer.Informer().HasSynced
+	}
+	if secretCache != nil {
+		// Namespaces are watched on demand, Secrets missing in the cache
+		// are read from the API server, there is no need to wait for
+		// the cache to sync.
+		secretCache.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    ctrl.secretAdded,
+			UpdateFunc: ctrl.secretUpdated,
+		})
+	}
+	ctrl.initHandler(ctrl.handler)
 
 	return ctrl
 }
 
+// SetHandler replaces the handler of the controller, e.g. when capabilities of
+// the CSI driver have changed. Syncs that are already running finish with the
+// old handler.
+func (ctrl *CSIAttachController) SetHandler(handler Handler, shouldReconcileVolumeAttachment bool) {
+	ctrl.initHandler(handler)
+
+	ctrl.handlerMux.Lock()
+	defer ctrl.handlerMux.Unlock()
+	ctrl.handler = handler
+	ctrl.shouldReconcileVolumeAttachment = shouldReconcileVolumeAttachment
+}
+
+// SetShutdownGracePeriod sets how long Run waits for running syncs after
+// stopCh is closed. Attach and detach calls that are already running can
+// finish and save their result to the VolumeAttachment. It must be called
+// before Run.
+func (ctrl *CSIAttachController) SetShutdownGracePeriod(gracePeriod time.Duration) {
+	ctrl.shutdownGracePeriod = gracePeriod
+}
+
+// getHandler returns the current handler and whether VolumeAttachments should
+// be reconciled with it.
+func (ctrl *CSIAttachController) getHandler() (Handler, bool) {
+	ctrl.handlerMux.RLock()
+	defer ctrl.handlerMux.RUnlock()
+	return ctrl.handler, ctrl.shouldReconcileVolumeAttachment
+}
+
 // Run starts CSI attacher and listens on channel events
 func (ctrl *CSIAttachController) Run(workers int, stopCh <-chan struct{}) {
 	defer ctrl.vaQueue.ShutDown()
@@ -128,30 +234,119 @@ func (ctrl *CSIAttachController) Run(workers int, stopCh <-chan struct{}) {
 	klog.Infof("Starting CSI attacher")
 	defer klog.Infof("Shutting CSI attacher")
 
-	if !cache.WaitForCacheSync(stopCh, ctrl.vaListerSynced, ctrl.pvListerSynced) {
+	synced := []cache.InformerSynced{ctrl.vaListerSynced, ctrl.pvListerSynced}
+	for _, s := range []cache.InformerSynced{ctrl.nodeListerSynced, ctrl.csiNodeListerSynced} {
+		if s != nil {
+			synced = append(synced, s)
+		}
+	}
+	if !cache.WaitForCacheSync(stopCh, synced...) {
 		klog.Errorf("Cannot sync caches")
 		return
 	}
 	for i := 0; i < workers; i++ {
-		go wait.Until(ctrl.syncVA, 0, stopCh)
-		go wait.Until(ctrl.syncPV, 0, stopCh)
-	}
-
-	if ctrl.shouldReconcileVolumeAttachment {
 		go wait.Until(func() {
-			err := ctrl.handler.ReconcileVA()
-			if err != nil {
-				klog.Errorf("Failed to reconcile volume attachments: %v", err)
+			if ctrl.waitUntilResumed(stopCh) {
+				ctrl.syncVA(stopCh)
+			}
+		}, 0, stopCh)
+		go wait.Until(func() {
+			if ctrl.waitUntilResumed(stopCh) {
+				ctrl.syncPV(stopCh)
 			}
-		}, ctrl.reconcileSync, stopCh)
+		}, 0, stopCh)
 	}
 
+	// The reconciler can be enabled later by SetHandler.
+	go wait.Until(func() {
+		handler, shouldReconcile := ctrl.getHandler()
+		if !shouldReconcile || !ctrl.waitUntilResumed(stopCh) {
+			return
+		}
+		err := handler.ReconcileVA()
+		if err != nil {
+			klog.Errorf("Failed to reconcile volume attachments: %v", err)
+		}
+	}, ctrl.reconcileSync, stopCh)
+
 	<-stopCh
+	klog.Infof("Waiting up to %s for running operations to finish", ctrl.shutdownGracePeriod)
+	if pending := ctrl.inFlight.drain(ctrl.shutdownGracePeriod); pending > 0 {
+		klog.Warningf("%d operations did not finish before shutdown", pending)
+	}
+}
+
+// startSync returns false when the controller is shutting down and the item
+// from the queue should not be processed. Otherwise the caller must call
+// ctrl.inFlight.finish when done.
+func (ctrl *CSIAttachController) startSync(stopCh <-chan struct{}) bool {
+	select {
+	case <-stopCh:
+		return false
+	default:
+	}
+	return ctrl.inFlight.start()
+}
+
+// Pause stops processing of the VA and PV queues and VA reconciliation, e.g.
+// when the CSI driver is not available. Items added to the queues while paused
+// are processed after Resume. Syncs that are already running are not
+// interrupted.
+func (ctrl *CSIAttachController) Pause() {
+	ctrl.resumedMux.Lock()
+	defer ctrl.resumedMux.Unlock()
+	select {
+	case <-ctrl.resumed:
+		ctrl.resumed = make(chan struct{})
+	default:
+		// Already paused
+	}
+}
+
+// Resume continues processing of the queues stopped by Pause.
+func (ctrl *CSIAttachController) Resume() {
+	ctrl.resumedMux.Lock()
+	defer ctrl.resumedMux.Unlock()
+	select {
+	case <-ctrl.resumed:
+		// Not paused
+	default:
+		close(ctrl.resumed)
+	}
+}
+
+// isPaused returns true between Pause and Resume.
+func (ctrl *CSIAttachController) isPaused() bool {
+	ctrl.resumedMux.Lock()
+	defer ctrl.resumedMux.Unlock()
+	select {
+	case <-ctrl.resumed:
+		return false
+	default:
+		return true
+	}
+}
+
+// waitUntilResumed blocks while the controller is paused. It returns false
+// when stopCh was closed in the meantime.
+func (ctrl *CSIAttachController) waitUntilResumed(stopCh <-chan struct{}) bool {
+	ctrl.resumedMux.Lock()
+	resumed := ctrl.resumed
+	ctrl.resumedMux.Unlock()
+	select {
+	case <-resumed:
+		return true
+	case <-stopCh:
+		return false
+	}
 }
 
 // vaAdded reacts to a VolumeAttachment creation
 func (ctrl *CSIAttachController) vaAdded(obj interface{}) {
 	va := obj.(*storage.VolumeAttachment)
+	if !ctrl.shouldHandleVA(va) {
+		return
+	}
 	ctrl.vaQueue.Add(va.Name)
 }
 
@@ -159,6 +354,14 @@ func (ctrl *CSIAttachController) vaAdded(obj interface{}) {
 func (ctrl *CSIAttachController) vaUpdated(old, new interface{}) {
 	oldVA := old.(*storage.VolumeAttachment)
 	newVA := new.(*storage.VolumeAttachment)
+	if ctrl.usesAttachSlot(oldVA) && !ctrl.usesAttachSlot(newVA) {
+		// The volume was detached. VolumeAttachments of other shards
+		// may wait for the slot too, check them before filtering.
+		ctrl.attachSlotFreed(newVA.Spec.NodeName)
+	}
+	if !ctrl.shouldHandleVA(newVA) {
+		return
+	}
 	if shouldEnqueueVAChange(oldVA, newVA) {
 		ctrl.vaQueue.Add(newVA.Name)
 	} else {
@@ -172,16 +375,284 @@ func (ctrl *CSIAttachController) vaDeleted(obj interface{}) {
 		obj = unknown.Obj
 	}
 	va := obj.(*storage.VolumeAttachment)
-	if va != nil && va.Spec.Source.PersistentVolumeName != nil {
+	if va != nil && va.Spec.Attacher == ctrl.attacherName {
+		ctrl.forgetVA(va.Name)
+	}
+	if va != nil && ctrl.usesAttachSlot(va) {
+		// Deleted with the finalizer, the update that removed it was
+		// missed.
+		ctrl.attachSlotFreed(va.Spec.NodeName)
+	}
+	if va != nil && ctrl.shouldHandleVA(va) && va.Spec.Source.PersistentVolumeName != nil {
 		// Enqueue PV sync event - it will evaluate and remove finalizer
 		ctrl.pvQueue.Add(*va.Spec.Source.PersistentVolumeName)
 	}
 }
 
+// forceSyncHandler is implemented by handlers that force sync of
+// VolumeAttachments found out of sync with the CSI driver.
+type forceSyncHandler interface {
+	// isForceSync returns true when the VolumeAttachment waits for a force
+	// sync.
+	isForceSync(vaName string) bool
+}
+
+// dependencyHandler is implemented by handlers that track VolumeAttachments
+// waiting for a PV, Secret or CSINode to appear.
+type dependencyHandler interface {
+	// dependencyAvailable returns VolumeAttachments that waited for the
+	// dependency, see *Dependency functions.
+	dependencyAvailable(dependency string) []string
+}
+
+// vaForgetter is implemented by handlers that keep in-memory state of
+// VolumeAttachments.
+type vaForgetter interface {
+	// forgetVA drops the state of a deleted VolumeAttachment.
+	forgetVA(vaName string)
+}
+
+// attachLimitHandler is implemented by handlers that refuse attaches to nodes
+// that reached their attach limit.
+type attachLimitHandler interface {
+	// attachSlotFreed re-queues VolumeAttachments that wait for a free
+	// attach slot of the node.
+	attachSlotFreed(nodeName string)
+}
+
+// vaFilterHandler is implemented by handlers that process VolumeAttachments
+// outside of the VA queue, e.g. in ReconcileVA.
+type vaFilterHandler interface {
+	// setVAFilter makes the handler process only VolumeAttachments for which
+	// filter returns true.
+	setVAFilter(filter func(va *storage.VolumeAttachment) bool)
+}
+
+// initHandler initializes a new handler of the controller.
+func (ctrl *CSIAttachController) initHandler(handler Handler) {
+	handler.Init(ctrl.vaQueue, ctrl.pvQueue, ctrl.eventRecorder)
+	if h, ok := handler.(vaFilterHandler); ok {
+		h.setVAFilter(ctrl.handlesVA)
+	}
+}
+
+// handlesVA returns true when this replica of the controller processes the
+// VolumeAttachment. Node name, node selector and shards are evaluated at the
+// time of the call, they may change while a sync is running.
+func (ctrl *CSIAttachController) handlesVA(va *storage.VolumeAttachment) bool {
+	return ctrl.shouldHandleVA(va) && ctrl.ownsVA(va)
+}
+
+// forgetVA makes the handler drop the state of a deleted VolumeAttachment.
+func (ctrl *CSIAttachController) forgetVA(vaName string) {
+	ctrl.forgetNodeSlot(vaName)
+	handler, _ := ctrl.getHandler()
+	if h, ok := handler.(vaForgetter); ok {
+		h.forgetVA(vaName)
+	}
+}
+
+// forgetNodeSlot re-queues the next VolumeAttachment deferred by the node
+// limiter when the given one won't use the slot it was woken for.
+func (ctrl *CSIAttachController) forgetNodeSlot(vaName string) {
+	for _, name := range ctrl.nodeLimiter.forget(vaName) {
+		ctrl.vaQueue.Add(name)
+	}
+}
+
+// usesAttachSlot returns true when the VolumeAttachment counts against the
+// attach limit of its node, i.e. it's attached or being attached by this
+// attacher.
+func (ctrl *CSIAttachController) usesAttachSlot(va *storage.VolumeAttachment) bool {
+	if va.Spec.Attacher != ctrl.attacherName {
+		return false
+	}
+	return va.Status.Attached || sets.NewString(va.Finalizers...).Has(GetFinalizerName(ctrl.attacherName))
+}
+
+// attachSlotFreed lets the handler re-queue VolumeAttachments that wait for a
+// free attach slot of the node.
+func (ctrl *CSIAttachController) attachSlotFreed(nodeName string) {
+	handler, _ := ctrl.getHandler()
+	if h, ok := handler.(attachLimitHandler); ok {
+		h.attachSlotFreed(nodeName)
+	}
+}
+
+// dependencyAvailable re-queues VolumeAttachments that waited for the
+// dependency and resets their exponential backoff.
+func (ctrl *CSIAttachController) dependencyAvailable(dependency string) {
+	handler, _ := ctrl.getHandler()
+	h, ok := handler.(dependencyHandler)
+	if !ok {
+		return
+	}
+	for _, vaName := range h.dependencyAvailable(dependency) {
+		klog.V(4).Infof("%s is available, enqueueing VolumeAttachment %q", dependency, vaName)
+		ctrl.vaQueue.Forget(vaName)
+		ctrl.vaQueue.Add(vaName)
+	}
+}
+
+// vaPriority returns priority and node name of a VolumeAttachment in the VA
+// queue.
+func (ctrl *CSIAttachController) vaPriority(item interface{}) (vaPriority, string) {
+	vaName := item.(string)
+	va, err := ctrl.vaLister.Get(vaName)
+	if err != nil {
+		// syncVA will handle the error.
+		return vaPriorityAttach, ""
+	}
+	if va.DeletionTimestamp != nil {
+		return vaPriorityDetach, va.Spec.NodeName
+	}
+	handler, _ := ctrl.getHandler()
+	if h, ok := handler.(forceSyncHandler); ok && h.isForceSync(vaName) {
+		return vaPriorityForceSync, va.Spec.NodeName
+	}
+	return vaPriorityAttach, va.Spec.NodeName
+}
+
+// SetNodeName makes the controller process only VolumeAttachments of the
+// given node, e.g. when the attacher runs on each node in a DaemonSet. It must
+// be called before Run.
+func (ctrl *CSIAttachController) SetNodeName(nodeName string) {
+	ctrl.nodeName = nodeName
+}
+
+// shouldHandleVA returns true for VolumeAttachments that this controller is
+// responsible for. Several controllers can share the same informers, each for
+// a different CSI driver.
+func (ctrl *CSIAttachController) shouldHandleVA(va *storage.VolumeAttachment) bool {
+	if ctrl.nodeName != "" && va.Spec.NodeName != ctrl.nodeName {
+		return false
+	}
+	if va.Spec.Attacher != ctrl.attacherName {
+		return false
+	}
+	return ctrl.matchesNodeSelector(va)
+}
+
+// shouldHandlePV returns true for PersistentVolumes whose finalizer this
+// controller processes. A controller of a single node processes only PVs
+// with a VolumeAttachment of the driver on its node, or with no
+// VolumeAttachment of the driver at all, i.e. the last one was deleted.
+func (ctrl *CSIAttachController) shouldHandlePV(pv *v1.PersistentVolume) bool {
+	if ctrl.nodeName == "" {
+		return true
+	}
+	vas, err := listVAsByIndex(ctrl.vaIndexer, vaPVNameIndex, pv.Name)
+	if err != nil {
+		klog.Errorf("Failed to list VolumeAttachments for PV %q: %s", pv.Name, err)
+		return false
+	}
+	attached := false
+	for _, va := range vas {
+		if va.Spec.Attacher != ctrl.attacherName {
+			continue
+		}
+		if va.Spec.NodeName == ctrl.nodeName {
+			return true
+		}
+		attached = true
+	}
+	return !attached
+}
+
+// matchesNodeSelector returns true when the node of the VolumeAttachment
+// matches the node selector of the controller. Labels of nodes that are not in
+// the informer cache are not known, their VolumeAttachments are processed only
+// by the attacher instance that attached them, see vaNodeSelectorAnnotation.
+func (ctrl *CSIAttachController) matchesNodeSelector(va *storage.VolumeAttachment) bool {
+	if ctrl.nodeSelector == nil {
+		return true
+	}
+	node, err := ctrl.nodeLister.Get(va.Spec.NodeName)
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			selector, found := va.Annotations[vaNodeSelectorAnnotation]
+			return found && selector == ctrl.nodeSelector.String()
+		}
+		klog.V(4).Infof("Failed to get node %q: %s", va.Spec.NodeName, err)
+		return false
+	}
+	return ctrl.nodeSelector.Matches(labels.Set(node.Labels))
+}
+
+// nodeAdded reacts to a Node creation. Attaches of VolumeAttachments of the
+// node may have been delayed or refused because the node did not exist, and
+// VolumeAttachments of a node that matches the node selector are processed
+// only after the node is known.
+func (ctrl *CSIAttachController) nodeAdded(obj interface{}) {
+	node := obj.(*v1.Node)
+	ctrl.enqueueVAsForNode(node.Name, false)
+}
+
+// nodeUpdated reacts to a Node update. Attaches to unhealthy nodes may wait
+// for the node to get healthy.
+func (ctrl *CSIAttachController) nodeUpdated(old, new interface{}) {
+	oldNode := old.(*v1.Node)
+	node := new.(*v1.Node)
+	if ctrl.nodeSelector != nil && ctrl.nodeSelector.Matches(labels.Set(node.Labels)) && !ctrl.nodeSelector.Matches(labels.Set(oldNode.Labels)) {
+		// The node moved to this attacher instance, process all its
+		// VolumeAttachments.
+		ctrl.enqueueVAsForNode(node.Name, false)
+		return
+	}
+	if !nodeHealthChanged(oldNode, node) {
+		return
+	}
+	ctrl.enqueueVAsForNode(node.Name, true)
+}
+
+// enqueueVAsForNode enqueues VolumeAttachments of this attacher on given node.
+// With onlyWaiting, only VolumeAttachments waiting for attach are enqueued.
+func (ctrl *CSIAttachController) enqueueVAsForNode(nodeName string, onlyWaiting bool) {
+	vas, err := listVAsByIndex(ctrl.vaIndexer, vaNodeNameIndex, nodeName)
+	if err != nil {
+		klog.Errorf("Failed to list VolumeAttachments of node %q: %s", nodeName, err)
+		return
+	}
+	for _, va := range vas {
+		if !ctrl.shouldHandleVA(va) {
+			continue
+		}
+		if onlyWaiting && (va.Status.Attached || va.DeletionTimestamp != nil) {
+			continue
+		}
+		klog.V(4).Infof("Node %q changed, enqueueing VolumeAttachment %q", nodeName, va.Name)
+		ctrl.vaQueue.Add(va.Name)
+	}
+}
+
+// csiNodeAdded reacts to a CSINode creation
+func (ctrl *CSIAttachController) csiNodeAdded(obj interface{}) {
+	csiNode := obj.(*storage.CSINode)
+	ctrl.dependencyAvailable(csiNodeDependency(csiNode.Name))
+}
+
+// csiNodeUpdated reacts to a CSINode update, e.g. when a driver registers on
+// the node.
+func (ctrl *CSIAttachController) csiNodeUpdated(old, new interface{}) {
+	ctrl.csiNodeAdded(new)
+}
+
+// secretAdded reacts to a Secret creation
+func (ctrl *CSIAttachController) secretAdded(obj interface{}) {
+	secret := obj.(*v1.Secret)
+	ctrl.dependencyAvailable(secretDependency(secret.Namespace, secret.Name))
+}
+
+// secretUpdated reacts to a Secret update
+func (ctrl *CSIAttachController) secretUpdated(old, new interface{}) {
+	ctrl.secretAdded(new)
+}
+
 // pvAdded reacts to a PV creation
 func (ctrl *CSIAttachController) pvAdded(obj interface{}) {
 	pv := obj.(*v1.PersistentVolume)
-	if !ctrl.processFinalizers(pv) {
+	ctrl.dependencyAvailable(pvDependency(pv.Name))
+	if !ctrl.processFinalizers(pv) || !ctrl.shouldHandlePV(pv) {
 		return
 	}
 	ctrl.pvQueue.Add(pv.Name)
@@ -189,20 +660,56 @@ func (ctrl *CSIAttachController) pvAdded(obj interface{}) {
 
 // pvUpdated reacts to a PV update
 func (ctrl *CSIAttachController) pvUpdated(old, new interface{}) {
+	oldPV := old.(*v1.PersistentVolume)
 	pv := new.(*v1.PersistentVolume)
-	if !ctrl.processFinalizers(pv) {
+	ctrl.dependencyAvailable(pvDependency(pv.Name))
+	if !equality.Semantic.DeepEqual(oldPV.Spec, pv.Spec) {
+		// VolumeAttachments that failed with a final error are not retried
+		// until their PV changes.
+		ctrl.enqueueVAsForPV(pv.Name)
+	}
+	if !ctrl.processFinalizers(pv) || !ctrl.shouldHandlePV(pv) {
 		return
 	}
 	ctrl.pvQueue.Add(pv.Name)
 }
 
+// enqueueVAsForPV enqueues all VolumeAttachments of this attacher that refer
+// to given PV.
+func (ctrl *CSIAttachController) enqueueVAsForPV(pvName string) {
+	vas, err := listVAsByIndex(ctrl.vaIndexer, vaPVNameIndex, pvName)
+	if err != nil {
+		klog.Errorf("Failed to list VolumeAttachments for PV %q: %s", pvName, err)
+		return
+	}
+	for _, va := range vas {
+		if !ctrl.shouldHandleVA(va) {
+			continue
+		}
+		klog.V(4).Infof("PV %q changed, enqueueing VolumeAttachment %q", pvName, va.Name)
+		ctrl.vaQueue.Add(va.Name)
+	}
+}
+
 // syncVA deals with one key off the queue.  It returns false when it's time to quit.
-func (ctrl *CSIAttachController) syncVA() {
+func (ctrl *CSIAttachController) syncVA(stopCh <-chan struct{}) {
 	key, quit := ctrl.vaQueue.Get()
 	if quit {
 		return
 	}
 	defer ctrl.vaQueue.Done(key)
+	if ctrl.isPaused() {
+		// The worker was waiting in Get when the controller was paused.
+		// Leave the item to a worker after Resume, without backoff.
+		klog.V(4).Infof("Paused, leaving VA %q in the queue", key)
+		ctrl.vaQueue.Add(key)
+		return
+	}
+	if !ctrl.startSync(stopCh) {
+		klog.V(4).Infof("Shutting down, leaving VA %q to the next attacher", key)
+		return
+	}
+	defer ctrl.inFlight.finish()
 
 	vaName := key.(string)
 	klog.V(4).Infof("Started VA processing %q", vaName)
@@ -213,17 +720,39 @@ func (ctrl *CSIAttachController) syncVA() {
 		if apierrs.IsNotFound(err) {
 			// VolumeAttachment was deleted in the meantime, ignore.
 			klog.V(3).Infof("VA %q deleted, ignoring", vaName)
+			ctrl.forgetVA(vaName)
 			return
 		}
 		klog.Errorf("Error getting VolumeAttachment %q: %v", vaName, err)
 		ctrl.vaQueue.AddRateLimited(vaName)
 		return
 	}
-	if va.Spec.Attacher != ctrl.attacherName {
-		klog.V(4).Infof("Skipping VolumeAttachment %s for attacher %s", va.Name, va.Spec.Attacher)
+	if !ctrl.shouldHandleVA(va) {
+		klog.V(4).Infof("Skipping VolumeAttachment %s for attacher %s on node %s", va.Name, va.Spec.Attacher, va.Spec.NodeName)
+		ctrl.forgetNodeSlot(vaName)
 		return
 	}
-	ctrl.handler.SyncNewOrUpdatedVolumeAttachment(va)
+	if !ctrl.ownsVA(va) {
+		// The VA is processed by another replica. It's re-queued by
+		// ShardsChanged when this replica gets its shard.
+		klog.V(4).Infof("Skipping VolumeAttachment %s owned by another replica", va.Name)
+		ctrl.forgetNodeSlot(vaName)
+		return
+	}
+	nodeName := va.Spec.NodeName
+	if !ctrl.nodeLimiter.tryAcquire(nodeName, vaName) {
+		// The VA is re-queued when the node has a free slot, keep its
+		// backoff intact.
+		klog.V(4).Infof("Too many VolumeAttachments in progress on node %q, deferring %q", nodeName, vaName)
+		return
+	}
+	defer func() {
+		for _, name := range ctrl.nodeLimiter.release(nodeName) {
+			ctrl.vaQueue.Add(name)
+		}
+	}()
+	handler, _ := ctrl.getHandler()
+	handler.SyncNewOrUpdatedVolumeAttachment(va)
 }
 
 func (ctrl *CSIAttachController) processFinalizers(pv *v1.PersistentVolume) bool {
@@ -248,12 +777,24 @@ func (ctrl *CSIAttachController) processFinalizers(pv *v1.PersistentVolume) bool
 }
 
 // syncPV deals with one key off the queue.  It returns false when it's time to quit.
-func (ctrl *CSIAttachController) syncPV() {
+func (ctrl *CSIAttachController) syncPV(stopCh <-chan struct{}) {
 	key, quit := ctrl.pvQueue.Get()
 	if quit {
 		return
 	}
 	defer ctrl.pvQueue.Done(key)
+	if ctrl.isPaused() {
+		// The worker was waiting in Get when the controller was paused.
+		// Leave the item to a worker after Resume, without backoff.
+		klog.V(4).Infof("Paused, leaving PV %q in the queue", key)
+		ctrl.pvQueue.Add(key)
+		return
+	}
+	if !ctrl.startSync(stopCh) {
+		klog.V(4).Infof("Shutting down, leaving PV %q to the next attacher", key)
+		return
+	}
+	defer ctrl.inFlight.finish()
 
 	pvName := key.(string)
 	klog.V(4).Infof("Started PV processing %q", pvName)
@@ -270,7 +811,16 @@ func (ctrl *CSIAttachController) syncPV() {
 		ctrl.pvQueue.AddRateLimited(pvName)
 		return
 	}
-	ctrl.handler.SyncNewOrUpdatedPersistentVolume(pv)
+	if !ctrl.shouldHandlePV(pv) {
+		klog.V(4).Infof("Skipping PV %s attached to other nodes", pv.Name)
+		return
+	}
+	if !ctrl.ownsPV(pv) {
+		klog.V(4).Infof("Skipping PV %s owned by another replica", pv.Name)
+		return
+	}
+	handler, _ := ctrl.getHandler()
+	handler.SyncNewOrUpdatedPersistentVolume(pv)
 }
 
 // shouldEnqueueVAChange checks if a changed VolumeAttachment should be enqueued.
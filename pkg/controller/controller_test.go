@@ -17,11 +17,18 @@ limitations under the License.
 package controller
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	csitrans "k8s.io/csi-translation-lib"
 )
 
@@ -224,3 +231,613 @@ func TestProcessFinalizers(t *testing.T) {
 		}
 	}
 }
+
+func TestPauseResume(t *testing.T) {
+	c := &CSIAttachController{resumed: make(chan struct{})}
+	close(c.resumed)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	if !c.waitUntilResumed(stopCh) {
+		t.Errorf("expected running controller not to wait")
+	}
+
+	c.Pause()
+	c.Pause()
+	resumed := make(chan bool)
+	go func() {
+		resumed <- c.waitUntilResumed(stopCh)
+	}()
+	select {
+	case <-resumed:
+		t.Fatalf("expected paused controller to wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c.Resume()
+	c.Resume()
+	select {
+	case ok := <-resumed:
+		if !ok {
+			t.Errorf("expected waitUntilResumed to return true after Resume")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for Resume")
+	}
+
+	// Stopping the controller unblocks paused workers.
+	c.Pause()
+	stopped := make(chan struct{})
+	close(stopped)
+	if c.waitUntilResumed(stopped) {
+		t.Errorf("expected waitUntilResumed to return false after stop")
+	}
+
+	// Items handed out to workers that waited in Get are left in the queues.
+	c.vaQueue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer c.vaQueue.ShutDown()
+	c.pvQueue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer c.pvQueue.ShutDown()
+	c.vaQueue.Add("va1")
+	c.pvQueue.Add("pv1")
+	c.syncVA(stopCh)
+	c.syncPV(stopCh)
+	if c.vaQueue.Len() != 1 || c.pvQueue.Len() != 1 {
+		t.Errorf("expected paused controller to keep the items queued, got %d VAs and %d PVs", c.vaQueue.Len(), c.pvQueue.Len())
+	}
+	if c.vaQueue.NumRequeues("va1") != 0 || c.pvQueue.NumRequeues("pv1") != 0 {
+		t.Errorf("expected paused controller not to add backoff")
+	}
+}
+
+type initRecordingHandler struct {
+	Handler
+	vaQueue workqueue.RateLimitingInterface
+}
+
+func (h *initRecordingHandler) Init(vaQueue workqueue.RateLimitingInterface, pvQueue workqueue.RateLimitingInterface, eventRecorder record.EventRecorder) {
+	h.vaQueue = vaQueue
+}
+
+func TestSetHandler(t *testing.T) {
+	c := &CSIAttachController{
+		vaQueue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		handler: &initRecordingHandler{},
+	}
+	defer c.vaQueue.ShutDown()
+
+	newHandler := &initRecordingHandler{}
+	c.SetHandler(newHandler, true)
+	handler, shouldReconcile := c.getHandler()
+	if handler != newHandler || !shouldReconcile {
+		t.Errorf("expected the new handler with reconciliation, got %v, %v", handler, shouldReconcile)
+	}
+	if newHandler.vaQueue != c.vaQueue {
+		t.Errorf("expected the new handler to be initialized with the controller queue")
+	}
+
+	c.SetHandler(&initRecordingHandler{}, false)
+	if _, shouldReconcile := c.getHandler(); shouldReconcile {
+		t.Errorf("expected reconciliation to be disabled")
+	}
+}
+
+func TestVARouting(t *testing.T) {
+	pvName := "pv1"
+	newVA := func(name, attacher string) *storage.VolumeAttachment {
+		return &storage.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storage.VolumeAttachmentSpec{
+				Attacher: attacher,
+				Source:   storage.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+			},
+		}
+	}
+	c := &CSIAttachController{
+		attacherName: "csi/test",
+		nodeLimiter:  newNodeLimiter(0),
+		vaQueue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		pvQueue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	defer c.vaQueue.ShutDown()
+	defer c.pvQueue.ShutDown()
+
+	// VolumeAttachments of other drivers are ignored.
+	c.vaAdded(newVA("other", "csi/other"))
+	c.vaDeleted(newVA("other", "csi/other"))
+	if c.vaQueue.Len() != 0 || c.pvQueue.Len() != 0 {
+		t.Errorf("expected VolumeAttachment of another driver not to be enqueued, got %d VAs and %d PVs", c.vaQueue.Len(), c.pvQueue.Len())
+	}
+
+	c.vaAdded(newVA("mine", "csi/test"))
+	c.vaDeleted(newVA("mine", "csi/test"))
+	if c.vaQueue.Len() != 1 || c.pvQueue.Len() != 1 {
+		t.Errorf("expected VolumeAttachment of the driver to be enqueued, got %d VAs and %d PVs", c.vaQueue.Len(), c.pvQueue.Len())
+	}
+}
+
+func TestNodeDeployment(t *testing.T) {
+	newVA := func(name, nodeName string) *storage.VolumeAttachment {
+		return &storage.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storage.VolumeAttachmentSpec{
+				Attacher: "csi/test",
+				NodeName: nodeName,
+			},
+		}
+	}
+	c := &CSIAttachController{
+		attacherName: "csi/test",
+		vaQueue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	defer c.vaQueue.ShutDown()
+	c.SetNodeName("node1")
+
+	c.vaAdded(newVA("remote", "node2"))
+	if c.vaQueue.Len() != 0 {
+		t.Errorf("expected VolumeAttachment of another node not to be enqueued, got %d", c.vaQueue.Len())
+	}
+	c.vaAdded(newVA("local", "node1"))
+	if c.vaQueue.Len() != 1 {
+		t.Fatalf("expected VolumeAttachment of the node to be enqueued, got %d", c.vaQueue.Len())
+	}
+	if item, _ := c.vaQueue.Get(); item != "local" {
+		t.Errorf("expected VolumeAttachment local to be enqueued, got %v", item)
+	}
+
+	// Finalizers of PVs attached to other nodes are left to the attachers
+	// of those nodes.
+	vaInformer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0).Storage().V1().VolumeAttachments()
+	withPV := func(va *storage.VolumeAttachment, pvName string) *storage.VolumeAttachment {
+		va.Spec.Source.PersistentVolumeName = &pvName
+		return va
+	}
+	for _, va := range []*storage.VolumeAttachment{
+		withPV(newVA("local-pv", "node1"), "local"),
+		withPV(newVA("remote-pv", "node2"), "remote"),
+		withPV(newVA("shared-local", "node1"), "shared"),
+		withPV(newVA("shared-remote", "node2"), "shared"),
+	} {
+		vaInformer.Informer().GetStore().Add(va)
+	}
+	c.vaIndexer = vaInformer.Informer().GetIndexer()
+	for _, test := range []struct {
+		pvName   string
+		expected bool
+	}{
+		{"local", true},
+		{"remote", false},
+		{"shared", true},
+		{"detached", true},
+	} {
+		pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: test.pvName}}
+		if handles := c.shouldHandlePV(pv); handles != test.expected {
+			t.Errorf("expected shouldHandlePV(%s) to be %v, got %v", test.pvName, test.expected, handles)
+		}
+	}
+}
+
+func TestNodeSelector(t *testing.T) {
+	newVA := func(name, nodeName string) *storage.VolumeAttachment {
+		return &storage.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storage.VolumeAttachmentSpec{
+				Attacher: "csi/test",
+				NodeName: nodeName,
+			},
+		}
+	}
+	newNode := func(name, zone string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{"zone": zone},
+			},
+		}
+	}
+
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	vaInformer := factory.Storage().V1().VolumeAttachments()
+	nodeInformer := factory.Core().V1().Nodes()
+	for _, va := range []*storage.VolumeAttachment{newVA("va-a", "node-a"), newVA("va-b", "node-b")} {
+		vaInformer.Informer().GetStore().Add(va)
+	}
+	withSelector := func(va *storage.VolumeAttachment, selector string) *storage.VolumeAttachment {
+		va.Annotations = map[string]string{vaNodeSelectorAnnotation: selector}
+		return va
+	}
+	nodeInformer.Informer().GetStore().Add(newNode("node-a", "a"))
+	nodeInformer.Informer().GetStore().Add(newNode("node-b", "b"))
+	c := &CSIAttachController{
+		attacherName: "csi/test",
+		vaLister:     vaInformer.Lister(),
+		vaIndexer:    vaInformer.Informer().GetIndexer(),
+		nodeLister:   nodeInformer.Lister(),
+		nodeSelector: labels.SelectorFromSet(labels.Set{"zone": "a"}),
+		vaQueue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	defer c.vaQueue.ShutDown()
+
+	for _, test := range []struct {
+		va       *storage.VolumeAttachment
+		expected bool
+	}{
+		{newVA("va-a", "node-a"), true},
+		{newVA("va-b", "node-b"), false},
+		{newVA("va-unknown", "unknown"), false},
+		// VolumeAttachments of deleted nodes are processed by the
+		// instance that attached them.
+		{withSelector(newVA("va-deleted", "deleted"), "zone=a"), true},
+		{withSelector(newVA("va-deleted-b", "deleted"), "zone=b"), false},
+	} {
+		if handle := c.shouldHandleVA(test.va); handle != test.expected {
+			t.Errorf("expected shouldHandleVA(%s) to be %v, got %v", test.va.Name, test.expected, handle)
+		}
+	}
+
+	// All VolumeAttachments of a node are enqueued when it starts matching
+	// the selector.
+	nodeInformer.Informer().GetStore().Update(newNode("node-b", "a"))
+	c.nodeUpdated(newNode("node-b", "b"), newNode("node-b", "a"))
+	if c.vaQueue.Len() != 1 {
+		t.Fatalf("expected 1 VolumeAttachment to be enqueued, got %d", c.vaQueue.Len())
+	}
+	if item, _ := c.vaQueue.Get(); item != "va-b" {
+		t.Errorf("expected VolumeAttachment va-b to be enqueued, got %v", item)
+	}
+}
+
+func TestNodeUpdated(t *testing.T) {
+	newVA := func(name, nodeName string, attached bool) *storage.VolumeAttachment {
+		return &storage.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storage.VolumeAttachmentSpec{
+				Attacher: "csi/test",
+				NodeName: nodeName,
+			},
+			Status: storage.VolumeAttachmentStatus{Attached: attached},
+		}
+	}
+	newNode := func(ready v1.ConditionStatus) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+			Status: v1.NodeStatus{
+				Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: ready}},
+			},
+		}
+	}
+
+	vaInformer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0).Storage().V1().VolumeAttachments()
+	for _, va := range []*storage.VolumeAttachment{
+		newVA("waiting", "node1", false),
+		newVA("attached", "node1", true),
+		newVA("other-node", "node2", false),
+	} {
+		vaInformer.Informer().GetStore().Add(va)
+	}
+	c := &CSIAttachController{
+		attacherName: "csi/test",
+		vaLister:     vaInformer.Lister(),
+		vaIndexer:    vaInformer.Informer().GetIndexer(),
+		vaQueue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	defer c.vaQueue.ShutDown()
+
+	// Heartbeat does not change node health.
+	c.nodeUpdated(newNode(v1.ConditionFalse), newNode(v1.ConditionFalse))
+	if c.vaQueue.Len() != 0 {
+		t.Errorf("expected no VolumeAttachment to be enqueued, got %d", c.vaQueue.Len())
+	}
+
+	c.nodeUpdated(newNode(v1.ConditionFalse), newNode(v1.ConditionTrue))
+	if c.vaQueue.Len() != 1 {
+		t.Fatalf("expected 1 VolumeAttachment to be enqueued, got %d", c.vaQueue.Len())
+	}
+	if item, _ := c.vaQueue.Get(); item != "waiting" {
+		t.Errorf("expected VolumeAttachment waiting for the node to be enqueued, got %v", item)
+	}
+}
+
+func TestNodeAdded(t *testing.T) {
+	newVA := func(name, nodeName string) *storage.VolumeAttachment {
+		return &storage.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storage.VolumeAttachmentSpec{
+				Attacher: "csi/test",
+				NodeName: nodeName,
+			},
+		}
+	}
+	vaInformer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0).Storage().V1().VolumeAttachments()
+	for _, va := range []*storage.VolumeAttachment{newVA("refused", "node1"), newVA("other-node", "node2")} {
+		vaInformer.Informer().GetStore().Add(va)
+	}
+	c := &CSIAttachController{
+		attacherName: "csi/test",
+		vaLister:     vaInformer.Lister(),
+		vaIndexer:    vaInformer.Informer().GetIndexer(),
+		vaQueue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	defer c.vaQueue.ShutDown()
+
+	// VolumeAttachments refused because the node did not exist are retried
+	// without any node selector.
+	c.nodeAdded(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	if c.vaQueue.Len() != 1 {
+		t.Fatalf("expected 1 VolumeAttachment to be enqueued, got %d", c.vaQueue.Len())
+	}
+	if item, _ := c.vaQueue.Get(); item != "refused" {
+		t.Errorf("expected VolumeAttachment of the node to be enqueued, got %v", item)
+	}
+}
+
+type attachSlotRecordingHandler struct {
+	Handler
+	nodes []string
+}
+
+func (h *attachSlotRecordingHandler) attachSlotFreed(nodeName string) {
+	h.nodes = append(h.nodes, nodeName)
+}
+
+func TestAttachSlotFreed(t *testing.T) {
+	finalizer := GetFinalizerName("csi/test")
+	newVA := func(attacher string, attached bool, finalizers ...string) *storage.VolumeAttachment {
+		return &storage.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: "va1", Finalizers: finalizers},
+			Spec: storage.VolumeAttachmentSpec{
+				Attacher: attacher,
+				NodeName: "node1",
+			},
+			Status: storage.VolumeAttachmentStatus{Attached: attached},
+		}
+	}
+	tests := []struct {
+		name          string
+		old, new      *storage.VolumeAttachment
+		expectedNodes []string
+	}{
+		{
+			name:          "detached",
+			old:           newVA("csi/test", true, finalizer),
+			new:           newVA("csi/test", false),
+			expectedNodes: []string{"node1"},
+		},
+		{
+			name:          "finalizer removed after failed attach",
+			old:           newVA("csi/test", false, finalizer),
+			new:           newVA("csi/test", false),
+			expectedNodes: []string{"node1"},
+		},
+		{
+			name: "attached",
+			old:  newVA("csi/test", false, finalizer),
+			new:  newVA("csi/test", true, finalizer),
+		},
+		{
+			name: "other attacher detached",
+			old:  newVA("csi/other", true, GetFinalizerName("csi/other")),
+			new:  newVA("csi/other", false),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := &attachSlotRecordingHandler{}
+			c := &CSIAttachController{
+				attacherName: "csi/test",
+				handler:      handler,
+				vaQueue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+			}
+			defer c.vaQueue.ShutDown()
+			c.vaUpdated(test.old, test.new)
+			if !reflect.DeepEqual(handler.nodes, test.expectedNodes) {
+				t.Errorf("expected freed attach slots of nodes %v, got %v", test.expectedNodes, handler.nodes)
+			}
+		})
+	}
+}
+
+func TestDependencyAvailable(t *testing.T) {
+	handler := &csiHandler{CSIHandlerState: NewCSIHandlerState()}
+	handler.dependencies.wait("va1", csiNodeDependency("node1"))
+	c := &CSIAttachController{
+		handler: handler,
+		vaQueue: workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Hour, time.Hour)),
+	}
+	defer c.vaQueue.ShutDown()
+	c.vaQueue.AddRateLimited("va1")
+
+	c.secretAdded(&v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "node1"}})
+	if c.vaQueue.Len() != 0 {
+		t.Errorf("expected no VolumeAttachment to be enqueued, got %d", c.vaQueue.Len())
+	}
+
+	c.csiNodeUpdated(&storage.CSINode{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}, &storage.CSINode{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	if c.vaQueue.Len() != 1 {
+		t.Fatalf("expected 1 VolumeAttachment to be enqueued, got %d", c.vaQueue.Len())
+	}
+	if requeues := c.vaQueue.NumRequeues("va1"); requeues != 0 {
+		t.Errorf("expected backoff of the VolumeAttachment to be reset, got %d requeues", requeues)
+	}
+}
+
+func TestForgetDeletedVA(t *testing.T) {
+	handler := &csiHandler{CSIHandlerState: NewCSIHandlerState()}
+	handler.dependencies.wait("deleted", csiNodeDependency("node1"))
+	handler.dependencies.wait("removed", csiNodeDependency("node1"))
+	handler.setFinalAttachError("removed", "fingerprint")
+	vaInformer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0).Storage().V1().VolumeAttachments()
+	c := &CSIAttachController{
+		attacherName: "csi/test",
+		nodeLimiter:  newNodeLimiter(0),
+		handler:      handler,
+		vaLister:     vaInformer.Lister(),
+		vaQueue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		inFlight:     newInFlightTracker(),
+		resumed:      make(chan struct{}),
+	}
+	close(c.resumed)
+	defer c.vaQueue.ShutDown()
+
+	// VolumeAttachment deleted while it was queued.
+	c.vaQueue.Add("deleted")
+	c.syncVA(make(chan struct{}))
+	// VolumeAttachment deleted after its finalizer was removed.
+	c.vaDeleted(&storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "removed"},
+		Spec:       storage.VolumeAttachmentSpec{Attacher: "csi/test"},
+	})
+
+	if vaNames := handler.dependencies.available(csiNodeDependency("node1")); len(vaNames) != 0 {
+		t.Errorf("expected deleted VolumeAttachments to be forgotten, got %v waiting", vaNames)
+	}
+	if handler.hasFinalAttachError("removed", "fingerprint") {
+		t.Errorf("expected final attach error of the deleted VolumeAttachment to be forgotten")
+	}
+}
+
+// keySharder owns a fixed set of keys.
+type keySharder map[string]bool
+
+func (s keySharder) Owns(key string) bool {
+	return s[key]
+}
+
+func TestSharding(t *testing.T) {
+	pvName := "pv1"
+	missingPVName := "missing"
+	newVA := func(name, nodeName string, source storage.VolumeAttachmentSource) *storage.VolumeAttachment {
+		return &storage.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storage.VolumeAttachmentSpec{
+				Attacher: "csi/test",
+				NodeName: nodeName,
+				Source:   source,
+			},
+		}
+	}
+	pvVA := newVA("pv-va", "node1", storage.VolumeAttachmentSource{PersistentVolumeName: &pvName})
+	inlineVA := newVA("inline-va", "node2", storage.VolumeAttachmentSource{
+		InlineVolumeSpec: &v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: "csi/test", VolumeHandle: "inline-handle"},
+			},
+		},
+	})
+	missingPVVA := newVA("missing-pv-va", "node1", storage.VolumeAttachmentSource{PersistentVolumeName: &missingPVName})
+	// The PV was force deleted, the VA is detached by its detach record.
+	deletedPVName := "deleted"
+	recordedVA := newVA("recorded-va", "node2", storage.VolumeAttachmentSource{PersistentVolumeName: &deletedPVName})
+	recordedVA.Annotations = map[string]string{vaVolumeHandleAnnotation: "pv-handle"}
+
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	vaInformer := factory.Storage().V1().VolumeAttachments()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	for _, va := range []*storage.VolumeAttachment{pvVA, inlineVA, missingPVVA, recordedVA} {
+		vaInformer.Informer().GetStore().Add(va)
+	}
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: pvName},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: "csi/test", VolumeHandle: "pv-handle"},
+			},
+		},
+	}
+	pvInformer.Informer().GetStore().Add(pv)
+
+	c := &CSIAttachController{
+		attacherName: "csi/test",
+		vaLister:     vaInformer.Lister(),
+		vaIndexer:    vaInformer.Informer().GetIndexer(),
+		pvLister:     pvInformer.Lister(),
+		vaQueue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		pvQueue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		translator:   csitrans.New(),
+	}
+	defer c.vaQueue.ShutDown()
+	defer c.pvQueue.ShutDown()
+
+	if !c.ownsVA(pvVA) || !c.ownsPV(pv) {
+		t.Errorf("expected all objects to be owned without sharding")
+	}
+
+	c.SetSharding(keySharder{"pv-handle": true, "missing": true}, ShardByVolume)
+	for _, test := range []struct {
+		va       *storage.VolumeAttachment
+		expected bool
+	}{
+		{pvVA, true},
+		{inlineVA, false},
+		{missingPVVA, true},
+		{recordedVA, true},
+	} {
+		if owns := c.ownsVA(test.va); owns != test.expected {
+			t.Errorf("sharding by volume: expected ownsVA(%s) to be %v, got %v", test.va.Name, test.expected, owns)
+		}
+	}
+	if !c.ownsPV(pv) {
+		t.Errorf("sharding by volume: expected PV with owned handle to be owned")
+	}
+
+	c.SetSharding(keySharder{"node2": true}, ShardByNode)
+	for _, test := range []struct {
+		va       *storage.VolumeAttachment
+		expected bool
+	}{
+		{pvVA, false},
+		{inlineVA, true},
+		{missingPVVA, false},
+		{recordedVA, true},
+	} {
+		if owns := c.ownsVA(test.va); owns != test.expected {
+			t.Errorf("sharding by node: expected ownsVA(%s) to be %v, got %v", test.va.Name, test.expected, owns)
+		}
+	}
+
+	// The CSI handler reconciles and attaches only VolumeAttachments in
+	// owned shards.
+	handler := &csiHandler{CSIHandlerState: NewCSIHandlerState()}
+	c.initHandler(handler)
+	if handler.handlesVA(pvVA) || !handler.handlesVA(inlineVA) {
+		t.Errorf("expected the handler to handle only VolumeAttachments in owned shards")
+	}
+
+	c.ShardsChanged()
+	if c.vaQueue.Len() != 4 {
+		t.Errorf("expected all VolumeAttachments to be enqueued when shards change, got %d", c.vaQueue.Len())
+	}
+}
+
+func TestVAQueueMetricsPerDriver(t *testing.T) {
+	provider := namedMetricsProvider{}
+	oldProvider := workqueueMetricsProvider
+	workqueueMetricsProvider = provider
+	defer func() { workqueueMetricsProvider = oldProvider }()
+
+	client := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	newController := func(attacherName string) *CSIAttachController {
+		return NewCSIAttachController(client, attacherName, &initRecordingHandler{}, informerFactory.Storage().V1().VolumeAttachments(), informerFactory.Core().V1().PersistentVolumes(), nil, nil, nil, nil, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter(), false, time.Minute, 0)
+	}
+	ctrl1 := newController("csi.example.com")
+	defer ctrl1.vaQueue.ShutDown()
+	defer ctrl1.pvQueue.ShutDown()
+	ctrl2 := newController("other.example.com")
+	defer ctrl2.vaQueue.ShutDown()
+	defer ctrl2.pvQueue.ShutDown()
+
+	ctrl1.vaQueue.Add("va1")
+	ctrl2.vaQueue.Add("va1")
+	ctrl2.vaQueue.Add("va2")
+	for name, expected := range map[string]float64{"csi-attacher-va-csi-example-com": 1, "csi-attacher-va-other-example-com": 2} {
+		metrics, found := provider[name]
+		if !found {
+			t.Errorf("expected metrics of queue %q, got queues %v", name, provider)
+			continue
+		}
+		if metrics.adds.value != expected {
+			t.Errorf("expected %v adds to queue %q, got %v", expected, name, metrics.adds.value)
+		}
+	}
+}
@@ -18,26 +18,45 @@ package controller
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/connection"
 	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
 	v1 "k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/kubernetes"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 )
 
+// errFinalAttachErrorUnchanged is returned by csiAttach when ControllerPublish
+// of the VolumeAttachment already failed with a final error and the call would
+// use the same parameters again.
+var errFinalAttachErrorUnchanged = errors.New("attach failed with a final error and its parameters have not changed")
+
+// errVANotHandled is returned by csiAttach / csiDetach when the VolumeAttachment
+// has moved to another replica of the attacher while it was processed, e.g.
+// because its shard was lost. The other replica processes it.
+var errVANotHandled = errors.New("the VolumeAttachment is processed by another attacher")
+
 type AttacherCSITranslator interface {
 	TranslateInTreePVToCSI(pv *v1.PersistentVolume) (*v1.PersistentVolume, error)
 	IsPVMigratable(pv *v1.PersistentVolume) bool
@@ -46,13 +65,19 @@ type AttacherCSITranslator interface {
 
 // Lister implements list operations against a remote CSI driver.
 type VolumeLister interface {
-	// ListVolumes calls ListVolumes on the driver and returns a map with keys
-	// of VolumeID and values of the list of Node IDs that volume is published
-	// on
-	ListVolumes(ctx context.Context) (map[string][]string, error)
+	// ListVolumes calls ListVolumes on the driver and passes each page of
+	// results to processPage as a map with keys of VolumeID and values of the
+	// volume status, incl. the list of Node IDs that volume is published on
+	ListVolumes(ctx context.Context, processPage func(page map[string]attacher.VolumeStatus)) error
+
+	// GetVolumeStatus calls ControllerGetVolume on the driver and returns the
+	// volume status, incl. the list of Node IDs that the volume is published
+	// on. A volume that does not exist in the driver is published on no nodes.
+	GetVolumeStatus(ctx context.Context, volumeHandle string) (*attacher.VolumeStatus, error)
 }
 
 var _ VolumeLister = &attacher.CSIVolumeLister{}
+var _ VolumeLister = &attacher.DryRunVolumeLister{}
 
 // csiHandler is a handler that calls CSI to attach/detach volume.
 // It adds finalizer to VolumeAttachment instance to make sure they're detached
@@ -64,132 +89,475 @@ type csiHandler struct {
 	CSIVolumeLister         VolumeLister
 	pvLister                corelisters.PersistentVolumeLister
 	csiNodeLister           storagelisters.CSINodeLister
-	vaLister                storagelisters.VolumeAttachmentLister
+	vaIndexer               cache.Indexer
+	nodeLister              corelisters.NodeLister
 	vaQueue, pvQueue        workqueue.RateLimitingInterface
-	forceSync               map[string]bool
-	forceSyncMux            sync.Mutex
+	eventRecorder           record.EventRecorder
 	timeout                 time.Duration
 	supportsPublishReadOnly bool
+	// supportsSingleNodeMultiWriter is true when the driver supports
+	// SINGLE_NODE_SINGLE_WRITER and SINGLE_NODE_MULTI_WRITER access modes.
+	supportsSingleNodeMultiWriter bool
+	// reconcileWithGetVolume makes ReconcileVA call ControllerGetVolume for
+	// each volume referenced by a VolumeAttachment instead of listing all
+	// volumes in the driver.
+	reconcileWithGetVolume bool
+	// supportsVolumeCondition is true when the driver reports condition of
+	// volumes in ListVolumes / ControllerGetVolume.
+	supportsVolumeCondition bool
 	translator              AttacherCSITranslator
+	// operations serializes ControllerPublish / ControllerUnpublish calls of
+	// the same volume.
+	operations *OperationTracker
+	// unhealthyNodeAction and unhealthyNodeTaints configure attaching of
+	// volumes to unhealthy nodes. nodeLister is used only when
+	// unhealthyNodeAction is not UnhealthyNodeAllow.
+	unhealthyNodeAction UnhealthyNodeAction
+	unhealthyNodeTaints sets.String
+	// forceDetachGracePeriod is how long VolumeAttachments of out-of-service
+	// or deleted nodes can fail to detach before their finalizer is removed
+	// without successful ControllerUnpublish. 0 disables force detach.
+	forceDetachGracePeriod time.Duration
+	// nodeSelector is recorded in VolumeAttachments before they are
+	// attached, see vaNodeSelectorAnnotation. Empty when the controller
+	// has no node selector.
+	nodeSelector string
+	// secretCache serves ControllerPublishSecretRef secrets. Secrets
+	// missing in it are read from the API server. It's nil when Secrets are
+	// not watched.
+	secretCache *SecretCache
+	// vaFilter is set by the controller, see vaFilterHandler. nil means
+	// all VolumeAttachments of the driver are processed.
+	vaFilter func(va *storage.VolumeAttachment) bool
+
+	*CSIHandlerState
+}
+
+// CSIHandlerState is in-memory state of VolumeAttachments kept by CSI handlers.
+// Handlers of the same driver should share it, so a handler that replaces
+// another one, e.g. after capabilities of the driver changed, does not forget
+// what the previous one learned.
+type CSIHandlerState struct {
+	forceSync            map[string]bool
+	forceSyncMux         sync.Mutex
+	finalAttachErrors    map[string]string
+	finalAttachErrorsMux sync.Mutex
+
+	// dependencies tracks VolumeAttachments that wait for their PV, secret
+	// or CSINode to appear.
+	dependencies *dependencyTracker
+
+	// attachReservations tracks VolumeAttachments that passed the attach
+	// limit check of their node.
+	attachReservations *attachReservations
+
+	// reconciledVolumes caches volume handles of VolumeAttachments resolved
+	// by ReconcileVA, so PVs are not translated again in each cycle. It's
+	// used only by ReconcileVA, which does not run concurrently.
+	reconciledVolumes map[string]reconciledVolume
+}
+
+// NewCSIHandlerState returns empty state of CSI handlers.
+func NewCSIHandlerState() *CSIHandlerState {
+	return &CSIHandlerState{
+		forceSync:          map[string]bool{},
+		finalAttachErrors:  map[string]string{},
+		dependencies:       newDependencyTracker(),
+		attachReservations: newAttachReservations(),
+		reconciledVolumes:  map[string]reconciledVolume{},
+	}
 }
 
 var _ Handler = &csiHandler{}
+var _ forceSyncHandler = &csiHandler{}
+var _ dependencyHandler = &csiHandler{}
+var _ vaForgetter = &csiHandler{}
+var _ vaFilterHandler = &csiHandler{}
+var _ attachLimitHandler = &csiHandler{}
+
+// CSIHandlerOptions are parameters of NewCSIHandler.
+type CSIHandlerOptions struct {
+	Client       kubernetes.Interface
+	AttacherName string
+	Attacher     attacher.Attacher
+	// VolumeLister is used by ReconcileVA.
+	VolumeLister  VolumeLister
+	PVLister      corelisters.PersistentVolumeLister
+	CSINodeLister storagelisters.CSINodeLister
+	// VAIndexer is the indexer of the VolumeAttachment informer, see
+	// AddVAIndexers.
+	VAIndexer cache.Indexer
+	// NodeLister is used only when UnhealthyNodePolicy does not allow
+	// attaching to unhealthy nodes or ForceDetachGracePeriod is set.
+	NodeLister corelisters.NodeLister
+	// SecretCache serves ControllerPublishSecretRef secrets. Secrets
+	// missing in it are read from the API server. nil reads all secrets
+	// from the API server.
+	SecretCache *SecretCache
+	// Timeout of ControllerPublish / ControllerUnpublish and
+	// ControllerGetVolume calls.
+	Timeout                 time.Duration
+	SupportsPublishReadOnly bool
+	// SupportsSingleNodeMultiWriter is true when the driver supports
+	// SINGLE_NODE_SINGLE_WRITER and SINGLE_NODE_MULTI_WRITER access modes.
+	SupportsSingleNodeMultiWriter bool
+	// ReconcileWithGetVolume makes ReconcileVA call ControllerGetVolume for
+	// each volume referenced by a VolumeAttachment instead of listing all
+	// volumes in the driver.
+	ReconcileWithGetVolume bool
+	// SupportsVolumeCondition is true when the driver reports condition of
+	// volumes in ListVolumes / ControllerGetVolume.
+	SupportsVolumeCondition bool
+	Translator              AttacherCSITranslator
+	// Operations serializes ControllerPublish / ControllerUnpublish calls of
+	// the same volume. Handlers of the same driver should share it.
+	Operations          *OperationTracker
+	UnhealthyNodePolicy UnhealthyNodePolicy
+	// ForceDetachGracePeriod is how long VolumeAttachments of out-of-service
+	// or deleted nodes can fail to detach before their finalizer is removed
+	// without successful ControllerUnpublish. 0 disables force detach.
+	ForceDetachGracePeriod time.Duration
+	// NodeSelector is the node selector of the controller, nil when it
+	// processes VolumeAttachments of all nodes.
+	NodeSelector labels.Selector
+	// State is shared by handlers of the same driver. The handler gets its
+	// own state when it's nil.
+	State *CSIHandlerState
+}
 
 // NewCSIHandler creates a new CSIHandler.
-func NewCSIHandler(
-	client kubernetes.Interface,
-	attacherName string,
-	attacher attacher.Attacher,
-	CSIVolumeLister VolumeLister,
-	pvLister corelisters.PersistentVolumeLister,
-	csiNodeLister storagelisters.CSINodeLister,
-	vaLister storagelisters.VolumeAttachmentLister,
-	timeout *time.Duration,
-	supportsPublishReadOnly bool,
-	translator AttacherCSITranslator) Handler {
-
+func NewCSIHandler(opts CSIHandlerOptions) Handler {
+	state := opts.State
+	if state == nil {
+		state = NewCSIHandlerState()
+	}
+	var nodeSelector string
+	if opts.NodeSelector != nil {
+		nodeSelector = opts.NodeSelector.String()
+	}
 	return &csiHandler{
-		client:                  client,
-		attacherName:            attacherName,
-		attacher:                attacher,
-		CSIVolumeLister:         CSIVolumeLister,
-		pvLister:                pvLister,
-		csiNodeLister:           csiNodeLister,
-		vaLister:                vaLister,
-		timeout:                 *timeout,
-		supportsPublishReadOnly: supportsPublishReadOnly,
-		translator:              translator,
-		forceSync:               map[string]bool{},
-		forceSyncMux:            sync.Mutex{},
-	}
-}
-
-func (h *csiHandler) Init(vaQueue workqueue.RateLimitingInterface, pvQueue workqueue.RateLimitingInterface) {
+		client:                        opts.Client,
+		attacherName:                  opts.AttacherName,
+		attacher:                      opts.Attacher,
+		CSIVolumeLister:               opts.VolumeLister,
+		pvLister:                      opts.PVLister,
+		csiNodeLister:                 opts.CSINodeLister,
+		vaIndexer:                     opts.VAIndexer,
+		nodeLister:                    opts.NodeLister,
+		secretCache:                   opts.SecretCache,
+		timeout:                       opts.Timeout,
+		supportsPublishReadOnly:       opts.SupportsPublishReadOnly,
+		supportsSingleNodeMultiWriter: opts.SupportsSingleNodeMultiWriter,
+		reconcileWithGetVolume:        opts.ReconcileWithGetVolume,
+		supportsVolumeCondition:       opts.SupportsVolumeCondition,
+		translator:                    opts.Translator,
+		operations:                    opts.Operations,
+		unhealthyNodeAction:           opts.UnhealthyNodePolicy.Action,
+		unhealthyNodeTaints:           sets.NewString(opts.UnhealthyNodePolicy.TaintKeys...),
+		forceDetachGracePeriod:        opts.ForceDetachGracePeriod,
+		nodeSelector:                  nodeSelector,
+		CSIHandlerState:               state,
+	}
+}
+
+func (h *csiHandler) Init(vaQueue workqueue.RateLimitingInterface, pvQueue workqueue.RateLimitingInterface, eventRecorder record.EventRecorder) {
 	h.vaQueue = vaQueue
 	h.pvQueue = pvQueue
+	h.eventRecorder = eventRecorder
+}
+
+// reconciledVolume is the volume handle of a VolumeAttachment, resolved for
+// given versions of the VolumeAttachment and its PV.
+type reconciledVolume struct {
+	vaResourceVersion string
+	pvResourceVersion string
+	volumeHandle      string
+}
+
+// reconcileStats are statistics of one ReconcileVA cycle.
+type reconcileStats struct {
+	// scanned is the number of VolumeAttachments of this attacher.
+	scanned int
+	// skipped is the number of VolumeAttachments that are not reconciled,
+	// because they have not been attached yet.
+	skipped int
+	// drifted is the number of VolumeAttachments whose attached status
+	// differs from the actual state and that were queued for force sync.
+	drifted int
+	// errors is the number of VolumeAttachments that could not be
+	// reconciled because of an error, e.g. a missing PV or a failed
+	// ListVolumes / ControllerGetVolume call.
+	errors int
+}
+
+// report logs the statistics and exports them as metrics.
+func (s reconcileStats) report(attacherName string) {
+	klog.V(2).Infof("Reconciled VolumeAttachments of %s: %d scanned, %d skipped, %d drifted, %d errors", attacherName, s.scanned, s.skipped, s.drifted, s.errors)
+	reconcileVolumeAttachments.WithLabelValues(attacherName, reconcileScanned).Set(float64(s.scanned))
+	reconcileVolumeAttachments.WithLabelValues(attacherName, reconcileSkipped).Set(float64(s.skipped))
+	reconcileVolumeAttachments.WithLabelValues(attacherName, reconcileDrifted).Set(float64(s.drifted))
+	reconcileVolumeAttachments.WithLabelValues(attacherName, reconcileErrors).Set(float64(s.errors))
 }
 
 // ReconcileVA lists volumes from the CSI Driver and reconciles the attachment
 // status with the corresponding VolumeAttachment object. If the attachment
 // status of the volume is different from the state on the VolumeAttachment the
-// VolumeAttachment object is patched to the correct state.
+// VolumeAttachment object is patched to the correct state. Only
+// VolumeAttachments of this attacher are reconciled.
 func (h *csiHandler) ReconcileVA() error {
 	klog.V(4).Info("Reconciling VolumeAttachments with driver backend state")
-
-	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
-	defer cancel()
-
-	// Loop over all volume attachment objects
-	vas, err := h.vaLister.List(labels.Everything())
+	// Loop over all volume attachment objects of this attacher
+	vas, err := listVAsByIndex(h.vaIndexer, vaAttacherIndex, h.attacherName)
 	if err != nil {
+		// Nothing is known about the VolumeAttachments, the metrics keep
+		// the statistics of the last cycle.
 		return errors.New("failed to list all VolumeAttachment objects")
 	}
+	stats, err := h.reconcileVAs(vas)
+	stats.report(h.attacherName)
+	return err
+}
 
-	published, err := h.CSIVolumeLister.ListVolumes(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to ListVolumes: %v", err)
+// reconcileVAs implements ReconcileVA for the given VolumeAttachments of this
+// attacher and returns statistics of the cycle.
+func (h *csiHandler) reconcileVAs(vas []*storage.VolumeAttachment) (stats reconcileStats, err error) {
+
+	type attachment struct {
+		va           *storage.VolumeAttachment
+		volumeHandle string
+		nodeID       string
+		// published is true when the driver reported the volume as published
+		// to the node.
+		published bool
+		// reconciled is true when the attachment was already compared with
+		// the actual state.
+		reconciled bool
+		// condition is the volume condition reported by the driver.
+		condition *csi.VolumeCondition
 	}
-
+	attachments := map[string][]*attachment{}
+	reconciledVolumes := make(map[string]reconciledVolume, len(vas))
 	for _, va := range vas {
-		nodeID, ok := va.Annotations[vaNodeIDAnnotation]
-		if !ok {
-			klog.Warningf("Failed to find node ID in VolumeAttachment %s annotation", va.Name)
+		if va.Spec.Attacher != h.attacherName {
+			// listVAsByIndex returns only VolumeAttachments of this
+			// attacher, be defensive anyway.
 			continue
 		}
-		pvSpec, err := h.getProcessedPVSpec(va)
-		if err != nil {
-			klog.Warningf("Failed to get PV Spec: %v", err)
+		if !h.handlesVA(va) {
+			// Reconciled by the replica of the attacher that owns it.
 			continue
 		}
-
-		source, err := getCSISource(pvSpec)
-		if err != nil {
-			klog.Warningf("Failed to get CSI Source: %v", err)
+		stats.scanned++
+		nodeID, ok := va.Annotations[vaNodeIDAnnotation]
+		if !ok {
+			// ControllerPublish has not been called yet.
+			klog.V(4).Infof("VolumeAttachment %s has no node ID annotation, skipping", va.Name)
+			stats.skipped++
 			continue
 		}
-
-		volumeHandle, _, err := GetVolumeHandle(source)
+		volume, err := h.getReconciledVolume(va, nodeID)
 		if err != nil {
-			klog.Warningf("Failed to get volume handle: %v", err)
+			klog.Warningf("Failed to reconcile VolumeAttachment %s: %v", va.Name, err)
+			stats.errors++
 			continue
 		}
-		attachedStatus := va.Status.Attached
+		reconciledVolumes[va.Name] = volume
+		a := &attachment{va: va, volumeHandle: volume.volumeHandle, nodeID: nodeID}
+		attachments[volume.volumeHandle] = append(attachments[volume.volumeHandle], a)
+	}
+	// Forget VolumeAttachments that are gone.
+	h.reconciledVolumes = reconciledVolumes
+
+	// normal and abnormal count attached volumes by their condition.
+	var normal, abnormal int
+
+	// reconcile compares attached status of the VA with the actual state and
+	// adds it to the VA queue when they differ.
+	reconcile := func(a *attachment) {
+		a.reconciled = true
+		// If the actual attached status is different, add to shared workQueue.
+		attachedStatus := a.va.Status.Attached
+		if attachedStatus != a.published {
+			stats.drifted++
+			klog.Warningf("VA %s for volume %s has attached status %v but actual state %v. Adding back to VA queue for forced reprocessing", a.va.Name, a.volumeHandle, attachedStatus, a.published)
+			// Add this item to the vaQueue with forceSync so that it is force
+			// processed again, we avoid UPDATE on the VA or forcing a direct
+			// attach/detach as to avoid race conditions with the main attacher
+			// queue
+			h.setForceSync(a.va.Name)
+			h.vaQueue.Add(a.va.Name)
+		}
+		if h.supportsVolumeCondition && a.published && a.condition != nil {
+			h.updateVolumeCondition(a.va, a.condition)
+			if a.condition.Abnormal {
+				abnormal++
+			} else {
+				normal++
+			}
+		}
+	}
+	// markPublished checks whether the volume is published to the nodes of
+	// its attachments.
+	markPublished := func(volumeHandle string, status attacher.VolumeStatus) {
+		for _, a := range attachments[volumeHandle] {
+			a.condition = status.Condition
+			for _, gotNodeID := range status.PublishedNodeIDs {
+				if gotNodeID == a.nodeID {
+					a.published = true
+					break
+				}
+			}
+		}
+	}
 
-		// If volume driver has corresponding in-tree plugin, generate a correct volumehandle
-		isMig, err := h.isMigratable(va)
-		if err != nil {
-			klog.Warningf("Failed to check if migratable for volume handle %s (driver %s): %v", volumeHandle, source.Driver, err)
-			continue
+	// reportConditions exports the number of volumes in each condition. It's
+	// not called when ListVolumes fails, the metric keeps values of the last
+	// complete cycle then.
+	reportConditions := func() {
+		if !h.supportsVolumeCondition {
+			for _, condition := range []string{conditionNormal, conditionAbnormal} {
+				volumeConditions.Delete(map[string]string{labelDriverName: h.attacherName, labelCondition: condition})
+			}
+			return
 		}
-		if isMig {
-			volumeHandle, err = h.translator.RepairVolumeHandle(source.Driver, volumeHandle, nodeID)
+		volumeConditions.WithLabelValues(h.attacherName, conditionNormal).Set(float64(normal))
+		volumeConditions.WithLabelValues(h.attacherName, conditionAbnormal).Set(float64(abnormal))
+	}
+
+	if h.reconcileWithGetVolume {
+		for volumeHandle, as := range attachments {
+			status, err := h.getVolumeStatus(volumeHandle)
 			if err != nil {
-				klog.Warningf("Failed to repair volume handle %s for driver %s: %v", volumeHandle, source.Driver, err)
+				// The actual state is unknown.
+				klog.Warningf("Skipping reconciliation of volume %s: %v", volumeHandle, err)
+				stats.errors += len(as)
 				continue
 			}
+			markPublished(volumeHandle, *status)
+			for _, a := range as {
+				reconcile(a)
+			}
 		}
+		reportConditions()
+		return stats, nil
+	}
 
-		// Check whether the volume is published to this node
-		found := false
-		for _, gotNodeID := range published[volumeHandle] {
-			if gotNodeID == nodeID {
-				found = true
-				break
+	// Each ListVolumes page has its own timeout, see attacher.CSIVolumeLister.
+	err = h.CSIVolumeLister.ListVolumes(context.Background(), func(page map[string]attacher.VolumeStatus) {
+		for volumeHandle, status := range page {
+			markPublished(volumeHandle, status)
+			for _, a := range attachments[volumeHandle] {
+				// A volume published to the node is reconciled right away,
+				// the remaining pages can't change that.
+				if a.published && !a.reconciled {
+					reconcile(a)
+				}
 			}
 		}
+	})
+	if err != nil {
+		// Volumes not seen so far may be on the pages that failed, their
+		// actual state is unknown.
+		for _, as := range attachments {
+			for _, a := range as {
+				if !a.reconciled {
+					stats.errors++
+				}
+			}
+		}
+		return stats, fmt.Errorf("failed to ListVolumes: %v", err)
+	}
 
-		// If ListVolumes Attached Status is different, add to shared workQueue.
-		if attachedStatus != found {
-			klog.Warningf("VA %s for volume %s has attached status %v but actual state %v. Adding back to VA queue for forced reprocessing", va.Name, volumeHandle, attachedStatus, found)
-			// Add this item to the vaQueue with forceSync so that it is force
-			// processed again, we avoid UPDATE on the VA or forcing a direct
-			// attach/detach as to avoid race conditions with the main attacher
-			// queue
-			h.setForceSync(va.Name)
-			h.vaQueue.Add(va.Name)
+	// The rest of the attachments are not published anywhere.
+	for _, as := range attachments {
+		for _, a := range as {
+			if !a.reconciled {
+				reconcile(a)
+			}
 		}
 	}
-	return nil
+	reportConditions()
+	return stats, nil
+}
+
+// getReconciledVolume returns the volume handle of the VolumeAttachment. The PV
+// is translated only when the VolumeAttachment or the PV changed since the
+// last ReconcileVA.
+func (h *csiHandler) getReconciledVolume(va *storage.VolumeAttachment, nodeID string) (reconciledVolume, error) {
+	volume := reconciledVolume{vaResourceVersion: va.ResourceVersion}
+	if va.Spec.Source.PersistentVolumeName != nil {
+		pv, err := h.pvLister.Get(*va.Spec.Source.PersistentVolumeName)
+		if err != nil {
+			return volume, fmt.Errorf("failed to get PV: %v", err)
+		}
+		volume.pvResourceVersion = pv.ResourceVersion
+	}
+	if cached, found := h.reconciledVolumes[va.Name]; found && volume.vaResourceVersion != "" &&
+		cached.vaResourceVersion == volume.vaResourceVersion && cached.pvResourceVersion == volume.pvResourceVersion {
+		return cached, nil
+	}
+
+	pvSpec, err := h.getProcessedPVSpec(va)
+	if err != nil {
+		return volume, fmt.Errorf("failed to get PV Spec: %v", err)
+	}
+
+	source, err := getCSISource(pvSpec)
+	if err != nil {
+		return volume, fmt.Errorf("failed to get CSI Source: %v", err)
+	}
+
+	volumeHandle, _, err := GetVolumeHandle(source)
+	if err != nil {
+		return volume, fmt.Errorf("failed to get volume handle: %v", err)
+	}
+
+	// If volume driver has corresponding in-tree plugin, generate a correct volumehandle
+	isMig, err := h.isMigratable(va)
+	if err != nil {
+		return volume, fmt.Errorf("failed to check if migratable for volume handle %s (driver %s): %v", volumeHandle, source.Driver, err)
+	}
+	if isMig {
+		repairedHandle, err := h.translator.RepairVolumeHandle(source.Driver, volumeHandle, nodeID)
+		if err != nil {
+			return volume, fmt.Errorf("failed to repair volume handle %s for driver %s: %v", volumeHandle, source.Driver, err)
+		}
+		volumeHandle = repairedHandle
+	}
+	volume.volumeHandle = volumeHandle
+	return volume, nil
+}
+
+// getVolumeStatus returns status of the volume, using ControllerGetVolume with
+// its own timeout.
+func (h *csiHandler) getVolumeStatus(volumeHandle string) (*attacher.VolumeStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	return h.CSIVolumeLister.GetVolumeStatus(ctx, volumeHandle)
+}
+
+// updateVolumeCondition exposes condition of an attached volume reported by the
+// driver as VolumeAttachment annotations. A Warning event is emitted when the
+// volume becomes abnormal.
+func (h *csiHandler) updateVolumeCondition(va *storage.VolumeAttachment, condition *csi.VolumeCondition) {
+	abnormalValue := strconv.FormatBool(condition.Abnormal)
+	if va.Annotations[vaVolumeConditionAbnormalAnnotation] == abnormalValue && va.Annotations[vaVolumeConditionMessageAnnotation] == condition.Message {
+		return
+	}
+	clone := va.DeepCopy()
+	if clone.Annotations == nil {
+		clone.Annotations = map[string]string{}
+	}
+	clone.Annotations[vaVolumeConditionAbnormalAnnotation] = abnormalValue
+	clone.Annotations[vaVolumeConditionMessageAnnotation] = condition.Message
+	if _, err := h.patchVA(va, clone); err != nil {
+		klog.Warningf("Failed to save volume condition to VolumeAttachment %s: %v", va.Name, err)
+		return
+	}
+	klog.V(4).Infof("Saved volume condition (abnormal: %v) to VolumeAttachment %s", condition.Abnormal, va.Name)
+	if condition.Abnormal {
+		recordVAEvent(h.eventRecorder, va, v1.EventTypeWarning, eventReasonVolumeConditionAbnormal, "Volume attached to node %q is abnormal: %s", va.Spec.NodeName, condition.Message)
+	}
 }
 
 // setForceSync sets the intention that next time the VolumeAttachment
@@ -201,6 +569,14 @@ func (h *csiHandler) setForceSync(vaName string) {
 	h.forceSync[vaName] = true
 }
 
+// isForceSync returns true when forceSync was set for the VA referenced by
+// vaName and not consumed yet.
+func (h *csiHandler) isForceSync(vaName string) bool {
+	h.forceSyncMux.Lock()
+	defer h.forceSyncMux.Unlock()
+	return h.forceSync[vaName]
+}
+
 // consumeForceSync is used to check whether forceSync was set for the VA
 // referenced by vaName. It will then remove the forceSync intention so that the
 // VA will only be forceSync-ed once per request
@@ -214,6 +590,41 @@ func (h *csiHandler) consumeForceSync(vaName string) bool {
 	return s
 }
 
+// setFinalAttachError remembers that ControllerPublish of the VolumeAttachment
+// referenced by vaName failed with a final error. The fingerprint identifies
+// parameters of the failed call, see attachFingerprint.
+func (h *csiHandler) setFinalAttachError(vaName, fingerprint string) {
+	h.finalAttachErrorsMux.Lock()
+	defer h.finalAttachErrorsMux.Unlock()
+	h.finalAttachErrors[vaName] = fingerprint
+}
+
+// hasFinalAttachError checks whether the last ControllerPublish of the
+// VolumeAttachment referenced by vaName failed with a final error and with the
+// same parameters as given by the fingerprint.
+func (h *csiHandler) hasFinalAttachError(vaName, fingerprint string) bool {
+	h.finalAttachErrorsMux.Lock()
+	defer h.finalAttachErrorsMux.Unlock()
+	f, ok := h.finalAttachErrors[vaName]
+	return ok && f == fingerprint
+}
+
+// clearFinalAttachError forgets any final error of the VolumeAttachment
+// referenced by vaName.
+func (h *csiHandler) clearFinalAttachError(vaName string) {
+	h.finalAttachErrorsMux.Lock()
+	defer h.finalAttachErrorsMux.Unlock()
+	delete(h.finalAttachErrors, vaName)
+}
+
+// finishOperation finishes the operation of the volume and re-queues
+// VolumeAttachments that waited for it.
+func (h *csiHandler) finishOperation(volumeHandle, nodeName string) {
+	for _, vaName := range h.operations.finish(volumeHandle, nodeName) {
+		h.vaQueue.Add(vaName)
+	}
+}
+
 func (h *csiHandler) SyncNewOrUpdatedVolumeAttachment(va *storage.VolumeAttachment) {
 	klog.V(4).Infof("CSIHandler: processing VA %q", va.Name)
 
@@ -223,6 +634,16 @@ func (h *csiHandler) SyncNewOrUpdatedVolumeAttachment(va *storage.VolumeAttachme
 	} else {
 		err = h.syncDetach(va)
 	}
+	if err == errOperationPending {
+		// The VA is re-queued when the other operation finishes, it's not
+		// a failure.
+		klog.V(4).Infof("Operation on the volume of %q is in progress, deferring", va.Name)
+		return
+	}
+	if err == errVANotHandled {
+		klog.V(4).Infof("%q is processed by another attacher, skipping", va.Name)
+		return
+	}
 	if err != nil {
 		// Re-queue with exponential backoff
 		klog.V(2).Infof("Error processing %q: %s", va.Name, err)
@@ -235,22 +656,62 @@ func (h *csiHandler) SyncNewOrUpdatedVolumeAttachment(va *storage.VolumeAttachme
 }
 
 func (h *csiHandler) syncAttach(va *storage.VolumeAttachment) error {
-	if !h.consumeForceSync(va.Name) && va.Status.Attached {
+	forceSync := h.consumeForceSync(va.Name)
+	if !forceSync && va.Status.Attached {
 		// Volume is attached and no force sync, there is nothing to be done.
 		klog.V(4).Infof("%q is already attached", va.Name)
 		return nil
 	}
 
+	reason, err := h.getUnhealthyNodeReason(va.Spec.NodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %q: %s", va.Spec.NodeName, err)
+	}
+	if reason != "" {
+		if forceSync {
+			// Keep the intention for the time the node is healthy again.
+			h.setForceSync(va.Name)
+		}
+		return h.skipAttachToUnhealthyNode(va, reason)
+	}
+
 	// Attach and report any error
 	klog.V(2).Infof("Attaching %q", va.Name)
-	va, metadata, err := h.csiAttach(va)
+	va, metadata, detached, err := h.csiAttach(va)
+	var missingDependency *missingDependencyError
+	if errors.As(err, &missingDependency) {
+		klog.V(4).Infof("%q waits for %s", va.Name, missingDependency.dependency)
+		h.dependencies.wait(va.Name, missingDependency.dependency)
+	} else {
+		h.dependencies.forget(va.Name)
+	}
+	if err == errFinalAttachErrorUnchanged {
+		klog.V(4).Infof("%q failed to attach with a final error and nothing has changed since then, not retrying", va.Name)
+		return nil
+	}
+	if err == errOperationPending || err == errVANotHandled {
+		return err
+	}
 	if err != nil {
 		var saveErr error
-		va, saveErr = h.saveAttachError(va, err)
+		if detached {
+			va, saveErr = h.saveFinalAttachError(va, err)
+		} else {
+			va, saveErr = h.saveAttachError(va, err)
+		}
 		if saveErr != nil {
 			// Just log it, propagate the attach error.
 			klog.V(2).Infof("Failed to save attach error to %q: %s", va.Name, saveErr.Error())
 		}
+		recordVAEvent(h.eventRecorder, va, v1.EventTypeWarning, eventReasonFailedAttach, "AttachVolume failed for node %q%s: %v", va.Spec.NodeName, errorCodeSuffix(err), err)
+		if detached && saveErr == nil {
+			// The volume is for sure not attached and another ControllerPublish
+			// with the same parameters would fail the same way. Don't retry
+			// with exponential backoff, the VA is processed again when it,
+			// its PV or its secret changes.
+			klog.V(2).Infof("Failed to attach %q with a final error, not retrying until the VolumeAttachment, PersistentVolume or secret changes: %s", va.Name, err)
+			return nil
+		}
 		// Add context to the error for logging
 		err := fmt.Errorf("failed to attach: %s", err)
 		return err
@@ -261,12 +722,114 @@ func (h *csiHandler) syncAttach(va *storage.VolumeAttachment) error {
 	if _, err := markAsAttached(h.client, va, metadata); err != nil {
 		return fmt.Errorf("failed to mark as attached: %s", err)
 	}
+	recordVAEvent(h.eventRecorder, va, v1.EventTypeNormal, eventReasonAttached, "Volume attached to node %q", va.Spec.NodeName)
 	klog.V(4).Infof("Fully attached %q", va.Name)
 	return nil
 }
 
+// forgetVA drops the state of a deleted VolumeAttachment.
+func (h *csiHandler) forgetVA(vaName string) {
+	h.dependencies.forget(vaName)
+	h.clearFinalAttachError(vaName)
+	h.releaseAttachSlot(vaName)
+}
+
+func (h *csiHandler) setVAFilter(filter func(va *storage.VolumeAttachment) bool) {
+	h.vaFilter = filter
+}
+
+// handlesVA returns true when the VolumeAttachment passes the filter of the
+// controller.
+func (h *csiHandler) handlesVA(va *storage.VolumeAttachment) bool {
+	return h.vaFilter == nil || h.vaFilter(va)
+}
+
+// dependencyAvailable returns VolumeAttachments that waited for the given
+// dependency. The controller re-queues them without backoff.
+func (h *csiHandler) dependencyAvailable(dependency string) []string {
+	return h.dependencies.available(dependency)
+}
+
+// getForceDetachReason returns why the volume of the VolumeAttachment may be
+// force detached and how much of the grace period remains, measured from
+// deletion of the VolumeAttachment. It returns an empty reason when the
+// volume must not be force detached.
+func (h *csiHandler) getForceDetachReason(va *storage.VolumeAttachment) (string, time.Duration) {
+	if h.forceDetachGracePeriod <= 0 || va.DeletionTimestamp == nil {
+		return "", 0
+	}
+	var reason string
+	node, err := h.nodeLister.Get(va.Spec.NodeName)
+	switch {
+	case apierrs.IsNotFound(err):
+		reason = fmt.Sprintf("node %q does not exist", va.Spec.NodeName)
+	case err != nil:
+		klog.V(2).Infof("Failed to get node %q: %s", va.Spec.NodeName, err)
+		return "", 0
+	case hasTaint(node, taintNodeOutOfService):
+		reason = fmt.Sprintf("node %q is out of service", va.Spec.NodeName)
+	default:
+		return "", 0
+	}
+	remaining := time.Until(va.DeletionTimestamp.Add(h.forceDetachGracePeriod))
+	return reason, remaining
+}
+
+// forceDetach marks the VolumeAttachment as detached, although the volume may
+// be still attached.
+func (h *csiHandler) forceDetach(va *storage.VolumeAttachment, reason string, detachErr error) error {
+	klog.Warningf("Force detaching %q, %s: last detach error: %s", va.Name, reason, detachErr)
+	va, err := markAsDetached(h.client, va)
+	if err != nil {
+		return fmt.Errorf("could not mark as detached: %s", err)
+	}
+	recordVAEvent(h.eventRecorder, va, v1.EventTypeWarning, eventReasonForceDetached, "Volume force detached from node %q after %s, %s, the volume may be still attached: %v", va.Spec.NodeName, h.forceDetachGracePeriod, reason, detachErr)
+	return nil
+}
+
+// getUnhealthyNodeReason returns why volumes should not be attached to the
+// node, or an empty string when the node is healthy or the attacher is
+// configured to attach volumes to unhealthy nodes.
+func (h *csiHandler) getUnhealthyNodeReason(nodeName string) (string, error) {
+	if h.unhealthyNodeAction == UnhealthyNodeAllow || h.unhealthyNodeAction == "" {
+		return "", nil
+	}
+	node, err := h.nodeLister.Get(nodeName)
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			return fmt.Sprintf("node %q does not exist", nodeName), nil
+		}
+		return "", err
+	}
+	return getUnhealthyNodeReason(node, h.unhealthyNodeTaints), nil
+}
+
+// skipAttachToUnhealthyNode saves the reason why the volume is not attached to
+// the VolumeAttachment. With UnhealthyNodeDelay, it returns an error to re-try
+// the attach after exponential backoff. With UnhealthyNodeRefuse, the
+// VolumeAttachment is processed again when its node changes.
+func (h *csiHandler) skipAttachToUnhealthyNode(va *storage.VolumeAttachment, reason string) error {
+	var nodeErr error
+	if h.unhealthyNodeAction == UnhealthyNodeRefuse {
+		nodeErr = fmt.Errorf("refusing to attach to unhealthy node: %s", reason)
+	} else {
+		nodeErr = fmt.Errorf("delaying attach to unhealthy node: %s", reason)
+	}
+	klog.V(2).Infof("Not attaching %q: %s", va.Name, nodeErr)
+	va, err := h.saveAttachError(va, nodeErr)
+	if err != nil {
+		return fmt.Errorf("failed to save attach error: %s", err)
+	}
+	recordVAEvent(h.eventRecorder, va, v1.EventTypeWarning, eventReasonFailedAttach, "AttachVolume failed for node %q: %v", va.Spec.NodeName, nodeErr)
+	if h.unhealthyNodeAction == UnhealthyNodeRefuse {
+		return nil
+	}
+	return nodeErr
+}
+
 func (h *csiHandler) syncDetach(va *storage.VolumeAttachment) error {
 	klog.V(4).Infof("Starting detach operation for %q", va.Name)
+	h.forgetVA(va.Name)
 	if !h.consumeForceSync(va.Name) && !h.hasVAFinalizer(va) {
 		klog.V(4).Infof("%q is already detached", va.Name)
 		return nil
@@ -274,18 +837,40 @@ func (h *csiHandler) syncDetach(va *storage.VolumeAttachment) error {
 
 	// Detach and report any error
 	klog.V(2).Infof("Detaching %q", va.Name)
-	va, err := h.csiDetach(va)
+	va, unpublishFailed, err := h.csiDetach(va)
+	if err == errOperationPending || err == errVANotHandled {
+		return err
+	}
 	if err != nil {
+		// Only volumes that the driver failed to detach are force
+		// detached. Errors before ControllerUnpublish, such as a missing
+		// secret, are not related to the node being gone.
+		var reason string
+		var remaining time.Duration
+		if unpublishFailed {
+			reason, remaining = h.getForceDetachReason(va)
+		}
+		if reason != "" {
+			if remaining <= 0 {
+				// The last attempt to detach has failed too.
+				return h.forceDetach(va, reason, err)
+			}
+			// Make sure the VA is processed when the grace period
+			// expires, exponential backoff may be longer.
+			h.vaQueue.AddAfter(va.Name, remaining)
+		}
 		var saveErr error
 		va, saveErr = h.saveDetachError(va, err)
 		if saveErr != nil {
 			// Just log it, propagate the detach error.
 			klog.V(2).Infof("Failed to save detach error to %q: %s", va.Name, saveErr.Error())
 		}
+		recordVAEvent(h.eventRecorder, va, v1.EventTypeWarning, eventReasonFailedDetach, "DetachVolume failed for node %q%s: %v", va.Spec.NodeName, errorCodeSuffix(err), err)
 		// Add context to the error for logging
 		err := fmt.Errorf("failed to detach: %s", err)
 		return err
 	}
+	recordVAEvent(h.eventRecorder, va, v1.EventTypeNormal, eventReasonDetached, "Volume detached from node %q", va.Spec.NodeName)
 	klog.V(4).Infof("Fully detached %q", va.Name)
 	return nil
 }
@@ -321,6 +906,84 @@ func (h *csiHandler) prepareVANodeID(va *storage.VolumeAttachment, nodeID string
 	return clone, true
 }
 
+// prepareVADetachRecord adds the volume handle, the publish secret reference
+// and the migration flag to the VA annotations, so csiDetach can detach the
+// volume without its PV.
+func (h *csiHandler) prepareVADetachRecord(va *storage.VolumeAttachment, csiSource *v1.CSIPersistentVolumeSource, migratable bool) (newVA *storage.VolumeAttachment, modified bool) {
+	record := map[string]string{
+		vaVolumeHandleAnnotation: csiSource.VolumeHandle,
+	}
+	if ref := csiSource.ControllerPublishSecretRef; ref != nil {
+		record[vaPublishSecretRefAnnotation] = ref.Namespace + "/" + ref.Name
+	}
+	if migratable {
+		record[vaMigratedAnnotation] = "true"
+	}
+	upToDate := true
+	for _, key := range []string{vaVolumeHandleAnnotation, vaPublishSecretRefAnnotation, vaMigratedAnnotation} {
+		value, found := va.Annotations[key]
+		if expected, expectedFound := record[key]; found != expectedFound || value != expected {
+			upToDate = false
+			break
+		}
+	}
+	if upToDate {
+		klog.V(4).Infof("Detach record is already set on %q", va.Name)
+		return va, false
+	}
+	clone := va.DeepCopy()
+	if clone.Annotations == nil {
+		clone.Annotations = map[string]string{}
+	}
+	delete(clone.Annotations, vaPublishSecretRefAnnotation)
+	delete(clone.Annotations, vaMigratedAnnotation)
+	for key, value := range record {
+		clone.Annotations[key] = value
+	}
+	klog.V(4).Infof("Detach record added to %q", va.Name)
+	return clone, true
+}
+
+// prepareVANodeSelector records the node selector of the controller in the
+// VolumeAttachment, so the controller can detach the volume after the node is
+// deleted and its labels are not known.
+func (h *csiHandler) prepareVANodeSelector(va *storage.VolumeAttachment) (newVA *storage.VolumeAttachment, modified bool) {
+	if h.nodeSelector == "" {
+		return va, false
+	}
+	if selector, found := va.Annotations[vaNodeSelectorAnnotation]; found && selector == h.nodeSelector {
+		klog.V(4).Infof("Node selector annotation is already set on %q", va.Name)
+		return va, false
+	}
+	clone := va.DeepCopy()
+	if clone.Annotations == nil {
+		clone.Annotations = map[string]string{}
+	}
+	clone.Annotations[vaNodeSelectorAnnotation] = h.nodeSelector
+	klog.V(4).Infof("Node selector annotation added to %q", va.Name)
+	return clone, true
+}
+
+// getDetachRecord returns CSI source and migration flag recorded by
+// prepareVADetachRecord. It returns nil when the VA has no record, e.g. when
+// it was attached by an older attacher.
+func getDetachRecord(va *storage.VolumeAttachment) (*v1.CSIPersistentVolumeSource, bool) {
+	volumeHandle, found := va.Annotations[vaVolumeHandleAnnotation]
+	if !found {
+		return nil, false
+	}
+	csiSource := &v1.CSIPersistentVolumeSource{
+		Driver:       va.Spec.Attacher,
+		VolumeHandle: volumeHandle,
+	}
+	if ref, found := va.Annotations[vaPublishSecretRefAnnotation]; found {
+		if parts := strings.SplitN(ref, "/", 2); len(parts) == 2 {
+			csiSource.ControllerPublishSecretRef = &v1.SecretReference{Namespace: parts[0], Name: parts[1]}
+		}
+	}
+	return csiSource, va.Annotations[vaMigratedAnnotation] == "true"
+}
+
 func (h *csiHandler) saveVA(va *storage.VolumeAttachment, patch []byte) (*storage.VolumeAttachment, error) {
 	newVA, err := h.client.StorageV1().VolumeAttachments().Patch(context.TODO(), va.Name, types.MergePatchType, patch, metav1.PatchOptions{})
 	if err != nil {
@@ -420,7 +1083,10 @@ func (h *csiHandler) getProcessedPVSpec(va *storage.VolumeAttachment) (*v1.Persi
 	}
 }
 
-func (h *csiHandler) csiAttach(va *storage.VolumeAttachment) (*storage.VolumeAttachment, map[string]string, error) {
+// csiAttach attaches the volume referenced by given VolumeAttachment. The
+// returned bool is "detached" value of Attacher.Attach - when true, the
+// returned error is final and the volume is for sure not attached to the node.
+func (h *csiHandler) csiAttach(va *storage.VolumeAttachment) (*storage.VolumeAttachment, map[string]string, bool, error) {
 	klog.V(4).Infof("Starting attach operation for %q", va.Name)
 	// Check as much as possible before adding VA finalizer - it would block
 	// deletion of VA on error.
@@ -430,25 +1096,28 @@ func (h *csiHandler) csiAttach(va *storage.VolumeAttachment) (*storage.VolumeAtt
 	var migratable bool
 	if va.Spec.Source.PersistentVolumeName != nil {
 		if va.Spec.Source.InlineVolumeSpec != nil {
-			return va, nil, errors.New("both InlineCSIVolumeSource and PersistentVolumeName specified in VA source")
+			return va, nil, false, errors.New("both InlineCSIVolumeSource and PersistentVolumeName specified in VA source")
 		}
 		pv, err := h.pvLister.Get(*va.Spec.Source.PersistentVolumeName)
 		if err != nil {
-			return va, nil, err
+			if apierrs.IsNotFound(err) {
+				err = &missingDependencyError{dependency: pvDependency(*va.Spec.Source.PersistentVolumeName), err: err}
+			}
+			return va, nil, false, err
 		}
 		// Refuse to attach volumes that are marked for deletion.
 		if pv.DeletionTimestamp != nil {
-			return va, nil, fmt.Errorf("PersistentVolume %q is marked for deletion", pv.Name)
+			return va, nil, false, fmt.Errorf("PersistentVolume %q is marked for deletion", pv.Name)
 		}
 		pv, err = h.addPVFinalizer(pv)
 		if err != nil {
-			return va, nil, fmt.Errorf("could not add PersistentVolume finalizer: %s", err)
+			return va, nil, false, fmt.Errorf("could not add PersistentVolume finalizer: %s", err)
 		}
 
 		if h.translator.IsPVMigratable(pv) {
 			pv, err = h.translator.TranslateInTreePVToCSI(pv)
 			if err != nil {
-				return va, nil, fmt.Errorf("failed to translate in tree pv to CSI: %v", err)
+				return va, nil, false, fmt.Errorf("failed to translate in tree pv to CSI: %v", err)
 			}
 			migratable = true
 		}
@@ -457,7 +1126,7 @@ func (h *csiHandler) csiAttach(va *storage.VolumeAttachment) (*storage.VolumeAtt
 		// migrated
 		csiSource, err = getCSISource(&pv.Spec)
 		if err != nil {
-			return va, nil, err
+			return va, nil, false, err
 		}
 
 		pvSpec = &pv.Spec
@@ -465,22 +1134,22 @@ func (h *csiHandler) csiAttach(va *storage.VolumeAttachment) (*storage.VolumeAtt
 		if va.Spec.Source.InlineVolumeSpec.CSI != nil {
 			csiSource = va.Spec.Source.InlineVolumeSpec.CSI
 		} else {
-			return va, nil, errors.New("inline volume spec contains nil CSI source")
+			return va, nil, false, errors.New("inline volume spec contains nil CSI source")
 		}
 
 		pvSpec = va.Spec.Source.InlineVolumeSpec
 	} else {
-		return va, nil, errors.New("neither InlineCSIVolumeSource nor PersistentVolumeName specified in VA source")
+		return va, nil, false, errors.New("neither InlineCSIVolumeSource nor PersistentVolumeName specified in VA source")
 	}
 
 	attributes, err := GetVolumeAttributes(csiSource)
 	if err != nil {
-		return va, nil, err
+		return va, nil, false, err
 	}
 
 	volumeHandle, readOnly, err := GetVolumeHandle(csiSource)
 	if err != nil {
-		return va, nil, err
+		return va, nil, false, err
 	}
 	if !h.supportsPublishReadOnly {
 		// "CO MUST set this field to false if SP does not have the
@@ -488,88 +1157,148 @@ func (h *csiHandler) csiAttach(va *storage.VolumeAttachment) (*storage.VolumeAtt
 		readOnly = false
 	}
 
-	volumeCapabilities, err := GetVolumeCapabilities(pvSpec)
+	volumeCapabilities, err := GetVolumeCapabilities(pvSpec, h.supportsSingleNodeMultiWriter)
 	if err != nil {
-		return va, nil, err
+		return va, nil, false, err
 	}
 	secrets, err := h.getCredentialsFromPV(csiSource)
 	if err != nil {
-		return va, nil, err
+		return va, nil, false, err
 	}
 
 	nodeID, err := h.getNodeID(h.attacherName, va.Spec.NodeName, nil)
 	if err != nil {
-		return va, nil, err
+		// The driver registers itself in CSINode when it starts on the
+		// node.
+		return va, nil, false, &missingDependencyError{dependency: csiNodeDependency(va.Spec.NodeName), err: err}
+	}
+	if err := h.checkAttachLimit(va); err != nil {
+		return va, nil, false, err
+	}
+	defer func() {
+		// VolumeAttachments with the finalizer are counted by
+		// checkAttachLimit, the others must not keep their slot.
+		if !h.hasVAFinalizer(va) {
+			h.releaseAttachSlot(va.Name)
+		}
+	}()
+
+	fingerprint := attachFingerprint(volumeHandle, readOnly, nodeID, volumeCapabilities, attributes, secrets)
+	if h.hasFinalAttachError(va.Name, fingerprint) {
+		return va, nil, true, errFinalAttachErrorUnchanged
+	}
+
+	// The VolumeAttachment may have moved to another replica while its PV,
+	// secrets and CSINode were read.
+	if !h.handlesVA(va) {
+		return va, nil, false, errVANotHandled
 	}
 
 	originalVA := va
 	va, finalizerAdded := h.prepareVAFinalizer(va)
 	va, nodeIDAdded := h.prepareVANodeID(va, nodeID)
+	va, recordAdded := h.prepareVADetachRecord(va, csiSource, migratable)
+	va, selectorAdded := h.prepareVANodeSelector(va)
 
-	if finalizerAdded || nodeIDAdded {
+	if finalizerAdded || nodeIDAdded || recordAdded || selectorAdded {
 		if va, err = h.patchVA(originalVA, va); err != nil {
-			return originalVA, nil, fmt.Errorf("could not save VolumeAttachment: %s", err)
+			return originalVA, nil, false, fmt.Errorf("could not save VolumeAttachment: %s", err)
 		}
 	}
 
+	if !h.operations.start(volumeHandle, va.Spec.NodeName, va.Name) {
+		return va, nil, false, errOperationPending
+	}
+	defer h.finishOperation(volumeHandle, va.Spec.NodeName)
+
+	// Retries of a failing attach are reported by FailedAttachVolume events,
+	// announce only the first attempt.
+	if va.Status.AttachError == nil {
+		recordVAEvent(h.eventRecorder, va, v1.EventTypeNormal, eventReasonAttaching, "Attaching volume %q to node %q", volumeHandle, va.Spec.NodeName)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
 	ctx = markAsMigrated(ctx, migratable)
 	defer cancel()
-	// We're not interested in `detached` return value, the controller will
-	// issue Detach to be sure the volume is really detached.
-	publishInfo, _, err := h.attacher.Attach(ctx, volumeHandle, readOnly, nodeID, volumeCapabilities, attributes, secrets)
+	publishInfo, detached, err := h.attacher.Attach(ctx, volumeHandle, readOnly, nodeID, volumeCapabilities, attributes, secrets)
 	if err != nil {
-		return va, nil, err
+		if detached {
+			h.setFinalAttachError(va.Name, fingerprint)
+		}
+		return va, nil, detached, err
 	}
+	h.clearFinalAttachError(va.Name)
 
-	return va, publishInfo, nil
+	return va, publishInfo, false, nil
 }
 
-func (h *csiHandler) csiDetach(va *storage.VolumeAttachment) (*storage.VolumeAttachment, error) {
+// csiDetach detaches the volume referenced by given VolumeAttachment. The
+// returned bool is true when the error was returned by ControllerUnpublish,
+// i.e. the driver was asked to detach the volume and failed.
+func (h *csiHandler) csiDetach(va *storage.VolumeAttachment) (*storage.VolumeAttachment, bool, error) {
 	var csiSource *v1.CSIPersistentVolumeSource
 	var migratable bool
 	if va.Spec.Source.PersistentVolumeName != nil {
 		if va.Spec.Source.InlineVolumeSpec != nil {
-			return va, errors.New("both InlineCSIVolumeSource and PersistentVolumeName specified in VA source")
+			return va, false, errors.New("both InlineCSIVolumeSource and PersistentVolumeName specified in VA source")
 		}
 		pv, err := h.pvLister.Get(*va.Spec.Source.PersistentVolumeName)
-		if err != nil {
-			return va, err
-		}
-		if h.translator.IsPVMigratable(pv) {
-			pv, err = h.translator.TranslateInTreePVToCSI(pv)
+		switch {
+		case err == nil:
+			if h.translator.IsPVMigratable(pv) {
+				pv, err = h.translator.TranslateInTreePVToCSI(pv)
+				if err != nil {
+					return va, false, fmt.Errorf("failed to translate in tree pv to CSI: %v", err)
+				}
+				migratable = true
+			}
+			csiSource, err = getCSISource(&pv.Spec)
 			if err != nil {
-				return va, fmt.Errorf("failed to translate in tree pv to CSI: %v", err)
+				return va, false, err
 			}
-			migratable = true
-		}
-		csiSource, err = getCSISource(&pv.Spec)
-		if err != nil {
-			return va, err
+		case apierrs.IsNotFound(err):
+			// The PV was force deleted, detach the volume with what it
+			// was attached with.
+			csiSource, migratable = getDetachRecord(va)
+			if csiSource == nil {
+				return va, false, err
+			}
+			klog.V(2).Infof("PersistentVolume %q not found, detaching %q using its detach record", *va.Spec.Source.PersistentVolumeName, va.Name)
+		default:
+			return va, false, err
 		}
 	} else if va.Spec.Source.InlineVolumeSpec != nil {
 		if va.Spec.Source.InlineVolumeSpec.CSI != nil {
 			csiSource = va.Spec.Source.InlineVolumeSpec.CSI
 		} else {
-			return va, errors.New("inline volume spec contains nil CSI source")
+			return va, false, errors.New("inline volume spec contains nil CSI source")
 		}
 	} else {
-		return va, errors.New("neither InlineCSIVolumeSource nor PersistentVolumeName specified in VA source")
+		return va, false, errors.New("neither InlineCSIVolumeSource nor PersistentVolumeName specified in VA source")
 	}
 
 	volumeHandle, _, err := GetVolumeHandle(csiSource)
 	if err != nil {
-		return va, err
+		return va, false, err
 	}
 	secrets, err := h.getCredentialsFromPV(csiSource)
 	if err != nil {
-		return va, err
+		return va, false, err
 	}
 
 	nodeID, err := h.getNodeID(h.attacherName, va.Spec.NodeName, va)
 	if err != nil {
-		return va, err
+		return va, false, err
+	}
+	// The VolumeAttachment may have moved to another replica while its PV
+	// and secrets were read.
+	if !h.handlesVA(va) {
+		return va, false, errVANotHandled
+	}
+
+	if !h.operations.start(volumeHandle, va.Spec.NodeName, va.Name) {
+		return va, false, errOperationPending
 	}
+	defer h.finishOperation(volumeHandle, va.Spec.NodeName)
 
 	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
 	ctx = markAsMigrated(ctx, migratable)
@@ -578,15 +1307,15 @@ func (h *csiHandler) csiDetach(va *storage.VolumeAttachment) (*storage.VolumeAtt
 	if err != nil {
 		// The volume may not be fully detached. Save the error and try again
 		// after backoff.
-		return va, err
+		return va, true, err
 	}
 	klog.V(2).Infof("Detached %q", va.Name)
 
 	if va, err := markAsDetached(h.client, va); err != nil {
-		return va, fmt.Errorf("could not mark as detached: %s", err)
+		return va, false, fmt.Errorf("could not mark as detached: %s", err)
 	}
 
-	return va, nil
+	return va, false, nil
 }
 
 func (h *csiHandler) saveAttachError(va *storage.VolumeAttachment, err error) (*storage.VolumeAttachment, error) {
@@ -605,6 +1334,43 @@ func (h *csiHandler) saveAttachError(va *storage.VolumeAttachment, err error) (*
 	return newVa, nil
 }
 
+// saveFinalAttachError saves an attach error after which the volume is for
+// sure not attached to the node. The VA is marked as not attached and its
+// finalizer is removed, there is nothing to detach when the VA gets deleted.
+func (h *csiHandler) saveFinalAttachError(va *storage.VolumeAttachment, err error) (*storage.VolumeAttachment, error) {
+	klog.V(4).Infof("Saving final attach error to %q", va.Name)
+	clone := va.DeepCopy()
+	clone.Status.Attached = false
+	clone.Status.AttachmentMetadata = nil
+	clone.Status.AttachError = &storage.VolumeError{
+		Message: err.Error(),
+		Time:    metav1.Now(),
+	}
+
+	newVA, err := h.patchVA(va, clone, "status")
+	if err != nil {
+		return va, err
+	}
+	klog.V(4).Infof("Saved final attach error to %q", va.Name)
+
+	if !h.hasVAFinalizer(newVA) {
+		return newVA, nil
+	}
+	finalizerName := GetFinalizerName(h.attacherName)
+	clone = newVA.DeepCopy()
+	clone.Finalizers = nil
+	for _, f := range newVA.Finalizers {
+		if f != finalizerName {
+			clone.Finalizers = append(clone.Finalizers, f)
+		}
+	}
+	if newVA, err = h.patchVA(newVA, clone); err != nil {
+		return newVA, err
+	}
+	klog.V(4).Infof("Finalizer removed from %q", va.Name)
+	return newVA, nil
+}
+
 func (h *csiHandler) saveDetachError(va *storage.VolumeAttachment, err error) (*storage.VolumeAttachment, error) {
 	klog.V(4).Infof("Saving detach error to %q", va.Name)
 	clone := va.DeepCopy()
@@ -667,20 +1433,18 @@ func (h *csiHandler) SyncNewOrUpdatedPersistentVolume(pv *v1.PersistentVolume) {
 	}
 
 	// Check that there is no VA that requires the PV
-	vas, err := h.vaLister.List(labels.Everything())
+	vas, err := listVAsByIndex(h.vaIndexer, vaPVNameIndex, pv.Name)
 	if err != nil {
 		// Failed listing VAs? Try again with exp. backoff
 		klog.Errorf("Failed to list VolumeAttachments for PV %q: %s", pv.Name, err.Error())
 		h.pvQueue.AddRateLimited(pv.Name)
 		return
 	}
-	for _, va := range vas {
-		if va.Spec.Source.PersistentVolumeName != nil && *va.Spec.Source.PersistentVolumeName == pv.Name {
-			// This PV is needed by this VA, don't remove finalizer
-			klog.V(4).Infof("CSIHandler: processing PV %q: VA %q found", pv.Name, va.Name)
-			h.pvQueue.Forget(pv.Name)
-			return
-		}
+	if len(vas) > 0 {
+		// This PV is needed by this VA, don't remove finalizer
+		klog.V(4).Infof("CSIHandler: processing PV %q: VA %q found", pv.Name, vas[0].Name)
+		h.pvQueue.Forget(pv.Name)
+		return
 	}
 	// No VA found -> remove finalizer
 	klog.V(4).Infof("CSIHandler: processing PV %q: no VA found, removing finalizer", pv.Name)
@@ -720,9 +1484,13 @@ func (h *csiHandler) getCredentialsFromPV(csiSource *v1.CSIPersistentVolumeSourc
 		return nil, nil
 	}
 
-	secret, err := h.client.CoreV1().Secrets(secretRef.Namespace).Get(context.TODO(), secretRef.Name, metav1.GetOptions{})
+	secret, err := h.getSecret(secretRef.Namespace, secretRef.Name)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load secret \"%s/%s\": %s", secretRef.Namespace, secretRef.Name, err)
+		loadErr := fmt.Errorf("failed to load secret \"%s/%s\": %s", secretRef.Namespace, secretRef.Name, err)
+		if apierrs.IsNotFound(err) {
+			return nil, &missingDependencyError{dependency: secretDependency(secretRef.Namespace, secretRef.Name), err: loadErr}
+		}
+		return nil, loadErr
 	}
 	credentials := map[string]string{}
 	for key, value := range secret.Data {
@@ -732,6 +1500,20 @@ func (h *csiHandler) getCredentialsFromPV(csiSource *v1.CSIPersistentVolumeSourc
 	return credentials, nil
 }
 
+// getSecret returns the secret from the secret cache or, when it's not cached,
+// from the API server. Secrets that don't match the label selector of the
+// cache and secrets that were just created are not cached.
+func (h *csiHandler) getSecret(namespace, name string) (*v1.Secret, error) {
+	if h.secretCache != nil {
+		if secret, found := h.secretCache.Get(namespace, name); found {
+			secretCacheRequests.WithLabelValues(h.attacherName, secretCacheHit).Inc()
+			return secret, nil
+		}
+		secretCacheRequests.WithLabelValues(h.attacherName, secretCacheMiss).Inc()
+	}
+	return h.client.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+}
+
 // getNodeID finds node ID from CSINode API object. If caller wants, it can find
 // node ID stored in VolumeAttachment annotation.
 func (h *csiHandler) getNodeID(driver string, nodeName string, va *storage.VolumeAttachment) (string, error) {
@@ -764,6 +1546,92 @@ func (h *csiHandler) getNodeID(driver string, nodeName string, va *storage.Volum
 	return "", err
 }
 
+// checkAttachLimit returns an error when attaching the VolumeAttachment would
+// exceed the number of volumes of the driver that can be attached to the node,
+// as reported in CSINode. Volumes that are attached or being attached count
+// against the limit. When the check passes, the VolumeAttachment keeps a slot
+// of the node reserved until the informer shows its finalizer or until it's
+// released.
+func (h *csiHandler) checkAttachLimit(va *storage.VolumeAttachment) error {
+	csiNode, err := h.csiNodeLister.Get(va.Spec.NodeName)
+	if err != nil {
+		// getNodeID has already found the CSINode, it must have been
+		// deleted in the meantime.
+		return err
+	}
+	limit, found := GetAttachLimitFromCSINode(h.attacherName, csiNode)
+	if !found {
+		return nil
+	}
+
+	reserved, err := h.attachReservations.reserve(va.Spec.NodeName, va.Name, int(limit), func() (sets.String, error) {
+		return h.attachedVAs(va.Spec.NodeName, va.Name)
+	})
+	if err != nil {
+		return err
+	}
+	if !reserved {
+		return fmt.Errorf("node %q has reached the limit of %d volumes attached by driver %s", va.Spec.NodeName, limit, h.attacherName)
+	}
+	return nil
+}
+
+// attachedVAs returns VolumeAttachments of the node that are attached or
+// being attached by the driver according to the informer, except the given
+// one.
+func (h *csiHandler) attachedVAs(nodeName, except string) (sets.String, error) {
+	vas, err := listVAsByIndex(h.vaIndexer, vaNodeNameIndex, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	attached := sets.NewString()
+	for _, va := range vas {
+		if va.Name == except || va.Spec.Attacher != h.attacherName {
+			continue
+		}
+		// VA finalizer is added just before ControllerPublish and removed
+		// after ControllerUnpublish.
+		if va.Status.Attached || h.hasVAFinalizer(va) {
+			attached.Insert(va.Name)
+		}
+	}
+	return attached, nil
+}
+
+// attachSlotFreed re-queues VolumeAttachments refused because the node had
+// reached its attach limit, as many as there are free slots of the node, in
+// the order they were refused.
+func (h *csiHandler) attachSlotFreed(nodeName string) {
+	csiNode, err := h.csiNodeLister.Get(nodeName)
+	if err != nil {
+		// No CSINode, no limit.
+		return
+	}
+	limit, found := GetAttachLimitFromCSINode(h.attacherName, csiNode)
+	if !found {
+		return
+	}
+	vaNames, err := h.attachReservations.waiting(nodeName, int(limit), func() (sets.String, error) {
+		return h.attachedVAs(nodeName, "")
+	})
+	if err != nil {
+		klog.Errorf("Failed to count volumes attached to node %q: %v", nodeName, err)
+		return
+	}
+	for _, vaName := range vaNames {
+		klog.V(4).Infof("Node %q has a free attach slot, enqueueing VolumeAttachment %q", nodeName, vaName)
+		h.vaQueue.Add(vaName)
+	}
+}
+
+// releaseAttachSlot removes reservation of the VolumeAttachment and gives
+// the slot to a VolumeAttachment that waits for it.
+func (h *csiHandler) releaseAttachSlot(vaName string) {
+	if nodeName := h.attachReservations.release(vaName); nodeName != "" {
+		h.attachSlotFreed(nodeName)
+	}
+}
+
 func (h *csiHandler) patchVA(va, clone *storage.VolumeAttachment, subresources ...string) (*storage.VolumeAttachment,
 	error) {
 	patch, err := createMergePatch(va, clone)
@@ -792,6 +1660,22 @@ func (h *csiHandler) patchPV(pv, clone *v1.PersistentVolume) (*v1.PersistentVolu
 	return newPV, nil
 }
 
+// attachFingerprint returns a digest of all parameters of a ControllerPublish
+// call. It does not contain the secrets in plain text, so it can be kept in
+// memory.
+func attachFingerprint(volumeHandle string, readOnly bool, nodeID string, caps *csi.VolumeCapability, attributes, secrets map[string]string) string {
+	data, _ := json.Marshal(struct {
+		VolumeHandle string
+		ReadOnly     bool
+		NodeID       string
+		Capability   string
+		Attributes   map[string]string
+		Secrets      map[string]string
+	}{volumeHandle, readOnly, nodeID, caps.String(), attributes, secrets})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 func markAsMigrated(parent context.Context, hasMigrated bool) context.Context {
 	return context.WithValue(parent, connection.AdditionalInfoKey, connection.AdditionalInfo{Migrated: strconv.FormatBool(hasMigrated)})
 }
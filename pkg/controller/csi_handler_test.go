@@ -20,22 +20,33 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/connection"
 	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	v1 "k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
 	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	k8smetrics "k8s.io/component-base/metrics"
 	csitranslator "k8s.io/csi-translation-lib"
 	"k8s.io/klog/v2"
 )
@@ -47,40 +58,109 @@ const (
 
 var (
 	ann = map[string]string{
+		vaNodeIDAnnotation:       "nodeID1",
+		vaVolumeHandleAnnotation: testVolumeHandle,
+	}
+	// annWithoutRecord are annotations of a VA attached by an older attacher,
+	// without the detach record.
+	annWithoutRecord = map[string]string{
 		vaNodeIDAnnotation: "nodeID1",
 	}
+	annGCEPD = map[string]string{
+		vaNodeIDAnnotation:       "nodeID1",
+		vaVolumeHandleAnnotation: "projects/UNSPECIFIED/zones/testZone/disks/testpd",
+		vaMigratedAnnotation:     "true",
+	}
 )
 
 var timeout = 10 * time.Millisecond
 
+// annWith returns ann with an additional annotation.
+func annWith(key, value string) map[string]string {
+	annotations := map[string]string{key: value}
+	for k, v := range ann {
+		annotations[k] = v
+	}
+	return annotations
+}
+
+// testCSIHandlerOptions returns options of a CSI handler with all
+// optional features disabled, except PUBLISH_READONLY.
+func testCSIHandlerOptions(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher, lister VolumeLister) CSIHandlerOptions {
+	return CSIHandlerOptions{
+		Client:                  client,
+		AttacherName:            testAttacherName,
+		Attacher:                csi,
+		VolumeLister:            lister,
+		PVLister:                informerFactory.Core().V1().PersistentVolumes().Lister(),
+		CSINodeLister:           informerFactory.Storage().V1().CSINodes().Lister(),
+		VAIndexer:               informerFactory.Storage().V1().VolumeAttachments().Informer().GetIndexer(),
+		NodeLister:              informerFactory.Core().V1().Nodes().Lister(),
+		Timeout:                 timeout,
+		SupportsPublishReadOnly: true,
+		Translator:              csitranslator.New(),
+		Operations:              NewOperationTracker(false),
+		UnhealthyNodePolicy:     UnhealthyNodePolicy{Action: UnhealthyNodeAllow},
+	}
+}
+
+// csiHandlerFactoryWith returns a factory of CSI handlers with
+// testCSIHandlerOptions changed by modify.
+func csiHandlerFactoryWith(modify func(opts *CSIHandlerOptions)) handlerFactory {
+	return func(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher, lister VolumeLister) Handler {
+		opts := testCSIHandlerOptions(client, informerFactory, csi, lister)
+		modify(&opts)
+		return NewCSIHandler(opts)
+	}
+}
+
 func csiHandlerFactory(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher, lister VolumeLister) Handler {
-	return NewCSIHandler(
-		client,
-		testAttacherName,
-		csi,
-		lister,
-		informerFactory.Core().V1().PersistentVolumes().Lister(),
-		informerFactory.Storage().V1().CSINodes().Lister(),
-		informerFactory.Storage().V1().VolumeAttachments().Lister(),
-		&timeout,
-		true, /* supports PUBLISH_READONLY */
-		csitranslator.New(),
-	)
+	return NewCSIHandler(testCSIHandlerOptions(client, informerFactory, csi, lister))
+}
+
+var csiHandlerFactoryNoReadOnly = csiHandlerFactoryWith(func(opts *CSIHandlerOptions) {
+	opts.SupportsPublishReadOnly = false
+})
+
+var csiHandlerFactoryGetVolume = csiHandlerFactoryWith(func(opts *CSIHandlerOptions) {
+	opts.ReconcileWithGetVolume = true
+})
+
+var csiHandlerFactoryVolumeCondition = csiHandlerFactoryWith(func(opts *CSIHandlerOptions) {
+	opts.SupportsVolumeCondition = true
+})
+
+var csiHandlerFactoryForceDetach = csiHandlerFactoryWith(func(opts *CSIHandlerOptions) {
+	opts.ForceDetachGracePeriod = time.Minute
+})
+
+func csiHandlerFactoryUnhealthyNode(action UnhealthyNodeAction) handlerFactory {
+	return csiHandlerFactoryWith(func(opts *CSIHandlerOptions) {
+		opts.UnhealthyNodePolicy = UnhealthyNodePolicy{Action: action, TaintKeys: []string{testTaintKey}}
+	})
+}
+
+const testTaintKey = "ToBeDeletedByClusterAutoscaler"
+
+func nodeWithReady(ready v1.ConditionStatus) *v1.Node {
+	node := node()
+	node.Status.Conditions = []v1.NodeCondition{
+		{
+			Type:   v1.NodeReady,
+			Status: ready,
+		},
+	}
+	return node
+}
+
+func nodeWithTaint(node *v1.Node, key string) *v1.Node {
+	node.Spec.Taints = append(node.Spec.Taints, v1.Taint{Key: key, Effect: v1.TaintEffectNoSchedule})
+	return node
 }
 
-func csiHandlerFactoryNoReadOnly(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher, lister VolumeLister) Handler {
-	return NewCSIHandler(
-		client,
-		testAttacherName,
-		csi,
-		lister,
-		informerFactory.Core().V1().PersistentVolumes().Lister(),
-		informerFactory.Storage().V1().CSINodes().Lister(),
-		informerFactory.Storage().V1().VolumeAttachments().Lister(),
-		&timeout,
-		false, /* does not support PUBLISH_READONLY */
-		csitranslator.New(),
-	)
+func nodeDeleted(node *v1.Node) *v1.Node {
+	node.DeletionTimestamp = &metav1.Time{}
+	return node
 }
 
 func pv() *v1.PersistentVolume {
@@ -223,6 +303,19 @@ func csiNode() *storage.CSINode {
 	}
 }
 
+func csiNodeWithLimit(limit int32) *storage.CSINode {
+	node := csiNode()
+	node.Spec.Drivers[0].Allocatable = &storage.VolumeNodeResources{Count: &limit}
+	return node
+}
+
+func otherVA(attacher string) *storage.VolumeAttachment {
+	va := va(true, fin, ann)
+	va.Name = "other-va"
+	va.Spec.Attacher = attacher
+	return va
+}
+
 func csiNodeEmpty() *storage.CSINode {
 	return &storage.CSINode{
 		ObjectMeta: metav1.ObjectMeta{
@@ -309,6 +402,10 @@ func TestCSIHandler(t *testing.T) {
 			expectedCSICalls: []csiCall{
 				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
 			},
+			expectedEvents: []string{
+				"Normal AttachingVolume", "Normal AttachingVolume",
+				"Normal SuccessfulAttachVolume", "Normal SuccessfulAttachVolume",
+			},
 		},
 		{
 			name:           "VolumeAttachment with InlineVolumeSpec -> successful attachment",
@@ -325,6 +422,11 @@ func TestCSIHandler(t *testing.T) {
 			expectedCSICalls: []csiCall{
 				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
 			},
+			// Inline volumes have no PV to report events on.
+			expectedEvents: []string{
+				"Normal AttachingVolume",
+				"Normal SuccessfulAttachVolume",
+			},
 		},
 		{
 			name:           "readOnly VolumeAttachment added -> successful attachment",
@@ -436,10 +538,10 @@ func TestCSIHandler(t *testing.T) {
 				// Finalizer is saved first
 				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
 					types.MergePatchType, patch(va(false /*attached*/, "" /*finalizer*/, nil /* annotations */),
-						va(false /*attached*/, fin, ann))),
+						va(false /*attached*/, fin, annWith(vaPublishSecretRefAnnotation, "default/secret")))),
 				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
-					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
-						va(true /*attached*/, fin, ann)), "status"),
+					types.MergePatchType, patch(va(false /*attached*/, fin, annWith(vaPublishSecretRefAnnotation, "default/secret")),
+						va(true /*attached*/, fin, annWith(vaPublishSecretRefAnnotation, "default/secret"))), "status"),
 			},
 			expectedCSICalls: []csiCall{
 				{"attach", testVolumeHandle, testNodeID, noAttrs, map[string]string{"foo": "bar"}, readWrite, success, notDetached, noMetadata, 0},
@@ -454,10 +556,10 @@ func TestCSIHandler(t *testing.T) {
 				// Finalizer is saved first
 				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
 					types.MergePatchType, patch(va(false /*attached*/, "" /*finalizer*/, nil /* annotations */),
-						va(false /*attached*/, fin, ann))),
+						va(false /*attached*/, fin, annWith(vaPublishSecretRefAnnotation, "default/secret")))),
 				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
-					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
-						va(true /*attached*/, fin, ann)), "status"),
+					types.MergePatchType, patch(va(false /*attached*/, fin, annWith(vaPublishSecretRefAnnotation, "default/secret")),
+						va(true /*attached*/, fin, annWith(vaPublishSecretRefAnnotation, "default/secret"))), "status"),
 			},
 			expectedCSICalls: []csiCall{
 				{"attach", testVolumeHandle, testNodeID, noAttrs, map[string]string{"foo": "bar"}, readWrite, success, notDetached, noMetadata, 0},
@@ -472,10 +574,10 @@ func TestCSIHandler(t *testing.T) {
 				// Finalizer is saved first
 				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
 					types.MergePatchType, patch(va(false /*attached*/, "" /*finalizer*/, nil /* annotations */),
-						va(false /*attached*/, fin, ann))),
+						va(false /*attached*/, fin, annWith(vaPublishSecretRefAnnotation, "default/emptySecret")))),
 				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
-					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
-						va(true /*attached*/, fin, ann)), "status"),
+					types.MergePatchType, patch(va(false /*attached*/, fin, annWith(vaPublishSecretRefAnnotation, "default/emptySecret")),
+						va(true /*attached*/, fin, annWith(vaPublishSecretRefAnnotation, "default/emptySecret"))), "status"),
 			},
 			expectedCSICalls: []csiCall{
 				{"attach", testVolumeHandle, testNodeID, noAttrs, map[string]string{}, readWrite, success, notDetached, noMetadata, 0},
@@ -490,10 +592,10 @@ func TestCSIHandler(t *testing.T) {
 				// Finalizer is saved first
 				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
 					types.MergePatchType, patch(va(false /*attached*/, "" /*finalizer*/, nil /* annotations */),
-						va(false /*attached*/, fin, ann))),
+						va(false /*attached*/, fin, annWith(vaPublishSecretRefAnnotation, "default/emptySecret")))),
 				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
-					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
-						va(true /*attached*/, fin, ann)), "status"),
+					types.MergePatchType, patch(va(false /*attached*/, fin, annWith(vaPublishSecretRefAnnotation, "default/emptySecret")),
+						va(true /*attached*/, fin, annWith(vaPublishSecretRefAnnotation, "default/emptySecret"))), "status"),
 			},
 			expectedCSICalls: []csiCall{
 				{"attach", testVolumeHandle, testNodeID, noAttrs, map[string]string{}, readWrite, success, notDetached, noMetadata, 0},
@@ -826,6 +928,115 @@ func TestCSIHandler(t *testing.T) {
 				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, fmt.Errorf("mock error"), notDetached, noMetadata, 0},
 				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
 			},
+			expectedEvents: []string{
+				"Normal AttachingVolume", "Normal AttachingVolume",
+				"Warning FailedAttachVolume AttachVolume failed for node \"node1\": mock error",
+				"Warning FailedAttachVolume pv1-node1: AttachVolume failed for node \"node1\": mock error",
+				"Normal SuccessfulAttachVolume", "Normal SuccessfulAttachVolume",
+			},
+		},
+		{
+			name:           "CSI attach fails twice -> AttachingVolume event only on the first attempt",
+			initialObjects: []runtime.Object{pvWithFinalizer(), csiNode()},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "" /*finalizer*/, nil /* annotations */),
+						va(false /*attached*/, fin, ann))),
+				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone,
+					testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin /*finalizer*/, ann /* annotations */),
+						vaWithAttachError(va(false, fin, ann), "mock error")),
+					"status"),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "" /*finalizer*/, nil /* annotations */),
+						va(false /*attached*/, fin, ann))),
+				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone,
+					testPVName+"-"+testNodeName,
+					// The test framework rebuilds patches with sanitized error time
+					// against an empty VolumeAttachment.
+					types.MergePatchType, patch(&storage.VolumeAttachment{},
+						vaWithAttachError(&storage.VolumeAttachment{}, "mock error 2")),
+					"status"),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "" /*finalizer*/, nil /* annotations */),
+						va(false /*attached*/, fin, ann))),
+				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone,
+					testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(vaWithAttachError(va(false, fin, ann), "mock error 2"),
+						va(true /*attached*/, fin, ann)), "status"),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, fmt.Errorf("mock error"), notDetached, noMetadata, 0},
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, fmt.Errorf("mock error 2"), notDetached, noMetadata, 0},
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+			expectedEvents: []string{
+				"Normal AttachingVolume", "Normal AttachingVolume",
+				"Warning FailedAttachVolume AttachVolume failed for node \"node1\": mock error",
+				"Warning FailedAttachVolume pv1-node1: AttachVolume failed for node \"node1\": mock error",
+				"Warning FailedAttachVolume AttachVolume failed for node \"node1\": mock error 2",
+				"Warning FailedAttachVolume pv1-node1: AttachVolume failed for node \"node1\": mock error 2",
+				"Normal SuccessfulAttachVolume", "Normal SuccessfulAttachVolume",
+			},
+		},
+		{
+			name:           "CSI attach fails with gRPC error -> event with error code",
+			initialObjects: []runtime.Object{pvWithFinalizer(), csiNode()},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "" /*finalizer*/, nil /* annotations */),
+						va(false /*attached*/, fin, ann))),
+				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone,
+					testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin /*finalizer*/, ann /* annotations */),
+						vaWithAttachError(va(false, fin, ann), "rpc error: code = Unavailable desc = mock error")),
+					"status"),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "" /*finalizer*/, nil /* annotations */),
+						va(false /*attached*/, fin, ann))),
+				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone,
+					testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(vaWithAttachError(va(false, fin, ann), "rpc error: code = Unavailable desc = mock error"),
+						va(true /*attached*/, fin, ann)), "status"),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, status.Error(codes.Unavailable, "mock error"), notDetached, noMetadata, 0},
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+			expectedEvents: []string{
+				"Normal AttachingVolume", "Normal AttachingVolume",
+				"Warning FailedAttachVolume AttachVolume failed for node \"node1\" (Unavailable): rpc error: code = Unavailable desc = mock error",
+				"Warning FailedAttachVolume pv1-node1: AttachVolume failed for node \"node1\" (Unavailable)",
+				"Normal SuccessfulAttachVolume", "Normal SuccessfulAttachVolume",
+			},
+		},
+		{
+			name:           "CSI attach fails with final error -> VA finalizer removed, no retry",
+			initialObjects: []runtime.Object{pvWithFinalizer(), csiNode()},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "" /*finalizer*/, nil /* annotations */),
+						va(false /*attached*/, fin, ann))),
+				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone,
+					testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin /*finalizer*/, ann /* annotations */),
+						vaWithAttachError(va(false, fin, ann), "rpc error: code = InvalidArgument desc = mock error")),
+					"status"),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
+						va(false /*attached*/, "", ann))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, status.Error(codes.InvalidArgument, "mock error"), detached, noMetadata, 0},
+			},
+			expectedEvents: []string{
+				"Normal AttachingVolume", "Normal AttachingVolume",
+				"Warning FailedAttachVolume AttachVolume failed for node \"node1\" (InvalidArgument)",
+				"Warning FailedAttachVolume pv1-node1: AttachVolume failed for node \"node1\" (InvalidArgument)",
+			},
 		},
 		{
 			name:           "CSI attach times out -> controller retries",
@@ -887,6 +1098,31 @@ func TestCSIHandler(t *testing.T) {
 					"status"),
 			},
 		},
+		{
+			name:           "CSINode attach limit reached -> error",
+			initialObjects: []runtime.Object{pvWithFinalizer(), csiNodeWithLimit(1), otherVA(testAttacherName)},
+			addedVA:        va(false, fin, ann),
+			expectedActions: []core.Action{
+				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
+						vaWithAttachError(va(false, fin, ann), "node \"node1\" has reached the limit of 1 volumes attached by driver csi/test")),
+					"status"),
+			},
+			expectedEvents: []string{"Warning FailedAttachVolume", "Warning FailedAttachVolume"},
+		},
+		{
+			name:           "CSINode attach limit with volumes of another driver -> success",
+			initialObjects: []runtime.Object{pvWithFinalizer(), csiNodeWithLimit(1), otherVA("csi/other")},
+			addedVA:        va(false, fin, ann),
+			expectedActions: []core.Action{
+				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
+						va(true /*attached*/, fin, ann)), "status"),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+		},
 		{
 			name:           "CSINode exists with the driver, Node without annotations -> success",
 			initialObjects: []runtime.Object{pvWithFinalizer(), csiNode()},
@@ -912,10 +1148,10 @@ func TestCSIHandler(t *testing.T) {
 				// Finalizer is saved first
 				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
 					types.MergePatchType, patch(va(false /*attached*/, "" /*finalizer*/, nil /* annotations */),
-						va(false /*attached*/, fin, ann))),
+						va(false /*attached*/, fin, annGCEPD))),
 				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
-					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
-						va(true /*attached*/, fin, ann)), "status"),
+					types.MergePatchType, patch(va(false /*attached*/, fin, annGCEPD),
+						va(true /*attached*/, fin, annGCEPD)), "status"),
 			},
 			expectedCSICalls: []csiCall{
 				{"attach", "projects/UNSPECIFIED/zones/testZone/disks/testpd", testNodeID,
@@ -1066,6 +1302,10 @@ func TestCSIHandler(t *testing.T) {
 				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, fmt.Errorf("mock error"), ignored, noMetadata, 0},
 				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, ignored, noMetadata, 0},
 			},
+			expectedEvents: []string{
+				"Warning FailedDetachVolume", "Warning FailedDetachVolume",
+				"Normal SuccessfulDetachVolume", "Normal SuccessfulDetachVolume",
+			},
 		},
 		{
 			name:           "CSI detach times out -> controller retries",
@@ -1096,26 +1336,59 @@ func TestCSIHandler(t *testing.T) {
 			expectedCSICalls: []csiCall{},
 		},
 		{
-			name:           "detach unknown PV -> error",
+			name:           "detach unknown PV with detach record -> successful detach",
 			initialObjects: []runtime.Object{csiNode()},
 			addedVA:        deleted(va(true, fin, ann)),
+			expectedActions: []core.Action{
+				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(deleted(va(true, "", ann)),
+						deleted(va(false /*attached*/, "", ann))), "status"),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(deleted(va(false, fin, ann)),
+						deleted(va(false /*attached*/, "", ann)))),
+			},
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, ignored, noMetadata, 0},
+			},
+		},
+		{
+			name:           "detach unknown PV with detach record and secrets -> successful detach",
+			initialObjects: []runtime.Object{csiNode(), secret()},
+			addedVA:        deleted(va(true, fin, annWith(vaPublishSecretRefAnnotation, "default/secret"))),
+			expectedActions: []core.Action{
+				core.NewGetAction(secretGroupResourceVersion, "default", "secret"),
+				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(deleted(va(true, "", annWith(vaPublishSecretRefAnnotation, "default/secret"))),
+						deleted(va(false /*attached*/, "", annWith(vaPublishSecretRefAnnotation, "default/secret")))), "status"),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(deleted(va(false, fin, annWith(vaPublishSecretRefAnnotation, "default/secret"))),
+						deleted(va(false /*attached*/, "", annWith(vaPublishSecretRefAnnotation, "default/secret"))))),
+			},
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, testNodeID, noAttrs, map[string]string{"foo": "bar"}, readWrite, success, ignored, noMetadata, 0},
+			},
+		},
+		{
+			name:           "detach unknown PV without detach record -> error",
+			initialObjects: []runtime.Object{csiNode()},
+			addedVA:        deleted(va(true, fin, annWithoutRecord)),
 			expectedActions: []core.Action{
 				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone,
 					testPVName+"-"+testNodeName,
-					types.MergePatchType, patch(deleted(va(true, "", ann)),
-						deleted(vaWithDetachError(va(true, "", ann), "persistentvolume \"pv1\" not found"))),
+					types.MergePatchType, patch(deleted(va(true, "", annWithoutRecord)),
+						deleted(vaWithDetachError(va(true, "", annWithoutRecord), "persistentvolume \"pv1\" not found"))),
 					"status"),
 				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone,
 					testPVName+"-"+testNodeName,
-					types.MergePatchType, patch(deleted(va(false, "", ann)),
-						deleted(vaWithDetachError(va(false, "", ann), "persistentvolume \"pv1\" not found"))),
+					types.MergePatchType, patch(deleted(va(false, "", annWithoutRecord)),
+						deleted(vaWithDetachError(va(false, "", annWithoutRecord), "persistentvolume \"pv1\" not found"))),
 					"status"),
 			},
 		},
 		{
-			name:           "detach unknown PV -> error + error saving the error",
+			name:           "detach unknown PV without detach record -> error + error saving the error",
 			initialObjects: []runtime.Object{csiNode()},
-			addedVA:        deleted(va(true, fin, ann)),
+			addedVA:        deleted(va(true, fin, annWithoutRecord)),
 			reactors: []reaction{
 				{
 					verb:     "patch",
@@ -1140,20 +1413,20 @@ func TestCSIHandler(t *testing.T) {
 			// 4 such loops are tested below: two when the error save fails, and then two when the error succeeds.
 			expectedActions: []core.Action{
 				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
-					types.MergePatchType, patch(deleted(va(true, fin, ann)),
-						deleted(vaWithDetachError(va(true, fin, ann), "persistentvolume \"pv1\" not found"))),
+					types.MergePatchType, patch(deleted(va(true, fin, annWithoutRecord)),
+						deleted(vaWithDetachError(va(true, fin, annWithoutRecord), "persistentvolume \"pv1\" not found"))),
 					"status"),
 				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
-					types.MergePatchType, patch(deleted(va(true, fin, ann)),
-						deleted(vaWithDetachError(va(true, fin, ann), "persistentvolume \"pv1\" not found"))),
+					types.MergePatchType, patch(deleted(va(true, fin, annWithoutRecord)),
+						deleted(vaWithDetachError(va(true, fin, annWithoutRecord), "persistentvolume \"pv1\" not found"))),
 					"status"),
 				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
-					types.MergePatchType, patch(deleted(va(true, fin, ann)),
-						deleted(vaWithDetachError(va(true, fin, ann), "persistentvolume \"pv1\" not found"))),
+					types.MergePatchType, patch(deleted(va(true, fin, annWithoutRecord)),
+						deleted(vaWithDetachError(va(true, fin, annWithoutRecord), "persistentvolume \"pv1\" not found"))),
 					"status"),
 				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
-					types.MergePatchType, patch(deleted(va(true, fin, ann)),
-						deleted(vaWithDetachError(va(true, fin, ann), "persistentvolume \"pv1\" not found"))),
+					types.MergePatchType, patch(deleted(va(true, fin, annWithoutRecord)),
+						deleted(vaWithDetachError(va(true, fin, annWithoutRecord), "persistentvolume \"pv1\" not found"))),
 					"status"),
 			},
 		},
@@ -1396,6 +1669,440 @@ func TestCSIHandler(t *testing.T) {
 	runTests(t, csiHandlerFactory, tests)
 }
 
+func TestCSIHandlerFinalAttachErrorNotRetried(t *testing.T) {
+	vaObj := va(false, "", nil)
+	pvObj := pvWithFinalizer()
+	client := fake.NewSimpleClientset(vaObj, pvObj, csiNode())
+	informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(pvObj)
+	informerFactory.Storage().V1().CSINodes().Informer().GetStore().Add(csiNode())
+
+	lister := &fakeLister{t: t}
+	csiConnection := &fakeCSIConnection{t: t, lister: lister, calls: []csiCall{
+		{"attach", testVolumeHandle, testNodeID, nil, nil, false, status.Error(codes.InvalidArgument, "mock error"), true, nil, 0},
+	}}
+	handler := csiHandlerFactory(client, informerFactory, csiConnection, lister)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	handler.Init(queue, queue, record.NewFakeRecorder(100))
+
+	handler.SyncNewOrUpdatedVolumeAttachment(vaObj)
+	if queue.NumRequeues(vaObj.Name) != 0 {
+		t.Errorf("expected VA not to be re-queued after a final error, got %d requeues", queue.NumRequeues(vaObj.Name))
+	}
+
+	// Nothing has changed, the driver must not be called again.
+	handler.SyncNewOrUpdatedVolumeAttachment(vaObj)
+	if csiConnection.index != 1 {
+		t.Errorf("expected 1 CSI call, got %d", csiConnection.index)
+	}
+
+	// PV has changed, the driver is called again with new parameters.
+	attrs := map[string]string{"foo": "bar"}
+	informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Update(pvWithAttributes(pvWithFinalizer(), attrs))
+	csiConnection.calls = append(csiConnection.calls, csiCall{"attach", testVolumeHandle, testNodeID, attrs, nil, false, nil, false, nil, 0})
+	handler.SyncNewOrUpdatedVolumeAttachment(vaObj)
+	if csiConnection.index != 2 {
+		t.Errorf("expected 2 CSI calls, got %d", csiConnection.index)
+	}
+}
+
+func TestCSIHandlerSharedState(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	opts := testCSIHandlerOptions(client, informerFactory, nil, nil)
+	opts.State = NewCSIHandlerState()
+	oldHandler := NewCSIHandler(opts).(*csiHandler)
+	oldHandler.setForceSync("va1")
+	oldHandler.setFinalAttachError("va2", "fingerprint")
+	oldHandler.dependencies.wait("va3", csiNodeDependency("node1"))
+
+	// The handler replacing the old one, e.g. after capabilities of the
+	// driver changed, knows everything the old one did.
+	opts.SupportsVolumeCondition = true
+	newHandler := NewCSIHandler(opts).(*csiHandler)
+	if !newHandler.isForceSync("va1") {
+		t.Errorf("expected force sync of va1 to be kept")
+	}
+	if !newHandler.hasFinalAttachError("va2", "fingerprint") {
+		t.Errorf("expected final attach error of va2 to be kept")
+	}
+	if vaNames := newHandler.dependencyAvailable(csiNodeDependency("node1")); len(vaNames) != 1 || vaNames[0] != "va3" {
+		t.Errorf("expected va3 to wait for its CSINode, got %v", vaNames)
+	}
+}
+
+func TestCSIHandlerAttachLimitReservation(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	informerFactory.Storage().V1().CSINodes().Informer().GetStore().Add(csiNodeWithLimit(1))
+	vaStore := informerFactory.Storage().V1().VolumeAttachments().Informer().GetStore()
+	handler := NewCSIHandler(testCSIHandlerOptions(client, informerFactory, nil, nil)).(*csiHandler)
+
+	va1 := va(false, "", nil)
+	va2 := va(false, "", nil)
+	va2.Name = "va2"
+	vaStore.Add(va1)
+	vaStore.Add(va2)
+
+	if err := handler.checkAttachLimit(va1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// va1 is being attached, but the informer does not know it yet.
+	if err := handler.checkAttachLimit(va2); err == nil {
+		t.Errorf("expected va2 to exceed the attach limit reserved by va1")
+	}
+	// The same VolumeAttachment can check the limit again.
+	if err := handler.checkAttachLimit(va1); err != nil {
+		t.Errorf("unexpected error of va1 checked again: %s", err)
+	}
+
+	// The informer has caught up.
+	vaStore.Update(va(false, fin, ann))
+	if err := handler.checkAttachLimit(va2); err == nil {
+		t.Errorf("expected va2 to exceed the attach limit of attached va1")
+	}
+
+	// va1 is detached.
+	vaStore.Update(va1)
+	if err := handler.checkAttachLimit(va2); err != nil {
+		t.Errorf("unexpected error after va1 was detached: %s", err)
+	}
+
+	// Reservation of va2 is released when va2 is deleted.
+	handler.forgetVA(va2.Name)
+	if err := handler.checkAttachLimit(va1); err != nil {
+		t.Errorf("unexpected error after va2 was deleted: %s", err)
+	}
+}
+
+func TestCSIHandlerAttachLimitWaiters(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	informerFactory.Storage().V1().CSINodes().Informer().GetStore().Add(csiNodeWithLimit(1))
+	vaStore := informerFactory.Storage().V1().VolumeAttachments().Informer().GetStore()
+	handler := NewCSIHandler(testCSIHandlerOptions(client, informerFactory, nil, nil)).(*csiHandler)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	handler.Init(queue, queue, record.NewFakeRecorder(100))
+	getQueued := func() []string {
+		var items []string
+		for queue.Len() > 0 {
+			item, _ := queue.Get()
+			queue.Done(item)
+			items = append(items, item.(string))
+		}
+		return items
+	}
+
+	va1 := va(true, fin, ann)
+	va2 := va(false, "", nil)
+	va2.Name = "va2"
+	va3 := va(false, "", nil)
+	va3.Name = "va3"
+	for _, va := range []*storage.VolumeAttachment{va1, va2, va3} {
+		vaStore.Add(va)
+	}
+	for _, va := range []*storage.VolumeAttachment{va3, va2} {
+		if err := handler.checkAttachLimit(va); err == nil {
+			t.Fatalf("expected %s to exceed the attach limit", va.Name)
+		}
+	}
+	// Refused again, it keeps its place.
+	if err := handler.checkAttachLimit(va3); err == nil {
+		t.Fatalf("expected va3 to exceed the attach limit")
+	}
+
+	handler.attachSlotFreed(testNodeName)
+	if queued := getQueued(); len(queued) != 0 {
+		t.Errorf("expected no VolumeAttachment woken while the node is full, got %v", queued)
+	}
+
+	// va1 is detached, the first refused VolumeAttachment gets the slot.
+	vaStore.Update(va(false, "", nil))
+	handler.attachSlotFreed(testNodeName)
+	if queued := getQueued(); !reflect.DeepEqual(queued, []string{"va3"}) {
+		t.Errorf("expected only va3 to be woken, got %v", queued)
+	}
+	if err := handler.checkAttachLimit(va3); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	handler.attachSlotFreed(testNodeName)
+	if queued := getQueued(); len(queued) != 0 {
+		t.Errorf("expected no VolumeAttachment woken for the reserved slot, got %v", queued)
+	}
+
+	// Released reservation wakes the next one.
+	handler.forgetVA(va3.Name)
+	if queued := getQueued(); !reflect.DeepEqual(queued, []string{"va2"}) {
+		t.Errorf("expected va2 to be woken after va3 was deleted, got %v", queued)
+	}
+}
+
+func TestCSIHandlerOperationPending(t *testing.T) {
+	vaObj := deleted(va(true, fin, ann))
+	pvObj := pvWithFinalizer()
+	client := fake.NewSimpleClientset(vaObj, pvObj, csiNode())
+	informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(pvObj)
+	informerFactory.Storage().V1().CSINodes().Informer().GetStore().Add(csiNode())
+
+	lister := &fakeLister{t: t}
+	csiConnection := &fakeCSIConnection{t: t, lister: lister}
+	operations := NewOperationTracker(false)
+	opts := testCSIHandlerOptions(client, informerFactory, csiConnection, lister)
+	opts.Operations = operations
+	handler := NewCSIHandler(opts)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	handler.Init(queue, queue, record.NewFakeRecorder(100))
+
+	// Another VA of the same volume is being attached.
+	operations.start(testVolumeHandle, "other-node", "other-va")
+	handler.SyncNewOrUpdatedVolumeAttachment(vaObj)
+	if csiConnection.index != 0 {
+		t.Errorf("expected no CSI call while another operation is pending, got %d", csiConnection.index)
+	}
+	if queue.NumRequeues(vaObj.Name) != 0 || queue.Len() != 0 {
+		t.Errorf("expected VA not to be re-queued with backoff, got %d requeues", queue.NumRequeues(vaObj.Name))
+	}
+
+	// Finished operation re-queues the waiting VA.
+	handler.(*csiHandler).finishOperation(testVolumeHandle, "other-node")
+	if queue.Len() != 1 {
+		t.Errorf("expected the waiting VA to be re-queued, got queue length %d", queue.Len())
+	}
+
+	csiConnection.calls = []csiCall{{"detach", testVolumeHandle, testNodeID, nil, nil, false, nil, false, nil, 0}}
+	handler.SyncNewOrUpdatedVolumeAttachment(vaObj)
+	if csiConnection.index != 1 {
+		t.Errorf("expected 1 CSI call, got %d", csiConnection.index)
+	}
+}
+
+func TestCSIHandlerMissingDependency(t *testing.T) {
+	tests := []struct {
+		name               string
+		pv                 *v1.PersistentVolume
+		csiNode            *storage.CSINode
+		expectedDependency string
+	}{
+		{
+			name:               "missing PV",
+			csiNode:            csiNode(),
+			expectedDependency: pvDependency(testPVName),
+		},
+		{
+			name:               "missing secret",
+			pv:                 pvWithSecret(pvWithFinalizer(), "secret"),
+			csiNode:            csiNode(),
+			expectedDependency: secretDependency("default", "secret"),
+		},
+		{
+			name:               "missing CSINode",
+			pv:                 pvWithFinalizer(),
+			expectedDependency: csiNodeDependency(testNodeName),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vaObj := va(false, "", nil)
+			client := fake.NewSimpleClientset(vaObj)
+			informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+			if test.pv != nil {
+				informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(test.pv)
+			}
+			if test.csiNode != nil {
+				informerFactory.Storage().V1().CSINodes().Informer().GetStore().Add(test.csiNode)
+			}
+			lister := &fakeLister{t: t}
+			handler := csiHandlerFactory(client, informerFactory, &fakeCSIConnection{t: t, lister: lister}, lister)
+			queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+			defer queue.ShutDown()
+			handler.Init(queue, queue, record.NewFakeRecorder(100))
+
+			handler.SyncNewOrUpdatedVolumeAttachment(vaObj)
+			h := handler.(*csiHandler)
+			if vaNames := h.dependencyAvailable("CSINode/other-node"); len(vaNames) != 0 {
+				t.Errorf("expected no VA to wait for other CSINode, got %v", vaNames)
+			}
+			vaNames := h.dependencyAvailable(test.expectedDependency)
+			if len(vaNames) != 1 || vaNames[0] != vaObj.Name {
+				t.Errorf("expected VA %q to wait for %s, got %v", vaObj.Name, test.expectedDependency, vaNames)
+			}
+		})
+	}
+}
+
+func TestCSIHandlerSecretCache(t *testing.T) {
+	cachedSecret := secret()
+	uncachedSecret := secret()
+	uncachedSecret.Name = "uncached"
+	client := fake.NewSimpleClientset(uncachedSecret)
+	informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	secretInformer := informerFactory.Core().V1().Secrets()
+	secretInformer.Informer().GetStore().Add(cachedSecret)
+	opts := testCSIHandlerOptions(client, informerFactory, nil, nil)
+	opts.SecretCache = &SecretCache{
+		namespaces: map[string]*secretNamespace{
+			cachedSecret.Namespace: {refs: 1, lister: secretInformer.Lister()},
+		},
+	}
+	handler := NewCSIHandler(opts).(*csiHandler)
+
+	// Cache hit does not call the API server.
+	credentials, err := handler.getCredentialsFromPV(pvWithSecret(pv(), cachedSecret.Name).Spec.CSI)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if credentials["foo"] != "bar" {
+		t.Errorf("expected credentials from the cached secret, got %v", credentials)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("expected no API call for a cached secret, got %v", actions)
+	}
+
+	// Cache miss falls back to the API server.
+	credentials, err = handler.getCredentialsFromPV(pvWithSecret(pv(), uncachedSecret.Name).Spec.CSI)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if credentials["foo"] != "bar" {
+		t.Errorf("expected credentials from the API server, got %v", credentials)
+	}
+	if actions := client.Actions(); len(actions) != 1 || !actions[0].Matches("get", "secrets") {
+		t.Errorf("expected secret GET for an uncached secret, got %v", actions)
+	}
+}
+
+// countingTranslator counts translations of in-tree PVs.
+type countingTranslator struct {
+	AttacherCSITranslator
+	translations int
+}
+
+func (c *countingTranslator) TranslateInTreePVToCSI(pv *v1.PersistentVolume) (*v1.PersistentVolume, error) {
+	c.translations++
+	return c.AttacherCSITranslator.TranslateInTreePVToCSI(pv)
+}
+
+func TestCSIHandlerReconcileVAStats(t *testing.T) {
+	nID := map[string]string{
+		vaNodeIDAnnotation: testNodeID,
+	}
+	missingPVName := "missing"
+	drifted := va(true /*attached*/, fin, nID)
+	inSync := va(false /*attached*/, fin, nID)
+	inSync.Name = "in-sync"
+	waiting := va(false /*attached*/, "", nil)
+	waiting.Name = "waiting"
+	missingPV := va(true /*attached*/, fin, nID)
+	missingPV.Name = "missing-pv"
+	missingPV.Spec.Source.PersistentVolumeName = &missingPVName
+	otherDriver := createVolumeAttachment("other-driver", testPVName, testNodeName, true, "", nID)
+	otherDriver.Name = "other-driver"
+	gceNodeID := "projects/test-project/zones/testZone/instances/" + testNodeName
+	migrated := va(true /*attached*/, fin, map[string]string{vaNodeIDAnnotation: gceNodeID})
+	migrated.Name = "migrated"
+	migrated.ResourceVersion = "1"
+	migratedPVName := "migrated"
+	migrated.Spec.Source.PersistentVolumeName = &migratedPVName
+	migratedPV := gcePDPV()
+	migratedPV.Name = migratedPVName
+	migratedPV.ResourceVersion = "1"
+
+	client := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	vaInformer := informerFactory.Storage().V1().VolumeAttachments()
+	if err := AddVAIndexers(vaInformer.Informer()); err != nil {
+		t.Fatalf("Failed to add VolumeAttachment indexers: %s", err)
+	}
+	for _, obj := range []*storage.VolumeAttachment{drifted, inSync, waiting, missingPV, otherDriver, migrated} {
+		vaInformer.Informer().GetStore().Add(obj)
+	}
+	informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(pv())
+	informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(migratedPV)
+
+	// The migrated volume is published, the other one is not.
+	lister := &fakeLister{t: t, publishedNodes: map[string][]string{"projects/test-project/zones/testZone/disks/testpd": {gceNodeID}}}
+	translator := &countingTranslator{AttacherCSITranslator: csitranslator.New()}
+	opts := testCSIHandlerOptions(client, informerFactory, nil, lister)
+	opts.VAIndexer = vaInformer.Informer().GetIndexer()
+	opts.Translator = translator
+	handler := NewCSIHandler(opts).(*csiHandler)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	handler.Init(queue, queue, record.NewFakeRecorder(100))
+
+	expectedStats := reconcileStats{scanned: 5, skipped: 1, drifted: 1, errors: 1}
+	for cycle := 1; cycle <= 2; cycle++ {
+		stats, err := handler.reconcileVAs([]*storage.VolumeAttachment{drifted, inSync, waiting, missingPV, otherDriver, migrated})
+		if err != nil {
+			t.Fatalf("cycle %d: unexpected error: %s", cycle, err)
+		}
+		if stats != expectedStats {
+			t.Errorf("cycle %d: expected %+v, got %+v", cycle, expectedStats, stats)
+		}
+		// The migrated PV is translated only in the first cycle.
+		if translator.translations != 1 {
+			t.Errorf("cycle %d: expected 1 translation, got %d", cycle, translator.translations)
+		}
+	}
+	if queue.Len() != 1 {
+		t.Fatalf("expected 1 VA to be force synced, got %d", queue.Len())
+	}
+	if item, _ := queue.Get(); item != drifted.Name {
+		t.Errorf("expected VA %q to be force synced, got %v", drifted.Name, item)
+	}
+}
+
+func TestCSIHandlerVAFilter(t *testing.T) {
+	nID := map[string]string{
+		vaNodeIDAnnotation: testNodeID,
+	}
+	drifted := va(true /*attached*/, fin, nID)
+	waiting := va(false /*attached*/, "", nil)
+	waiting.Name = "waiting"
+
+	client := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	vaInformer := informerFactory.Storage().V1().VolumeAttachments()
+	if err := AddVAIndexers(vaInformer.Informer()); err != nil {
+		t.Fatalf("Failed to add VolumeAttachment indexers: %s", err)
+	}
+	vaInformer.Informer().GetStore().Add(drifted)
+	vaInformer.Informer().GetStore().Add(waiting)
+	informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(pvWithFinalizer())
+	informerFactory.Storage().V1().CSINodes().Informer().GetStore().Add(csiNode())
+
+	lister := &fakeLister{t: t}
+	csiConnection := &fakeCSIConnection{t: t, lister: lister}
+	opts := testCSIHandlerOptions(client, informerFactory, csiConnection, lister)
+	opts.VAIndexer = vaInformer.Informer().GetIndexer()
+	handler := NewCSIHandler(opts).(*csiHandler)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	handler.Init(queue, queue, record.NewFakeRecorder(100))
+	// All VolumeAttachments moved to another replica.
+	handler.setVAFilter(func(*storage.VolumeAttachment) bool { return false })
+
+	stats, err := handler.reconcileVAs([]*storage.VolumeAttachment{drifted, waiting})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if stats != (reconcileStats{}) {
+		t.Errorf("expected no VolumeAttachment to be reconciled, got %+v", stats)
+	}
+
+	handler.SyncNewOrUpdatedVolumeAttachment(waiting)
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("expected no API calls, got %v", actions)
+	}
+	if queue.Len() != 0 {
+		t.Errorf("expected no VolumeAttachment to be re-queued, got %d", queue.Len())
+	}
+}
+
 func TestCSIHandlerReconcileVA(t *testing.T) {
 	nID := map[string]string{
 		vaNodeIDAnnotation: testNodeID,
@@ -1419,6 +2126,10 @@ func TestCSIHandlerReconcileVA(t *testing.T) {
 				// Intentionally empty
 			},
 			expectedActions: []core.Action{
+				// The VA was attached without the detach record, it's added now.
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(true /*attached*/, fin, nID),
+						va(true /*attached*/, fin, ann))),
 				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
 					types.MergePatchType, patch(va(true /*attached*/, "", nil),
 						va(true, "", nil)), "status"),
@@ -1464,6 +2175,421 @@ func TestCSIHandlerReconcileVA(t *testing.T) {
 		},
 	}
 	runTests(t, csiHandlerFactory, tests)
+	// The same tests must pass when reconciling with ControllerGetVolume
+	runTests(t, csiHandlerFactoryGetVolume, tests)
+}
+
+func TestCSIHandlerReconcileVAListVolumesError(t *testing.T) {
+	nID := map[string]string{
+		vaNodeIDAnnotation: testNodeID,
+	}
+	tests := []struct {
+		name           string
+		va             *storage.VolumeAttachment
+		publishedNodes map[string][]string
+		expectRequeue  bool
+		expectedErrors int
+	}{
+		{
+			name:           "published volume is reconciled before the error",
+			va:             va(false /*attached*/, fin, nID),
+			publishedNodes: map[string][]string{testVolumeHandle: {testNodeID}},
+			expectRequeue:  true,
+			expectedErrors: 0,
+		},
+		{
+			name:           "volume not seen before the error is not reconciled",
+			va:             va(true /*attached*/, fin, nID),
+			publishedNodes: map[string][]string{},
+			expectRequeue:  false,
+			expectedErrors: 1,
+		},
+	}
+
+	for _, test := range tests {
+		pvObj := pvWithFinalizer()
+		client := fake.NewSimpleClientset(test.va, pvObj)
+		informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+		informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(pvObj)
+		informerFactory.Storage().V1().VolumeAttachments().Informer().GetStore().Add(test.va)
+
+		lister := &fakeLister{t: t, publishedNodes: test.publishedNodes, listErr: status.Error(codes.Unavailable, "mock error")}
+		handler := csiHandlerFactory(client, informerFactory, &fakeCSIConnection{t: t, lister: lister}, lister).(*csiHandler)
+		queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+		handler.Init(queue, queue, record.NewFakeRecorder(100))
+
+		stats, err := handler.reconcileVAs([]*storage.VolumeAttachment{test.va})
+		if err == nil {
+			t.Errorf("test %q: expected error, got none", test.name)
+		}
+		// Errors count VolumeAttachments whose actual state is unknown.
+		if stats.errors != test.expectedErrors {
+			t.Errorf("test %q: expected %d errors, got %d", test.name, test.expectedErrors, stats.errors)
+		}
+		if requeued := queue.Len() == 1; requeued != test.expectRequeue {
+			t.Errorf("test %q: expected requeue %v, got %v", test.name, test.expectRequeue, requeued)
+		}
+		queue.ShutDown()
+	}
+}
+
+func TestCSIHandlerReconcileVAWithGetVolume(t *testing.T) {
+	nID := map[string]string{
+		vaNodeIDAnnotation: testNodeID,
+	}
+	vaObj := va(true /*attached*/, fin, nID)
+	pvObj := pvWithFinalizer()
+	client := fake.NewSimpleClientset(vaObj, pvObj, csiNode())
+	informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(pvObj)
+	informerFactory.Storage().V1().VolumeAttachments().Informer().GetStore().Add(vaObj)
+
+	lister := &fakeLister{t: t, publishedNodes: map[string][]string{
+		testVolumeHandle: {testNodeID},
+		"foreign-volume": {"foreign-node"},
+	}}
+	handler := csiHandlerFactoryGetVolume(client, informerFactory, &fakeCSIConnection{t: t, lister: lister}, lister)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	handler.Init(queue, queue, record.NewFakeRecorder(100))
+
+	if err := handler.ReconcileVA(); err != nil {
+		t.Fatalf("ReconcileVA failed: %v", err)
+	}
+	if lister.listCalls != 0 {
+		t.Errorf("expected no ListVolumes calls, got %d", lister.listCalls)
+	}
+	if !reflect.DeepEqual(lister.getVolumeCalls, []string{testVolumeHandle}) {
+		t.Errorf("expected ControllerGetVolume only for %q, got %v", testVolumeHandle, lister.getVolumeCalls)
+	}
+	if queue.Len() != 0 {
+		t.Errorf("expected no VA to be re-queued, got %d", queue.Len())
+	}
+
+	// Failed ControllerGetVolume must not be treated as "not published"
+	lister.getVolumeErr = status.Error(codes.Unavailable, "mock error")
+	if err := handler.ReconcileVA(); err != nil {
+		t.Fatalf("ReconcileVA failed: %v", err)
+	}
+	if queue.Len() != 0 {
+		t.Errorf("expected no VA to be re-queued after ControllerGetVolume error, got %d", queue.Len())
+	}
+
+	// The volume is gone from the node
+	lister.getVolumeErr = nil
+	lister.Delete(testVolumeHandle, testNodeID)
+	if err := handler.ReconcileVA(); err != nil {
+		t.Fatalf("ReconcileVA failed: %v", err)
+	}
+	if queue.Len() != 1 {
+		t.Errorf("expected VA to be re-queued, got %d items in queue", queue.Len())
+	}
+}
+
+func TestCSIHandlerNodeSelector(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1",
+		Resource: "volumeattachments",
+	}
+	var noMetadata map[string]string
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var notDetached = false
+	var success error
+	var readWrite = false
+
+	withSelector := func(va *storage.VolumeAttachment) *storage.VolumeAttachment {
+		annotations := map[string]string{vaNodeSelectorAnnotation: "zone=a"}
+		for key, value := range va.Annotations {
+			annotations[key] = value
+		}
+		va.Annotations = annotations
+		return va
+	}
+	tests := []testCase{
+		{
+			name:           "attach records node selector",
+			initialObjects: []runtime.Object{pvWithFinalizer(), csiNode()},
+			addedVA:        va(false, fin, ann),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
+						withSelector(va(false /*attached*/, fin, ann)))),
+				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(withSelector(va(false /*attached*/, fin, ann)),
+						withSelector(va(true /*attached*/, fin, ann))), "status"),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+		},
+	}
+	runTests(t, csiHandlerFactoryWith(func(opts *CSIHandlerOptions) {
+		opts.NodeSelector = labels.SelectorFromSet(labels.Set{"zone": "a"})
+	}), tests)
+}
+
+func TestCSIHandlerUnhealthyNode(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1",
+		Resource: "volumeattachments",
+	}
+	var noMetadata map[string]string
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var notDetached = false
+	var success error
+	var readWrite = false
+
+	attachSuccess := testCase{
+		expectedActions: []core.Action{
+			core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+				types.MergePatchType, patch(va(false /*attached*/, fin, ann),
+					va(true /*attached*/, fin, ann)), "status"),
+		},
+		expectedCSICalls: []csiCall{
+			{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+		},
+	}
+	attachSkipped := func(message string) testCase {
+		return testCase{
+			expectedActions: []core.Action{
+				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
+						vaWithAttachError(va(false, fin, ann), message)), "status"),
+			},
+			expectedEvents: []string{"Warning FailedAttachVolume", "Warning FailedAttachVolume"},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		action   UnhealthyNodeAction
+		node     *v1.Node
+		expected testCase
+	}{
+		{
+			name:     "ready node -> success",
+			action:   UnhealthyNodeRefuse,
+			node:     nodeWithReady(v1.ConditionTrue),
+			expected: attachSuccess,
+		},
+		{
+			name:     "not ready node with allow policy -> success",
+			action:   UnhealthyNodeAllow,
+			node:     nodeWithReady(v1.ConditionFalse),
+			expected: attachSuccess,
+		},
+		{
+			name:     "node with unrelated taint -> success",
+			action:   UnhealthyNodeRefuse,
+			node:     nodeWithTaint(nodeWithReady(v1.ConditionTrue), "foo"),
+			expected: attachSuccess,
+		},
+		{
+			name:     "not ready node with refuse policy -> error",
+			action:   UnhealthyNodeRefuse,
+			node:     nodeWithReady(v1.ConditionUnknown),
+			expected: attachSkipped("refusing to attach to unhealthy node: node \"node1\" is not ready"),
+		},
+		{
+			name:     "tainted node with delay policy -> error",
+			action:   UnhealthyNodeDelay,
+			node:     nodeWithTaint(nodeWithReady(v1.ConditionTrue), testTaintKey),
+			expected: attachSkipped("delaying attach to unhealthy node: node \"node1\" has taint \"ToBeDeletedByClusterAutoscaler\""),
+		},
+		{
+			name:     "deleted node with refuse policy -> error",
+			action:   UnhealthyNodeRefuse,
+			node:     nodeDeleted(nodeWithReady(v1.ConditionTrue)),
+			expected: attachSkipped("refusing to attach to unhealthy node: node \"node1\" is being deleted"),
+		},
+		{
+			name:     "missing node with delay policy -> error",
+			action:   UnhealthyNodeDelay,
+			expected: attachSkipped("delaying attach to unhealthy node: node \"node1\" does not exist"),
+		},
+	}
+	for _, test := range tests {
+		tc := test.expected
+		tc.name = test.name
+		tc.initialObjects = []runtime.Object{pvWithFinalizer(), csiNode()}
+		if test.node != nil {
+			tc.initialObjects = append(tc.initialObjects, test.node)
+		}
+		tc.addedVA = va(false, fin, ann)
+		runTests(t, csiHandlerFactoryUnhealthyNode(test.action), []testCase{tc})
+	}
+}
+
+func TestCSIHandlerForceDetach(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1",
+		Resource: "volumeattachments",
+	}
+	secretGroupResourceVersion := schema.GroupVersionResource{
+		Group:    v1.GroupName,
+		Version:  "v1",
+		Resource: "secrets",
+	}
+	var noMetadata map[string]string
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var success error
+	var readWrite = false
+	var ignored = false
+
+	// deleted() VAs are deleted long ago, the grace period has expired.
+	deletedNow := func(va *storage.VolumeAttachment) *storage.VolumeAttachment {
+		va.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+		return va
+	}
+	forceDetached := []core.Action{
+		core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+			types.MergePatchType, patch(deleted(va(true, "", ann)),
+				deleted(va(false, "", ann))), "status"),
+		core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+			types.MergePatchType, patch(deleted(va(false, fin, ann)),
+				deleted(va(false, "", ann)))),
+	}
+	detachedAfterRetry := []core.Action{
+		core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone,
+			testPVName+"-"+testNodeName,
+			types.MergePatchType, patch(deleted(va(true, "", ann)),
+				deleted(vaWithDetachError(va(true, "", ann), "mock error"))), "status"),
+		core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+			types.MergePatchType, patch(deleted(va(true, "", ann)),
+				deleted(va(false, "", ann))), "status"),
+		core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+			types.MergePatchType, patch(deleted(va(false, fin, ann)),
+				deleted(va(false, "", ann)))),
+	}
+
+	tests := []testCase{
+		{
+			name:            "out-of-service node, grace period expired, detach fails -> force detach",
+			initialObjects:  []runtime.Object{pvWithFinalizer(), csiNode(), nodeWithTaint(node(), taintNodeOutOfService)},
+			addedVA:         deleted(va(true, fin, ann)),
+			expectedActions: forceDetached,
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, fmt.Errorf("mock error"), ignored, noMetadata, 0},
+			},
+			expectedEvents: []string{"Warning ForceDetachedVolume", "Warning ForceDetachedVolume"},
+		},
+		{
+			name:            "deleted node, grace period expired, detach fails -> force detach",
+			initialObjects:  []runtime.Object{pvWithFinalizer(), csiNode()},
+			addedVA:         deleted(va(true, fin, ann)),
+			expectedActions: forceDetached,
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, fmt.Errorf("mock error"), ignored, noMetadata, 0},
+			},
+			expectedEvents: []string{"Warning ForceDetachedVolume", "Warning ForceDetachedVolume"},
+		},
+		{
+			name:           "deleted node, grace period expired, missing secret -> error, no force detach",
+			initialObjects: []runtime.Object{pvWithSecret(pvWithFinalizer(), "unknownSecret"), csiNode()},
+			addedVA:        deleted(va(true, fin, ann)),
+			expectedActions: []core.Action{
+				core.NewGetAction(secretGroupResourceVersion, "default", "unknownSecret"),
+				core.NewPatchSubresourceAction(vaGroupResourceVersion, metav1.NamespaceNone,
+					testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(deleted(va(true, fin, ann)),
+						deleted(vaWithDetachError(va(true, fin, ann),
+							"failed to load secret \"default/unknownSecret\": secrets \"unknownSecret\" not found"))), "status"),
+			},
+			expectedCSICalls: []csiCall{},
+		},
+		{
+			name:            "out-of-service node, grace period not expired, detach fails -> controller retries",
+			initialObjects:  []runtime.Object{pvWithFinalizer(), csiNode(), nodeWithTaint(node(), taintNodeOutOfService)},
+			addedVA:         deletedNow(va(true, fin, ann)),
+			expectedActions: detachedAfterRetry,
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, fmt.Errorf("mock error"), ignored, noMetadata, 0},
+				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, ignored, noMetadata, 0},
+			},
+		},
+		{
+			name:            "healthy node, detach fails -> controller retries",
+			initialObjects:  []runtime.Object{pvWithFinalizer(), csiNode(), node()},
+			addedVA:         deleted(va(true, fin, ann)),
+			expectedActions: detachedAfterRetry,
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, fmt.Errorf("mock error"), ignored, noMetadata, 0},
+				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, ignored, noMetadata, 0},
+			},
+		},
+	}
+	runTests(t, csiHandlerFactoryForceDetach, tests)
+}
+
+func TestCSIHandlerForceDetachWaitsForNodeCache(t *testing.T) {
+	client := fake.NewSimpleClientset(pvWithFinalizer(), node(), deleted(va(true, fin, ann)))
+	informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	// Nodes are watched by a separate factory, so the test can start the
+	// Node informer later than the others.
+	nodeFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	vaInformer := informerFactory.Storage().V1().VolumeAttachments()
+	if err := AddVAIndexers(vaInformer.Informer()); err != nil {
+		t.Fatalf("Failed to add VolumeAttachment indexers: %s", err)
+	}
+	lister := &fakeLister{t: t}
+	csiConnection := &fakeCSIConnection{t: t, lister: lister, calls: []csiCall{
+		{"detach", testVolumeHandle, testNodeID, nil, nil, false, fmt.Errorf("mock error"), false, nil, 0},
+	}}
+	opts := testCSIHandlerOptions(client, informerFactory, csiConnection, lister)
+	opts.NodeLister = nodeFactory.Core().V1().Nodes().Lister()
+	opts.ForceDetachGracePeriod = time.Minute
+	handler := NewCSIHandler(opts)
+	// Long backoff, the failed detach is not retried during the test.
+	rateLimiter := workqueue.NewItemExponentialFailureRateLimiter(time.Hour, time.Hour)
+	ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, informerFactory.Core().V1().PersistentVolumes(), nodeFactory.Core().V1().Nodes(), nil, nil, nil, rateLimiter, rateLimiter, false, time.Minute, 0)
+	recorder := record.NewFakeRecorder(100)
+	ctrl.eventRecorder = recorder
+	handler.Init(ctrl.vaQueue, ctrl.pvQueue, recorder)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informerFactory.Start(stopCh)
+	go ctrl.Run(1, stopCh)
+
+	// The node of the VolumeAttachment exists, but it's not in the Node
+	// cache yet. The VolumeAttachment must not be processed, its node would
+	// look deleted.
+	time.Sleep(100 * time.Millisecond)
+	for _, action := range client.Actions() {
+		if action.Matches("patch", "volumeattachments") {
+			t.Errorf("expected no VolumeAttachment processed before the Node cache has synced, got %+v", action)
+		}
+	}
+
+	nodeFactory.Start(stopCh)
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		for _, action := range client.Actions() {
+			if action.Matches("patch", "volumeattachments") && action.GetSubresource() == "status" {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatalf("expected detach error to be saved: %s", err)
+	}
+	for _, action := range client.Actions() {
+		if action.Matches("patch", "volumeattachments") && action.GetSubresource() == "" {
+			t.Errorf("expected VolumeAttachment of an existing node not to be force detached, got %+v", action)
+		}
+	}
+	close(recorder.Events)
+	for event := range recorder.Events {
+		if strings.Contains(event, "ForceDetachedVolume") {
+			t.Errorf("expected no force detach, got event %q", event)
+		}
+	}
 }
 
 func TestCSIHandlerReadOnly(t *testing.T) {
@@ -1538,3 +2664,99 @@ func TestMarkAsMigrated(t *testing.T) {
 		}
 	})
 }
+
+func TestCSIHandlerReconcileVAVolumeCondition(t *testing.T) {
+	nID := map[string]string{
+		vaNodeIDAnnotation: testNodeID,
+	}
+	vaObj := va(true /*attached*/, fin, nID)
+	pvObj := pvWithFinalizer()
+	client := fake.NewSimpleClientset(vaObj, pvObj)
+	informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(pvObj)
+	vaStore := informerFactory.Storage().V1().VolumeAttachments().Informer().GetStore()
+	vaStore.Add(vaObj)
+
+	registry := k8smetrics.NewKubeRegistry()
+	RegisterMetrics(registry)
+	lister := &fakeLister{
+		t:              t,
+		publishedNodes: map[string][]string{testVolumeHandle: {testNodeID}},
+		conditions:     map[string]*csi.VolumeCondition{testVolumeHandle: {Abnormal: true, Message: "mock failure"}},
+	}
+	handler := csiHandlerFactoryVolumeCondition(client, informerFactory, &fakeCSIConnection{t: t, lister: lister}, lister)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	recorder := record.NewFakeRecorder(100)
+	handler.Init(queue, queue, recorder)
+
+	if err := handler.ReconcileVA(); err != nil {
+		t.Fatalf("ReconcileVA failed: %v", err)
+	}
+	savedVA, err := client.StorageV1().VolumeAttachments().Get(context.TODO(), vaObj.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get VA: %v", err)
+	}
+	if savedVA.Annotations[vaVolumeConditionAbnormalAnnotation] != "true" || savedVA.Annotations[vaVolumeConditionMessageAnnotation] != "mock failure" {
+		t.Errorf("unexpected VA annotations: %v", savedVA.Annotations)
+	}
+	// Event on the VA and on the PV
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-recorder.Events:
+			if !strings.HasPrefix(event, v1.EventTypeWarning+" "+eventReasonVolumeConditionAbnormal) {
+				t.Errorf("unexpected event: %q", event)
+			}
+		default:
+			t.Errorf("expected event %d, got none", i)
+		}
+	}
+	if value := volumeConditionMetric(t, registry, conditionAbnormal); value == nil || *value != 1 {
+		t.Errorf("expected 1 abnormal volume, got %v", value)
+	}
+	if value := volumeConditionMetric(t, registry, conditionNormal); value == nil || *value != 0 {
+		t.Errorf("expected 0 normal volumes, got %v", value)
+	}
+
+	// Unchanged condition is not saved again
+	vaStore.Update(savedVA)
+	client.ClearActions()
+	if err := handler.ReconcileVA(); err != nil {
+		t.Fatalf("ReconcileVA failed: %v", err)
+	}
+	if len(client.Actions()) != 0 {
+		t.Errorf("expected no API calls, got %+v", client.Actions())
+	}
+
+	// Deleted VA is not counted
+	vaStore.Delete(savedVA)
+	if err := handler.ReconcileVA(); err != nil {
+		t.Fatalf("ReconcileVA failed: %v", err)
+	}
+	if value := volumeConditionMetric(t, registry, conditionAbnormal); value == nil || *value != 0 {
+		t.Errorf("expected 0 abnormal volumes, got %v", value)
+	}
+}
+
+// volumeConditionMetric returns value of volume_conditions metric of the
+// given condition, or nil when it does not exist.
+func volumeConditionMetric(t *testing.T, registry k8smetrics.KubeRegistry, condition string) *float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "csi_attacher_volume_conditions" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == labelCondition && label.GetValue() == condition {
+					value := m.GetGauge().GetValue()
+					return &value
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// missingDependencyError is returned by csiAttach when an object needed for
+// the attach does not exist (yet).
+type missingDependencyError struct {
+	// dependency is key of the missing object, see *Dependency functions.
+	dependency string
+	err        error
+}
+
+func (e *missingDependencyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *missingDependencyError) Unwrap() error {
+	return e.err
+}
+
+func pvDependency(name string) string {
+	return "PersistentVolume/" + name
+}
+
+func csiNodeDependency(name string) string {
+	return "CSINode/" + name
+}
+
+func secretDependency(namespace, name string) string {
+	return "Secret/" + namespace + "/" + name
+}
+
+// dependencyTracker remembers VolumeAttachments that failed to attach because
+// of a missing object, so they can be re-queued as soon as the object is
+// created, instead of waiting for exponential backoff.
+type dependencyTracker struct {
+	mux sync.Mutex
+	// waiting maps dependencies to VolumeAttachments waiting for them.
+	waiting map[string]sets.String
+	// dependencies maps VolumeAttachments to the dependency they wait for.
+	dependencies map[string]string
+}
+
+func newDependencyTracker() *dependencyTracker {
+	return &dependencyTracker{
+		waiting:      map[string]sets.String{},
+		dependencies: map[string]string{},
+	}
+}
+
+// wait records that the VolumeAttachment waits for the dependency. A
+// VolumeAttachment waits for at most one dependency, the one that failed
+// its last attach.
+func (t *dependencyTracker) wait(vaName, dependency string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.forgetLocked(vaName)
+	if _, found := t.waiting[dependency]; !found {
+		t.waiting[dependency] = sets.NewString()
+	}
+	t.waiting[dependency].Insert(vaName)
+	t.dependencies[vaName] = dependency
+}
+
+// forget removes the VolumeAttachment from the tracker.
+func (t *dependencyTracker) forget(vaName string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.forgetLocked(vaName)
+}
+
+func (t *dependencyTracker) forgetLocked(vaName string) {
+	dependency, found := t.dependencies[vaName]
+	if !found {
+		return
+	}
+	delete(t.dependencies, vaName)
+	t.waiting[dependency].Delete(vaName)
+	if t.waiting[dependency].Len() == 0 {
+		delete(t.waiting, dependency)
+	}
+}
+
+// available removes and returns VolumeAttachments that waited for the
+// dependency.
+func (t *dependencyTracker) available(dependency string) []string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	waiting, found := t.waiting[dependency]
+	if !found {
+		return nil
+	}
+	delete(t.waiting, dependency)
+	for vaName := range waiting {
+		delete(t.dependencies, vaName)
+	}
+	return waiting.List()
+}
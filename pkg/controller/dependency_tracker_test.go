@@ -0,0 +1,49 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDependencyTracker(t *testing.T) {
+	tracker := newDependencyTracker()
+	tracker.wait("va1", pvDependency("pv1"))
+	tracker.wait("va2", pvDependency("pv1"))
+	tracker.wait("va3", secretDependency("ns", "secret"))
+	// va3 fails on another dependency in the next attach.
+	tracker.wait("va3", csiNodeDependency("node1"))
+	tracker.wait("va4", csiNodeDependency("node1"))
+	tracker.forget("va4")
+
+	if vaNames := tracker.available(secretDependency("ns", "secret")); len(vaNames) != 0 {
+		t.Errorf("expected no VA to wait for the secret, got %v", vaNames)
+	}
+	if vaNames := tracker.available(pvDependency("pv1")); !reflect.DeepEqual(vaNames, []string{"va1", "va2"}) {
+		t.Errorf("expected va1 and va2 to wait for the PV, got %v", vaNames)
+	}
+	if vaNames := tracker.available(pvDependency("pv1")); len(vaNames) != 0 {
+		t.Errorf("expected available VAs to be removed, got %v", vaNames)
+	}
+	if vaNames := tracker.available(csiNodeDependency("node1")); !reflect.DeepEqual(vaNames, []string{"va3"}) {
+		t.Errorf("expected va3 to wait for the CSINode, got %v", vaNames)
+	}
+	if len(tracker.waiting) != 0 || len(tracker.dependencies) != 0 {
+		t.Errorf("expected empty tracker, got %v and %v", tracker.waiting, tracker.dependencies)
+	}
+}
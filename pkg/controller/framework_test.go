@@ -37,6 +37,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
 	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 )
@@ -74,6 +75,9 @@ type testCase struct {
 	expectedCSICalls []csiCall
 	// Expected lister response
 	listerResponse map[string][]string
+	// List of expected events, "<type> <reason>" prefixes in the order
+	// they're emitted. Events are not checked when nil.
+	expectedEvents []string
 	// Function to perform additional checks after the test finishes
 	additionalCheck func(t *testing.T, test testCase)
 }
@@ -133,6 +137,9 @@ func runTests(t *testing.T, handlerFactory handlerFactory, tests []testCase) {
 		client := fake.NewSimpleClientset(coreObjs...)
 		informers := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
 		vaInformer := informers.Storage().V1().VolumeAttachments()
+		if err := AddVAIndexers(vaInformer.Informer()); err != nil {
+			t.Fatalf("Failed to add VolumeAttachment indexers: %s", err)
+		}
 		pvInformer := informers.Core().V1().PersistentVolumes()
 		nodeInformer := informers.Core().V1().Nodes()
 		csiNodeInformer := informers.Storage().V1().CSINodes()
@@ -177,10 +184,23 @@ func runTests(t *testing.T, handlerFactory handlerFactory, tests []testCase) {
 		}
 
 		// Construct controller
-		lister := &fakeLister{t: t, publishedNodes: test.listerResponse}
+		// The lister modifies its map, copy it so the test can be run again.
+		var publishedNodes map[string][]string
+		if test.listerResponse != nil {
+			publishedNodes = make(map[string][]string, len(test.listerResponse))
+			for k, v := range test.listerResponse {
+				publishedNodes[k] = v
+			}
+		}
+		lister := &fakeLister{t: t, publishedNodes: publishedNodes}
 		csiConnection := &fakeCSIConnection{t: t, calls: test.expectedCSICalls, lister: lister}
 		handler := handlerFactory(client, informers, csiConnection, lister)
-		ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter(), test.listerResponse != nil, 1*time.Minute)
+		ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, nil, nil, nil, nil, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter(), test.listerResponse != nil, 1*time.Minute, 0)
+		// Replace the event recorder with a fake one, events would otherwise
+		// show up as unexpected client actions.
+		recorder := record.NewFakeRecorder(1000)
+		ctrl.eventRecorder = recorder
+		handler.Init(ctrl.vaQueue, ctrl.pvQueue, recorder)
 
 		// Start the test by enqueueing the right event
 		if test.addedVA != nil {
@@ -197,6 +217,7 @@ func runTests(t *testing.T, handlerFactory handlerFactory, tests []testCase) {
 		}
 
 		// Process the queue until we get expected results
+		stopCh := make(chan struct{})
 		timeout := time.Now().Add(10 * time.Second)
 		lastReportedActionCount := 0
 		for {
@@ -206,11 +227,11 @@ func runTests(t *testing.T, handlerFactory handlerFactory, tests []testCase) {
 			}
 			if ctrl.vaQueue.Len() > 0 {
 				klog.V(5).Infof("Test %q: %d events in VA queue, processing one", test.name, ctrl.vaQueue.Len())
-				ctrl.syncVA()
+				ctrl.syncVA(stopCh)
 			}
 			if ctrl.pvQueue.Len() > 0 {
 				klog.V(5).Infof("Test %q: %d events in PV queue, processing one", test.name, ctrl.vaQueue.Len())
-				ctrl.syncPV()
+				ctrl.syncPV(stopCh)
 			}
 			if ctrl.vaQueue.Len() > 0 || ctrl.pvQueue.Len() > 0 {
 				// There is still some work in the queue, process it now
@@ -297,6 +318,10 @@ func runTests(t *testing.T, handlerFactory handlerFactory, tests []testCase) {
 			}
 		}
 
+		if test.expectedEvents != nil {
+			checkEvents(t, test, recorder)
+		}
+
 		if test.additionalCheck != nil {
 			test.additionalCheck(t, test)
 		}
@@ -311,6 +336,26 @@ func runTests(t *testing.T, handlerFactory handlerFactory, tests []testCase) {
 	}
 }
 
+func checkEvents(t *testing.T, test testCase, recorder *record.FakeRecorder) {
+	events := []string{}
+	close(recorder.Events)
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	for i, event := range events {
+		if len(test.expectedEvents) < i+1 {
+			t.Errorf("Test %q: %d unexpected events: %+v", test.name, len(events)-len(test.expectedEvents), events[i:])
+			break
+		}
+		if !strings.HasPrefix(event, test.expectedEvents[i]) {
+			t.Errorf("Test %q: event %d\nExpected:\n%s\ngot:\n%s", test.name, i, test.expectedEvents[i], event)
+		}
+	}
+	if len(test.expectedEvents) > len(events) {
+		t.Errorf("Test %q: %d additional expected events: %+v", test.name, len(test.expectedEvents)-len(events), test.expectedEvents[len(events):])
+	}
+}
+
 // Helper function to create various objects
 const (
 	testAttacherName = "csi/test"
@@ -404,10 +449,37 @@ func vaWithDetachError(va *storage.VolumeAttachment, message string) *storage.Vo
 type fakeLister struct {
 	t              *testing.T
 	publishedNodes map[string][]string
+	conditions     map[string]*csi.VolumeCondition
+	listErr        error
+	getVolumeErr   error
+	listCalls      int
+	getVolumeCalls []string
+}
+
+// ListVolumes returns each volume on a separate page. listErr is returned
+// after the last page.
+func (l *fakeLister) ListVolumes(ctx context.Context, processPage func(page map[string]attacher.VolumeStatus)) error {
+	l.listCalls++
+	for volumeHandle := range l.publishedNodes {
+		processPage(map[string]attacher.VolumeStatus{volumeHandle: l.volumeStatus(volumeHandle)})
+	}
+	return l.listErr
 }
 
-func (l *fakeLister) ListVolumes(ctx context.Context) (map[string][]string, error) {
-	return l.publishedNodes, nil
+func (l *fakeLister) GetVolumeStatus(ctx context.Context, volumeHandle string) (*attacher.VolumeStatus, error) {
+	l.getVolumeCalls = append(l.getVolumeCalls, volumeHandle)
+	if l.getVolumeErr != nil {
+		return nil, l.getVolumeErr
+	}
+	status := l.volumeStatus(volumeHandle)
+	return &status, nil
+}
+
+func (l *fakeLister) volumeStatus(volumeHandle string) attacher.VolumeStatus {
+	return attacher.VolumeStatus{
+		PublishedNodeIDs: l.publishedNodes[volumeHandle],
+		Condition:        l.conditions[volumeHandle],
+	}
 }
 
 func (l *fakeLister) Add(volumeHandle string, nodeID string) {
@@ -452,10 +524,11 @@ func (f *fakeCSIConnection) Attach(ctx context.Context, volumeID string, readOnl
 	call := f.calls[f.index]
 	f.index++
 
-	// If caller has set long delay, return when deadline expires
+	// If caller has set long delay, return when deadline expires. Timeout is
+	// not a final error, the volume may be still attaching.
 	select {
 	case <-ctx.Done():
-		return nil, true, ctx.Err()
+		return nil, false, ctx.Err()
 	case <-time.After(call.delay):
 		break
 	}
@@ -0,0 +1,85 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+)
+
+// inFlightTracker counts running syncs, so the controller can wait for them
+// during shutdown.
+type inFlightTracker struct {
+	mux      sync.Mutex
+	count    int
+	draining bool
+	// drained is closed when draining and no sync is running.
+	drained chan struct{}
+}
+
+func newInFlightTracker() *inFlightTracker {
+	return &inFlightTracker{
+		drained: make(chan struct{}),
+	}
+}
+
+// start marks a sync as running. It returns false when the tracker is
+// draining and no new sync may start.
+func (t *inFlightTracker) start() bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.draining {
+		return false
+	}
+	t.count++
+	return true
+}
+
+// finish marks a sync started by start as finished.
+func (t *inFlightTracker) finish() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.count--
+	if t.draining && t.count == 0 {
+		close(t.drained)
+	}
+}
+
+// drain prevents new syncs from starting and waits until the running ones
+// finish, at most for the given timeout. It returns the number of syncs that
+// did not finish in time.
+func (t *inFlightTracker) drain(timeout time.Duration) int {
+	t.mux.Lock()
+	if !t.draining {
+		t.draining = true
+		if t.count == 0 {
+			close(t.drained)
+		}
+	}
+	t.mux.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.drained:
+	case <-timer.C:
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.count
+}
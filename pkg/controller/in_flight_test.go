@@ -0,0 +1,57 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInFlightTracker(t *testing.T) {
+	tracker := newInFlightTracker()
+	if !tracker.start() || !tracker.start() {
+		t.Fatalf("expected syncs to start before drain")
+	}
+
+	// A sync that finishes within the grace period is waited for.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		tracker.finish()
+	}()
+	if pending := tracker.drain(50 * time.Millisecond); pending != 1 {
+		t.Errorf("expected 1 sync not to finish in time, got %d", pending)
+	}
+	if tracker.start() {
+		t.Errorf("expected no sync to start while draining")
+	}
+
+	tracker.finish()
+	if pending := tracker.drain(time.Second); pending != 0 {
+		t.Errorf("expected all syncs to finish, got %d pending", pending)
+	}
+}
+
+func TestInFlightTrackerIdle(t *testing.T) {
+	tracker := newInFlightTracker()
+	start := time.Now()
+	if pending := tracker.drain(time.Minute); pending != 0 {
+		t.Errorf("expected no pending syncs, got %d", pending)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected drain of an idle tracker to return immediately, took %s", elapsed)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"k8s.io/component-base/metrics"
+)
+
+const (
+	metricsSubsystem = "csi_attacher"
+
+	labelDriverName = "driver_name"
+	labelCondition  = "condition"
+	labelResult     = "result"
+
+	labelType = "type"
+
+	conditionNormal   = "normal"
+	conditionAbnormal = "abnormal"
+
+	secretCacheHit  = "hit"
+	secretCacheMiss = "miss"
+
+	reconcileScanned = "scanned"
+	reconcileSkipped = "skipped"
+	reconcileDrifted = "drifted"
+	reconcileErrors  = "errors"
+)
+
+var (
+	// volumeConditions is the number of attached volumes that the CSI
+	// driver reported as normal and abnormal in the last ReconcileVA cycle.
+	volumeConditions = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "volume_conditions",
+			Help:           "Number of attached volumes in each condition (normal or abnormal) reported by the CSI driver in the last reconciliation.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{labelDriverName, labelCondition},
+	)
+
+	// secretCacheRequests counts ControllerPublishSecretRef secrets found
+	// in the Secret informer cache ("hit") and secrets read from the API
+	// server ("miss").
+	secretCacheRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "secret_cache_requests_total",
+			Help:           "Number of ControllerPublishSecretRef secrets read from the Secret cache (result=hit) or from the API server (result=miss).",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{labelDriverName, labelResult},
+	)
+
+	// reconcileVolumeAttachments are statistics of the last ReconcileVA
+	// cycle.
+	reconcileVolumeAttachments = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "reconcile_volume_attachments",
+			Help:           "Number of VolumeAttachments in the last reconciliation with the CSI driver: scanned, skipped because they were not attached yet, drifted from the actual state and failed with an error.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{labelDriverName, labelType},
+	)
+)
+
+// RegisterMetrics registers metrics of the external-attacher controllers to
+// the given registry, usually the one of the CSI metrics manager.
+func RegisterMetrics(registry metrics.KubeRegistry) {
+	registry.MustRegister(volumeConditions)
+	registry.MustRegister(secretCacheRequests)
+	registry.MustRegister(reconcileVolumeAttachments)
+	registerWorkqueueMetrics(registry)
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// taintNodeOutOfService is v1.TaintNodeOutOfService, which is not available
+// in k8s.io/api used by the external-attacher yet.
+const taintNodeOutOfService = "node.kubernetes.io/out-of-service"
+
+// UnhealthyNodeAction is what the attacher does with VolumeAttachments of
+// nodes that are NotReady, being deleted or tainted.
+type UnhealthyNodeAction string
+
+const (
+	// UnhealthyNodeAllow attaches volumes to unhealthy nodes.
+	UnhealthyNodeAllow UnhealthyNodeAction = "allow"
+	// UnhealthyNodeDelay saves an attach error and re-tries the attach with
+	// exponential backoff, until the node is healthy.
+	UnhealthyNodeDelay UnhealthyNodeAction = "delay"
+	// UnhealthyNodeRefuse saves an attach error and does not re-try the
+	// attach until the node or the VolumeAttachment changes.
+	UnhealthyNodeRefuse UnhealthyNodeAction = "refuse"
+)
+
+// ParseUnhealthyNodeAction parses UnhealthyNodeAction from a command line
+// option.
+func ParseUnhealthyNodeAction(action string) (UnhealthyNodeAction, error) {
+	switch a := UnhealthyNodeAction(action); a {
+	case UnhealthyNodeAllow, UnhealthyNodeDelay, UnhealthyNodeRefuse:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown unhealthy node policy %q, expected one of %q, %q or %q", action, UnhealthyNodeAllow, UnhealthyNodeDelay, UnhealthyNodeRefuse)
+}
+
+// UnhealthyNodePolicy configures attaching of volumes to unhealthy nodes.
+type UnhealthyNodePolicy struct {
+	Action UnhealthyNodeAction
+	// TaintKeys are keys of taints that make a node unhealthy, regardless
+	// of their value and effect.
+	TaintKeys []string
+}
+
+// getUnhealthyNodeReason returns why the node is unhealthy, or an empty string
+// when it is healthy.
+func getUnhealthyNodeReason(node *v1.Node, taintKeys sets.String) string {
+	if node.DeletionTimestamp != nil {
+		return fmt.Sprintf("node %q is being deleted", node.Name)
+	}
+	for _, taint := range node.Spec.Taints {
+		if taintKeys.Has(taint.Key) {
+			return fmt.Sprintf("node %q has taint %q", node.Name, taint.Key)
+		}
+	}
+	if !isNodeReady(node) {
+		return fmt.Sprintf("node %q is not ready", node.Name)
+	}
+	return ""
+}
+
+func hasTaint(node *v1.Node, key string) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func isNodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// nodeHealthChanged returns true when the node changed in a way that can
+// change result of getUnhealthyNodeReason. Periodic node status updates are
+// ignored.
+func nodeHealthChanged(oldNode, newNode *v1.Node) bool {
+	if (oldNode.DeletionTimestamp == nil) != (newNode.DeletionTimestamp == nil) {
+		return true
+	}
+	if isNodeReady(oldNode) != isNodeReady(newNode) {
+		return true
+	}
+	return !equality.Semantic.DeepEqual(oldNode.Spec.Taints, newNode.Spec.Taints)
+}
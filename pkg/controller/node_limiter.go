@@ -0,0 +1,153 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// nodeLimiter limits the number of VolumeAttachments of a single node that
+// are processed at the same time. VolumeAttachments over the limit are
+// remembered and returned when a slot of their node is released, so they
+// can be re-queued without any delay or backoff. Only as many of them are
+// returned as there are free slots, in the order they were deferred.
+type nodeLimiter struct {
+	// maxInFlight is the maximum number of VolumeAttachments processed per
+	// node. 0 means no limit.
+	maxInFlight int
+
+	mux      sync.Mutex
+	inFlight map[string]int
+	// waiting are deferred VolumeAttachments of each node, in the order
+	// they were deferred.
+	waiting map[string][]string
+	// woken are VolumeAttachments returned by release that have not
+	// called tryAcquire yet. Each of them has a free slot of its node.
+	woken map[string]sets.String
+}
+
+func newNodeLimiter(maxInFlight int) *nodeLimiter {
+	return &nodeLimiter{
+		maxInFlight: maxInFlight,
+		inFlight:    map[string]int{},
+		waiting:     map[string][]string{},
+		woken:       map[string]sets.String{},
+	}
+}
+
+// tryAcquire takes a slot of the given node for the VolumeAttachment. It
+// returns false when all slots of the node are taken, the VolumeAttachment is
+// then returned by release of the node.
+func (l *nodeLimiter) tryAcquire(nodeName, vaName string) bool {
+	if l.maxInFlight <= 0 {
+		return true
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.unwakeLocked(nodeName, vaName)
+	// Slots of woken VolumeAttachments are kept for them.
+	if l.inFlight[nodeName]+l.woken[nodeName].Len() >= l.maxInFlight {
+		for _, waiting := range l.waiting[nodeName] {
+			if waiting == vaName {
+				return false
+			}
+		}
+		l.waiting[nodeName] = append(l.waiting[nodeName], vaName)
+		return false
+	}
+	l.inFlight[nodeName]++
+	return true
+}
+
+// release frees a slot of the given node taken by tryAcquire and returns names
+// of VolumeAttachments that were deferred because the node was busy, as many
+// as there are free slots.
+func (l *nodeLimiter) release(nodeName string) []string {
+	if l.maxInFlight <= 0 {
+		return nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.inFlight[nodeName]--
+	if l.inFlight[nodeName] <= 0 {
+		delete(l.inFlight, nodeName)
+	}
+	return l.wakeLocked(nodeName)
+}
+
+// forget drops a VolumeAttachment that won't call tryAcquire, e.g. because
+// it was deleted. When it was returned by release, its slot is given to the
+// next deferred VolumeAttachment, which is returned.
+func (l *nodeLimiter) forget(vaName string) []string {
+	if l.maxInFlight <= 0 {
+		return nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for nodeName, waiting := range l.waiting {
+		for i := range waiting {
+			if waiting[i] == vaName {
+				l.setWaitingLocked(nodeName, append(waiting[:i:i], waiting[i+1:]...))
+				break
+			}
+		}
+	}
+	for nodeName, woken := range l.woken {
+		if woken.Has(vaName) {
+			l.unwakeLocked(nodeName, vaName)
+			return l.wakeLocked(nodeName)
+		}
+	}
+	return nil
+}
+
+// wakeLocked returns deferred VolumeAttachments of the node that get its free
+// slots.
+func (l *nodeLimiter) wakeLocked(nodeName string) []string {
+	free := l.maxInFlight - l.inFlight[nodeName] - l.woken[nodeName].Len()
+	waiting := l.waiting[nodeName]
+	if free <= 0 || len(waiting) == 0 {
+		return nil
+	}
+	if free > len(waiting) {
+		free = len(waiting)
+	}
+	woken := append([]string(nil), waiting[:free]...)
+	l.setWaitingLocked(nodeName, waiting[free:])
+	if _, found := l.woken[nodeName]; !found {
+		l.woken[nodeName] = sets.NewString()
+	}
+	l.woken[nodeName].Insert(woken...)
+	return woken
+}
+
+func (l *nodeLimiter) unwakeLocked(nodeName, vaName string) {
+	l.woken[nodeName].Delete(vaName)
+	if l.woken[nodeName].Len() == 0 {
+		delete(l.woken, nodeName)
+	}
+}
+
+func (l *nodeLimiter) setWaitingLocked(nodeName string, waiting []string) {
+	if len(waiting) == 0 {
+		delete(l.waiting, nodeName)
+		return
+	}
+	l.waiting[nodeName] = waiting
+}
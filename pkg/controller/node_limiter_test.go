@@ -0,0 +1,100 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNodeLimiter(t *testing.T) {
+	l := newNodeLimiter(2)
+
+	if !l.tryAcquire("node1", "va1") || !l.tryAcquire("node1", "va2") {
+		t.Fatalf("expected two VolumeAttachments of node1 to be accepted")
+	}
+	if l.tryAcquire("node1", "va3") {
+		t.Errorf("expected third VolumeAttachment of node1 to be deferred")
+	}
+	if !l.tryAcquire("node2", "va4") {
+		t.Errorf("expected VolumeAttachment of node2 to be accepted")
+	}
+
+	deferred := l.release("node1")
+	if !reflect.DeepEqual(deferred, []string{"va3"}) {
+		t.Errorf("expected va3 to be returned on release, got %v", deferred)
+	}
+	if deferred := l.release("node2"); len(deferred) != 0 {
+		t.Errorf("expected no deferred VolumeAttachments of node2, got %v", deferred)
+	}
+	if !l.tryAcquire("node1", "va3") {
+		t.Errorf("expected deferred VolumeAttachment to be accepted after release")
+	}
+}
+
+func TestNodeLimiterUnlimited(t *testing.T) {
+	l := newNodeLimiter(0)
+	for i := 0; i < 100; i++ {
+		if !l.tryAcquire("node1", "va") {
+			t.Fatalf("expected unlimited limiter to accept all VolumeAttachments")
+		}
+	}
+	if deferred := l.release("node1"); len(deferred) != 0 {
+		t.Errorf("expected no deferred VolumeAttachments, got %v", deferred)
+	}
+}
+
+func TestNodeLimiterWakesFreeSlots(t *testing.T) {
+	l := newNodeLimiter(1)
+
+	if !l.tryAcquire("node1", "va1") {
+		t.Fatalf("expected first VolumeAttachment of node1 to be accepted")
+	}
+	for _, va := range []string{"va2", "va3", "va4", "va3"} {
+		if l.tryAcquire("node1", va) {
+			t.Fatalf("expected %s to be deferred", va)
+		}
+	}
+
+	// One slot is free, only the first deferred VolumeAttachment is woken.
+	if woken := l.release("node1"); !reflect.DeepEqual(woken, []string{"va2"}) {
+		t.Errorf("expected va2 to be woken, got %v", woken)
+	}
+	// The slot is kept for va2.
+	if l.tryAcquire("node1", "va5") {
+		t.Errorf("expected va5 not to take the slot of woken va2")
+	}
+	// va2 won't use the slot, e.g. it was deleted.
+	if woken := l.forget("va2"); !reflect.DeepEqual(woken, []string{"va3"}) {
+		t.Errorf("expected va3 to be woken instead of forgotten va2, got %v", woken)
+	}
+	if !l.tryAcquire("node1", "va3") {
+		t.Fatalf("expected woken va3 to be accepted")
+	}
+	if woken := l.forget("va4"); len(woken) != 0 {
+		t.Errorf("expected forgotten waiting va4 not to wake anything, got %v", woken)
+	}
+	if woken := l.release("node1"); !reflect.DeepEqual(woken, []string{"va5"}) {
+		t.Errorf("expected va5 to be woken, got %v", woken)
+	}
+	if !l.tryAcquire("node1", "va5") {
+		t.Fatalf("expected woken va5 to be accepted")
+	}
+	if woken := l.release("node1"); len(woken) != 0 {
+		t.Errorf("expected no deferred VolumeAttachments, got %v", woken)
+	}
+}
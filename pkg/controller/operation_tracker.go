@@ -0,0 +1,90 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// errOperationPending is returned by csiAttach / csiDetach when another
+// ControllerPublish / ControllerUnpublish of the same volume is in progress.
+// The VolumeAttachment is re-queued when the other operation finishes.
+var errOperationPending = errors.New("another operation on the volume is in progress")
+
+// OperationTracker allows only one ControllerPublish / ControllerUnpublish
+// call per volume handle, or per volume handle and node, to run at the same
+// time. It should be shared by all handlers of a CSI driver.
+type OperationTracker struct {
+	// perNode allows operations of the same volume on different nodes to
+	// run at the same time.
+	perNode bool
+
+	mux     sync.Mutex
+	pending map[string]string
+	waiting map[string]sets.String
+}
+
+// NewOperationTracker returns a new OperationTracker. With perNode set, only
+// operations of the same volume on the same node are serialized.
+func NewOperationTracker(perNode bool) *OperationTracker {
+	return &OperationTracker{
+		perNode: perNode,
+		pending: map[string]string{},
+		waiting: map[string]sets.String{},
+	}
+}
+
+func (t *OperationTracker) operationKey(volumeHandle, nodeName string) string {
+	if t.perNode {
+		return volumeHandle + "/" + nodeName
+	}
+	return volumeHandle
+}
+
+// start marks an operation of the VolumeAttachment as pending. It returns
+// false when another VolumeAttachment has a pending operation with the same
+// key, the VolumeAttachment is then returned by finish of the other
+// operation.
+func (t *OperationTracker) start(volumeHandle, nodeName, vaName string) bool {
+	key := t.operationKey(volumeHandle, nodeName)
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if owner, found := t.pending[key]; found && owner != vaName {
+		if _, found := t.waiting[key]; !found {
+			t.waiting[key] = sets.NewString()
+		}
+		t.waiting[key].Insert(vaName)
+		return false
+	}
+	t.pending[key] = vaName
+	return true
+}
+
+// finish marks the operation started by start as finished and returns names
+// of VolumeAttachments that waited for it.
+func (t *OperationTracker) finish(volumeHandle, nodeName string) []string {
+	key := t.operationKey(volumeHandle, nodeName)
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	delete(t.pending, key)
+	waiting := t.waiting[key]
+	delete(t.waiting, key)
+	return waiting.List()
+}
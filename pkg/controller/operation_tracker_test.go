@@ -0,0 +1,72 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOperationTracker(t *testing.T) {
+	tests := []struct {
+		name            string
+		perNode         bool
+		expectOtherNode bool
+	}{
+		{
+			name:            "per volume",
+			perNode:         false,
+			expectOtherNode: false,
+		},
+		{
+			name:            "per volume and node",
+			perNode:         true,
+			expectOtherNode: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := NewOperationTracker(test.perNode)
+			if !tracker.start("vol1", "node1", "va1") {
+				t.Fatalf("expected first operation to start")
+			}
+			if !tracker.start("vol1", "node1", "va1") {
+				t.Errorf("expected the same VA to be allowed again")
+			}
+			if tracker.start("vol1", "node1", "va2") {
+				t.Errorf("expected second operation of the same volume and node to wait")
+			}
+			if started := tracker.start("vol1", "node2", "va3"); started != test.expectOtherNode {
+				t.Errorf("expected operation on another node to start: %v, got %v", test.expectOtherNode, started)
+			}
+			if !tracker.start("vol2", "node1", "va4") {
+				t.Errorf("expected operation of another volume to start")
+			}
+
+			expectedWaiting := []string{"va2", "va3"}
+			if test.perNode {
+				expectedWaiting = []string{"va2"}
+			}
+			if waiting := tracker.finish("vol1", "node1"); !reflect.DeepEqual(waiting, expectedWaiting) {
+				t.Errorf("expected waiting VAs %v, got %v", expectedWaiting, waiting)
+			}
+			if !tracker.start("vol1", "node1", "va2") {
+				t.Errorf("expected waiting operation to start after finish")
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// vaPriority is priority of a VolumeAttachment in the VA queue. Lower values
+// are processed first.
+type vaPriority int
+
+const (
+	// vaPriorityDetach is used for VolumeAttachments marked for deletion.
+	// Attaches of volumes moved to another node wait for them.
+	vaPriorityDetach vaPriority = iota
+	// vaPriorityForceSync is used for VolumeAttachments that ReconcileVA
+	// found out of sync with the CSI driver.
+	vaPriorityForceSync
+	// vaPriorityAttach is used for all other VolumeAttachments.
+	vaPriorityAttach
+
+	vaPriorityCount
+)
+
+// classifyFunc returns priority and node name of a queue item.
+type classifyFunc func(item interface{}) (vaPriority, string)
+
+// newVAQueue returns a rate limited VA queue that hands out items by their
+// priority. Items of the same priority are handed out round-robin per node,
+// so a node with many VolumeAttachments does not starve the others.
+func newVAQueue(rateLimiter workqueue.RateLimiter, name string, classify classifyFunc) workqueue.RateLimitingInterface {
+	return &rateLimitingQueue{
+		DelayingInterface: workqueue.NewDelayingQueueWithCustomQueue(newPriorityQueue(name, classify), name),
+		rateLimiter:       rateLimiter,
+	}
+}
+
+// rateLimitingQueue implements workqueue.RateLimitingInterface on top of any
+// delaying queue, client-go provides it only for its own FIFO queue.
+type rateLimitingQueue struct {
+	workqueue.DelayingInterface
+	rateLimiter workqueue.RateLimiter
+}
+
+var _ workqueue.RateLimitingInterface = &rateLimitingQueue{}
+
+func (q *rateLimitingQueue) AddRateLimited(item interface{}) {
+	q.DelayingInterface.AddAfter(item, q.rateLimiter.When(item))
+}
+
+func (q *rateLimitingQueue) NumRequeues(item interface{}) int {
+	return q.rateLimiter.NumRequeues(item)
+}
+
+func (q *rateLimitingQueue) Forget(item interface{}) {
+	q.rateLimiter.Forget(item)
+}
+
+// queuedItem is priority and node of an item in priorityQueue.
+type queuedItem struct {
+	priority vaPriority
+	node     string
+}
+
+// priorityQueue is a workqueue.Interface with the same guarantees as
+// workqueue.Type: an item is queued at most once and it's never processed by
+// two workers at the same time. An item added again while it's queued keeps
+// its place, unless its priority is raised.
+type priorityQueue struct {
+	classify classifyFunc
+
+	cond   *sync.Cond
+	levels [vaPriorityCount]*fairQueue
+	// queued are items waiting in levels.
+	queued map[interface{}]queuedItem
+	// processing are items handed out by Get and not marked as Done yet.
+	processing map[interface{}]bool
+	// dirty are items added while they were processed. They're queued
+	// again by Done.
+	dirty        map[interface{}]queuedItem
+	shuttingDown bool
+
+	// metrics are the standard workqueue metrics of the queue, nil when
+	// metrics are not registered.
+	metrics *queueMetrics
+	// stopCh stops updates of unfinished work metrics on shutdown.
+	stopCh chan struct{}
+}
+
+var _ workqueue.Interface = &priorityQueue{}
+
+// unfinishedWorkUpdatePeriod is how often the unfinished work metrics are
+// updated, the same as in client-go queues.
+const unfinishedWorkUpdatePeriod = 500 * time.Millisecond
+
+// newPriorityQueue returns a priority queue. Its workqueue metrics are
+// recorded under the given name when RegisterMetrics was called before.
+func newPriorityQueue(name string, classify classifyFunc) *priorityQueue {
+	q := &priorityQueue{
+		classify:   classify,
+		cond:       sync.NewCond(&sync.Mutex{}),
+		queued:     map[interface{}]queuedItem{},
+		processing: map[interface{}]bool{},
+		dirty:      map[interface{}]queuedItem{},
+		metrics:    newQueueMetrics(name),
+		stopCh:     make(chan struct{}),
+	}
+	for i := range q.levels {
+		q.levels[i] = newFairQueue()
+	}
+	if q.metrics != nil {
+		go q.updateUnfinishedWorkLoop()
+	}
+	return q
+}
+
+func (q *priorityQueue) updateUnfinishedWorkLoop() {
+	t := time.NewTicker(unfinishedWorkUpdatePeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			q.cond.L.Lock()
+			q.metrics.updateUnfinishedWork()
+			q.cond.L.Unlock()
+		case <-q.stopCh:
+			return
+		}
+	}
+}
+
+func (q *priorityQueue) Add(item interface{}) {
+	priority, node := q.classify(item)
+
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.shuttingDown {
+		return
+	}
+	if q.processing[item] {
+		dirty, found := q.dirty[item]
+		if !found {
+			q.metrics.add(item)
+		}
+		if !found || priority < dirty.priority {
+			q.dirty[item] = queuedItem{priority: priority, node: node}
+		}
+		return
+	}
+	if queued, found := q.queued[item]; found {
+		if priority >= queued.priority {
+			return
+		}
+		q.levels[queued.priority].remove(queued.node, item)
+	} else {
+		q.metrics.add(item)
+	}
+	q.push(item, queuedItem{priority: priority, node: node})
+}
+
+func (q *priorityQueue) push(item interface{}, queued queuedItem) {
+	q.queued[item] = queued
+	q.levels[queued.priority].push(queued.node, item)
+	q.cond.Signal()
+}
+
+func (q *priorityQueue) Len() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return len(q.queued)
+}
+
+func (q *priorityQueue) Get() (interface{}, bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for len(q.queued) == 0 && !q.shuttingDown {
+		q.cond.Wait()
+	}
+	if len(q.queued) == 0 {
+		// We must be shutting down.
+		return nil, true
+	}
+	for _, level := range q.levels {
+		if level.len() == 0 {
+			continue
+		}
+		item := level.pop()
+		delete(q.queued, item)
+		q.processing[item] = true
+		q.metrics.get(item)
+		return item, false
+	}
+	// Unreachable, queued and levels contain the same items.
+	return nil, true
+}
+
+func (q *priorityQueue) Done(item interface{}) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.metrics.done(item)
+	delete(q.processing, item)
+	if dirty, found := q.dirty[item]; found {
+		delete(q.dirty, item)
+		q.push(item, dirty)
+	}
+}
+
+func (q *priorityQueue) ShutDown() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if !q.shuttingDown {
+		close(q.stopCh)
+	}
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
+
+func (q *priorityQueue) ShuttingDown() bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.shuttingDown
+}
+
+// fairQueue is a FIFO queue per node. Nodes take turns in pop.
+type fairQueue struct {
+	// nodes with at least one item, in the order of their turns.
+	nodes []string
+	items map[string][]interface{}
+	count int
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{
+		items: map[string][]interface{}{},
+	}
+}
+
+func (f *fairQueue) len() int {
+	return f.count
+}
+
+func (f *fairQueue) push(node string, item interface{}) {
+	if len(f.items[node]) == 0 {
+		f.nodes = append(f.nodes, node)
+	}
+	f.items[node] = append(f.items[node], item)
+	f.count++
+}
+
+// pop returns the first item of the node whose turn it is. The caller must
+// check len first.
+func (f *fairQueue) pop() interface{} {
+	node := f.nodes[0]
+	f.nodes = f.nodes[1:]
+	items := f.items[node]
+	item := items[0]
+	if len(items) > 1 {
+		f.items[node] = items[1:]
+		f.nodes = append(f.nodes, node)
+	} else {
+		delete(f.items, node)
+	}
+	f.count--
+	return item
+}
+
+func (f *fairQueue) remove(node string, item interface{}) {
+	items := f.items[node]
+	for i := range items {
+		if items[i] != item {
+			continue
+		}
+		f.count--
+		if len(items) > 1 {
+			f.items[node] = append(items[:i:i], items[i+1:]...)
+			return
+		}
+		delete(f.items, node)
+		for j := range f.nodes {
+			if f.nodes[j] == node {
+				f.nodes = append(f.nodes[:j:j], f.nodes[j+1:]...)
+				break
+			}
+		}
+		return
+	}
+}
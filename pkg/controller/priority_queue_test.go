@@ -0,0 +1,250 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// testClassifier classifies items by a map, unknown items are attaches on
+// node "node".
+type testClassifier map[string]queuedItem
+
+func (c testClassifier) classify(item interface{}) (vaPriority, string) {
+	if q, found := c[item.(string)]; found {
+		return q.priority, q.node
+	}
+	return vaPriorityAttach, "node"
+}
+
+func getAll(t *testing.T, q *priorityQueue) []string {
+	var items []string
+	for q.Len() > 0 {
+		item, shutdown := q.Get()
+		if shutdown {
+			t.Fatalf("unexpected shutdown")
+		}
+		items = append(items, item.(string))
+		q.Done(item)
+	}
+	return items
+}
+
+func TestPriorityQueueOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		items    testClassifier
+		add      []string
+		expected []string
+	}{
+		{
+			name: "detach before force sync before attach",
+			items: testClassifier{
+				"attach":    {vaPriorityAttach, "node1"},
+				"forcesync": {vaPriorityForceSync, "node1"},
+				"detach":    {vaPriorityDetach, "node1"},
+			},
+			add:      []string{"attach", "forcesync", "detach"},
+			expected: []string{"detach", "forcesync", "attach"},
+		},
+		{
+			name: "nodes take turns",
+			items: testClassifier{
+				"a1": {vaPriorityAttach, "node1"},
+				"a2": {vaPriorityAttach, "node1"},
+				"a3": {vaPriorityAttach, "node1"},
+				"b1": {vaPriorityAttach, "node2"},
+				"c1": {vaPriorityAttach, "node3"},
+				"c2": {vaPriorityAttach, "node3"},
+			},
+			add:      []string{"a1", "a2", "a3", "b1", "c1", "c2"},
+			expected: []string{"a1", "b1", "c1", "a2", "c2", "a3"},
+		},
+		{
+			name: "duplicates are ignored",
+			items: testClassifier{
+				"a1": {vaPriorityAttach, "node1"},
+				"a2": {vaPriorityAttach, "node1"},
+			},
+			add:      []string{"a1", "a2", "a1"},
+			expected: []string{"a1", "a2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newPriorityQueue("", test.items.classify)
+			for _, item := range test.add {
+				q.Add(item)
+			}
+			if items := getAll(t, q); !reflect.DeepEqual(items, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, items)
+			}
+		})
+	}
+}
+
+func TestPriorityQueueRaisePriority(t *testing.T) {
+	items := testClassifier{}
+	q := newPriorityQueue("", items.classify)
+	q.Add("a1")
+	q.Add("a2")
+
+	// a2 is marked for deletion while it's queued.
+	items["a2"] = queuedItem{vaPriorityDetach, "node"}
+	q.Add("a2")
+	if q.Len() != 2 {
+		t.Errorf("expected 2 queued items, got %d", q.Len())
+	}
+	expected := []string{"a2", "a1"}
+	if got := getAll(t, q); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestPriorityQueueAddWhileProcessing(t *testing.T) {
+	q := newPriorityQueue("", testClassifier{}.classify)
+	q.Add("a1")
+	item, _ := q.Get()
+
+	// An item added while it's processed is not handed out to another worker.
+	q.Add("a1")
+	if q.Len() != 0 {
+		t.Errorf("expected no queued item while processing, got %d", q.Len())
+	}
+	q.Done(item)
+	if q.Len() != 1 {
+		t.Errorf("expected the item to be queued again after Done, got %d", q.Len())
+	}
+
+	q.ShutDown()
+	if !q.ShuttingDown() {
+		t.Errorf("expected the queue to shut down")
+	}
+	q.Add("a2")
+	if q.Len() != 1 {
+		t.Errorf("expected no new items after shutdown, got %d", q.Len())
+	}
+	// Queued items are still handed out after shutdown.
+	if item, shutdown := q.Get(); shutdown || item != "a1" {
+		t.Errorf("expected a1, got %v, shutdown %v", item, shutdown)
+	}
+	if _, shutdown := q.Get(); !shutdown {
+		t.Errorf("expected shutdown on empty queue")
+	}
+}
+
+// testMetric records values of all metrics of a queue.
+type testMetric struct {
+	value        float64
+	observations int
+}
+
+func (m *testMetric) Inc()              { m.value++ }
+func (m *testMetric) Dec()              { m.value-- }
+func (m *testMetric) Set(v float64)     { m.value = v }
+func (m *testMetric) Observe(v float64) { m.observations++ }
+
+// testMetricsProvider returns the same metrics for all queues.
+type testMetricsProvider struct {
+	depth, adds, latency, workDuration, unfinished, longest, retries testMetric
+}
+
+func (p *testMetricsProvider) NewDepthMetric(string) workqueue.GaugeMetric  { return &p.depth }
+func (p *testMetricsProvider) NewAddsMetric(string) workqueue.CounterMetric { return &p.adds }
+func (p *testMetricsProvider) NewLatencyMetric(string) workqueue.HistogramMetric {
+	return &p.latency
+}
+func (p *testMetricsProvider) NewWorkDurationMetric(string) workqueue.HistogramMetric {
+	return &p.workDuration
+}
+func (p *testMetricsProvider) NewUnfinishedWorkSecondsMetric(string) workqueue.SettableGaugeMetric {
+	return &p.unfinished
+}
+func (p *testMetricsProvider) NewLongestRunningProcessorSecondsMetric(string) workqueue.SettableGaugeMetric {
+	return &p.longest
+}
+func (p *testMetricsProvider) NewRetriesMetric(string) workqueue.CounterMetric { return &p.retries }
+
+// namedMetricsProvider returns separate metrics for each queue name.
+type namedMetricsProvider map[string]*testMetricsProvider
+
+func (p namedMetricsProvider) get(name string) *testMetricsProvider {
+	if _, found := p[name]; !found {
+		p[name] = &testMetricsProvider{}
+	}
+	return p[name]
+}
+
+func (p namedMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return p.get(name).NewDepthMetric(name)
+}
+func (p namedMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return p.get(name).NewAddsMetric(name)
+}
+func (p namedMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return p.get(name).NewLatencyMetric(name)
+}
+func (p namedMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return p.get(name).NewWorkDurationMetric(name)
+}
+func (p namedMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.get(name).NewUnfinishedWorkSecondsMetric(name)
+}
+func (p namedMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.get(name).NewLongestRunningProcessorSecondsMetric(name)
+}
+func (p namedMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return p.get(name).NewRetriesMetric(name)
+}
+
+func TestPriorityQueueMetrics(t *testing.T) {
+	provider := &testMetricsProvider{}
+	oldProvider := workqueueMetricsProvider
+	workqueueMetricsProvider = provider
+	defer func() { workqueueMetricsProvider = oldProvider }()
+
+	items := testClassifier{}
+	q := newPriorityQueue("test", items.classify)
+	defer q.ShutDown()
+	q.Add("a1")
+	q.Add("a2")
+	// Raising priority of a queued item is not a new add.
+	items["a2"] = queuedItem{vaPriorityDetach, "node"}
+	q.Add("a2")
+	if provider.depth.value != 2 || provider.adds.value != 2 {
+		t.Errorf("expected depth 2 and 2 adds, got depth %v and %v adds", provider.depth.value, provider.adds.value)
+	}
+
+	item, _ := q.Get()
+	// Added while processing, it's counted once until it's handed out again.
+	q.Add(item)
+	q.Add(item)
+	if provider.depth.value != 2 || provider.adds.value != 3 {
+		t.Errorf("expected depth 2 and 3 adds, got depth %v and %v adds", provider.depth.value, provider.adds.value)
+	}
+	q.Done(item)
+	getAll(t, q)
+	if provider.depth.value != 0 {
+		t.Errorf("expected depth 0, got %v", provider.depth.value)
+	}
+	if provider.latency.observations != 3 || provider.workDuration.observations != 3 {
+		t.Errorf("expected 3 latency and 3 work duration observations, got %d and %d", provider.latency.observations, provider.workDuration.observations)
+	}
+}
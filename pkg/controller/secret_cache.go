@@ -0,0 +1,223 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// SecretCache caches ControllerPublishSecretRef secrets of PersistentVolumes.
+// It watches Secrets only in namespaces referenced by ControllerPublishSecretRef
+// of at least one PersistentVolume, never in the whole cluster. A namespace is
+// watched by its own informer, which is started when the first PV refers to
+// the namespace and stopped when the last one is gone.
+type SecretCache struct {
+	client        kubernetes.Interface
+	resync        time.Duration
+	labelSelector string
+
+	mux sync.Mutex
+	// pvNamespaces maps PVs to the namespace of their secret.
+	pvNamespaces map[string]string
+	// namespaces are the watched namespaces.
+	namespaces map[string]*secretNamespace
+	handlers   []cache.ResourceEventHandler
+	// running is true between Run and its stopCh being closed. Informers
+	// are started only while running.
+	running bool
+}
+
+// secretNamespace is a namespace watched by SecretCache.
+type secretNamespace struct {
+	// refs is the number of PVs with a secret in the namespace.
+	refs int
+	// informer, lister and stopCh are nil when the informer is not running.
+	informer cache.SharedIndexInformer
+	lister   corelisters.SecretLister
+	stopCh   chan struct{}
+}
+
+// NewSecretCache returns a cache of secrets referenced by PVs from pvInformer.
+// Only Secrets that match labelSelector are cached, empty selector caches
+// all referenced Secrets. The cache must be started by Run.
+func NewSecretCache(client kubernetes.Interface, pvInformer coreinformers.PersistentVolumeInformer, resync time.Duration, labelSelector string) *SecretCache {
+	c := &SecretCache{
+		client:        client,
+		resync:        resync,
+		labelSelector: labelSelector,
+		pvNamespaces:  map[string]string{},
+		namespaces:    map[string]*secretNamespace{},
+	}
+	pvInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.pvAdded,
+		UpdateFunc: c.pvUpdated,
+		DeleteFunc: c.pvDeleted,
+	})
+	return c
+}
+
+// AddEventHandler adds a handler of Secret events of all watched namespaces.
+// It must be called before Run.
+func (c *SecretCache) AddEventHandler(handler cache.ResourceEventHandler) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.handlers = append(c.handlers, handler)
+}
+
+// Run starts informers of the referenced namespaces and blocks until stopCh
+// is closed.
+func (c *SecretCache) Run(stopCh <-chan struct{}) {
+	c.mux.Lock()
+	c.running = true
+	for namespace, ns := range c.namespaces {
+		c.startLocked(namespace, ns)
+	}
+	c.mux.Unlock()
+
+	<-stopCh
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.running = false
+	for _, ns := range c.namespaces {
+		c.stopLocked(ns)
+	}
+}
+
+// Get returns the secret from the cache. It returns false when the secret is
+// not cached, e.g. because its namespace is not watched yet or the informer
+// has not seen it.
+func (c *SecretCache) Get(namespace, name string) (*v1.Secret, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	ns, found := c.namespaces[namespace]
+	if !found || ns.lister == nil {
+		return nil, false
+	}
+	secret, err := ns.lister.Secrets(namespace).Get(name)
+	if err != nil {
+		return nil, false
+	}
+	return secret, true
+}
+
+func (c *SecretCache) pvAdded(obj interface{}) {
+	pv := obj.(*v1.PersistentVolume)
+	c.setPV(pv.Name, getSecretNamespace(pv))
+}
+
+func (c *SecretCache) pvUpdated(old, new interface{}) {
+	c.pvAdded(new)
+}
+
+func (c *SecretCache) pvDeleted(obj interface{}) {
+	if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok && unknown.Obj != nil {
+		obj = unknown.Obj
+	}
+	pv, ok := obj.(*v1.PersistentVolume)
+	if !ok {
+		return
+	}
+	c.setPV(pv.Name, "")
+}
+
+// setPV records namespace of the secret of the PV. Empty namespace means the
+// PV has no secret or it was deleted.
+func (c *SecretCache) setPV(pvName, namespace string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	old, found := c.pvNamespaces[pvName]
+	if found && old == namespace {
+		return
+	}
+	if found {
+		delete(c.pvNamespaces, pvName)
+		c.releaseLocked(old)
+	}
+	if namespace != "" {
+		c.pvNamespaces[pvName] = namespace
+		c.acquireLocked(namespace)
+	}
+}
+
+func (c *SecretCache) acquireLocked(namespace string) {
+	ns, found := c.namespaces[namespace]
+	if !found {
+		ns = &secretNamespace{}
+		c.namespaces[namespace] = ns
+	}
+	ns.refs++
+	if c.running && ns.informer == nil {
+		c.startLocked(namespace, ns)
+	}
+}
+
+func (c *SecretCache) releaseLocked(namespace string) {
+	ns, found := c.namespaces[namespace]
+	if !found {
+		return
+	}
+	ns.refs--
+	if ns.refs > 0 {
+		return
+	}
+	c.stopLocked(ns)
+	delete(c.namespaces, namespace)
+}
+
+func (c *SecretCache) startLocked(namespace string, ns *secretNamespace) {
+	klog.V(4).Infof("Watching Secrets in namespace %q", namespace)
+	ns.informer = coreinformers.NewFilteredSecretInformer(c.client, namespace, c.resync,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+		func(options *metav1.ListOptions) {
+			options.LabelSelector = c.labelSelector
+		})
+	for _, handler := range c.handlers {
+		ns.informer.AddEventHandler(handler)
+	}
+	ns.lister = corelisters.NewSecretLister(ns.informer.GetIndexer())
+	ns.stopCh = make(chan struct{})
+	go ns.informer.Run(ns.stopCh)
+}
+
+func (c *SecretCache) stopLocked(ns *secretNamespace) {
+	if ns.stopCh == nil {
+		return
+	}
+	close(ns.stopCh)
+	ns.informer = nil
+	ns.lister = nil
+	ns.stopCh = nil
+}
+
+// getSecretNamespace returns namespace of ControllerPublishSecretRef of the PV,
+// or an empty string when it has none.
+func getSecretNamespace(pv *v1.PersistentVolume) string {
+	if pv.Spec.CSI == nil || pv.Spec.CSI.ControllerPublishSecretRef == nil {
+		return ""
+	}
+	return pv.Spec.CSI.ControllerPublishSecretRef.Namespace
+}
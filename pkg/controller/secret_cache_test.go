@@ -0,0 +1,104 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestSecretCache() *SecretCache {
+	client := fake.NewSimpleClientset(secret())
+	informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+	return NewSecretCache(client, informerFactory.Core().V1().PersistentVolumes(), 0, "")
+}
+
+func (c *SecretCache) watchedNamespaces() sets.String {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	namespaces := sets.NewString()
+	for namespace := range c.namespaces {
+		namespaces.Insert(namespace)
+	}
+	return namespaces
+}
+
+func TestSecretCacheNamespaces(t *testing.T) {
+	c := newTestSecretCache()
+
+	c.pvAdded(pv())
+	if namespaces := c.watchedNamespaces(); namespaces.Len() != 0 {
+		t.Errorf("expected no namespace watched for PV without secret, got %v", namespaces.List())
+	}
+
+	pv1 := pvWithSecret(pv(), "secret")
+	pv2 := pvWithSecret(pv(), "secret")
+	pv2.Name = "pv2"
+	c.pvAdded(pv1)
+	c.pvAdded(pv2)
+	if namespaces := c.watchedNamespaces(); !namespaces.Equal(sets.NewString("default")) {
+		t.Errorf("expected namespace default to be watched, got %v", namespaces.List())
+	}
+
+	c.pvDeleted(pv1)
+	if namespaces := c.watchedNamespaces(); !namespaces.Equal(sets.NewString("default")) {
+		t.Errorf("expected namespace default to be watched while pv2 refers to it, got %v", namespaces.List())
+	}
+
+	moved := pv2.DeepCopy()
+	moved.Spec.CSI.ControllerPublishSecretRef.Namespace = "other"
+	c.pvUpdated(pv2, moved)
+	if namespaces := c.watchedNamespaces(); !namespaces.Equal(sets.NewString("other")) {
+		t.Errorf("expected only namespace other to be watched, got %v", namespaces.List())
+	}
+
+	c.pvDeleted(moved)
+	if namespaces := c.watchedNamespaces(); namespaces.Len() != 0 {
+		t.Errorf("expected no namespace watched after all PVs were deleted, got %v", namespaces.List())
+	}
+}
+
+func TestSecretCacheRun(t *testing.T) {
+	c := newTestSecretCache()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.Run(stopCh)
+
+	if _, found := c.Get("default", "secret"); found {
+		t.Errorf("expected secret in unreferenced namespace not to be cached")
+	}
+
+	pv := pvWithSecret(pv(), "secret")
+	c.pvAdded(pv)
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		_, found := c.Get("default", "secret")
+		return found, nil
+	})
+	if err != nil {
+		t.Fatalf("expected secret to be cached after a PV referred to it: %s", err)
+	}
+
+	c.pvDeleted(pv)
+	if _, found := c.Get("default", "secret"); found {
+		t.Errorf("expected secret not to be cached after the last PV was deleted")
+	}
+}
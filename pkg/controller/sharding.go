@@ -0,0 +1,148 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// Sharder decides which keys are processed by this replica of the attacher.
+type Sharder interface {
+	// Owns returns true when the key belongs to a shard owned by this
+	// replica.
+	Owns(key string) bool
+}
+
+// ShardKey is what VolumeAttachments are sharded by.
+type ShardKey string
+
+const (
+	// ShardByVolume shards VolumeAttachments by their volume handle. All
+	// attaches and detaches of a volume are processed by the same replica.
+	ShardByVolume ShardKey = "volume"
+	// ShardByNode shards VolumeAttachments by their node name. All
+	// attaches and detaches on a node are processed by the same replica.
+	ShardByNode ShardKey = "node"
+)
+
+// ParseShardKey parses ShardKey from a command line option.
+func ParseShardKey(key string) (ShardKey, error) {
+	switch k := ShardKey(key); k {
+	case ShardByVolume, ShardByNode:
+		return k, nil
+	}
+	return "", fmt.Errorf("unknown shard key %q, expected %q or %q", key, ShardByVolume, ShardByNode)
+}
+
+// SetSharding makes the controller process only VolumeAttachments and
+// PersistentVolumes in shards owned by the sharder. It must be called before
+// Run.
+func (ctrl *CSIAttachController) SetSharding(sharder Sharder, key ShardKey) {
+	ctrl.sharder = sharder
+	ctrl.shardKey = key
+}
+
+// ShardsChanged re-queues all VolumeAttachments of this attacher, so the ones
+// in newly acquired shards are processed. VolumeAttachments in shards owned
+// by another replica are skipped by syncVA.
+func (ctrl *CSIAttachController) ShardsChanged() {
+	vas, err := listVAsByIndex(ctrl.vaIndexer, vaAttacherIndex, ctrl.attacherName)
+	if err != nil {
+		klog.Errorf("Failed to list VolumeAttachments: %s", err)
+		return
+	}
+	for _, va := range vas {
+		if ctrl.shouldHandleVA(va) {
+			ctrl.vaQueue.Add(va.Name)
+		}
+	}
+	pvs, err := ctrl.pvLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list PersistentVolumes: %s", err)
+		return
+	}
+	for _, pv := range pvs {
+		if ctrl.processFinalizers(pv) && ctrl.shouldHandlePV(pv) {
+			ctrl.pvQueue.Add(pv.Name)
+		}
+	}
+}
+
+// ownsVA returns true when the VolumeAttachment is in a shard owned by this
+// replica.
+func (ctrl *CSIAttachController) ownsVA(va *storage.VolumeAttachment) bool {
+	if ctrl.sharder == nil {
+		return true
+	}
+	if ctrl.shardKey == ShardByNode {
+		return ctrl.sharder.Owns(va.Spec.NodeName)
+	}
+	return ctrl.sharder.Owns(ctrl.vaVolumeKey(va))
+}
+
+// ownsPV returns true when the PersistentVolume is in a shard owned by this
+// replica. PersistentVolumes are always sharded by their volume handle, their
+// finalizer does not depend on any node.
+func (ctrl *CSIAttachController) ownsPV(pv *v1.PersistentVolume) bool {
+	if ctrl.sharder == nil {
+		return true
+	}
+	return ctrl.sharder.Owns(ctrl.pvVolumeKey(pv))
+}
+
+// vaVolumeKey returns the volume handle of the VolumeAttachment. When the PV
+// is not available, the handle from the detach record is used, so the
+// detach is processed by the same replica as attaches of the volume. The PV
+// name is used as the last resort.
+func (ctrl *CSIAttachController) vaVolumeKey(va *storage.VolumeAttachment) string {
+	if va.Spec.Source.PersistentVolumeName != nil {
+		pv, err := ctrl.pvLister.Get(*va.Spec.Source.PersistentVolumeName)
+		if err == nil {
+			return ctrl.pvVolumeKey(pv)
+		}
+		if csiSource, _ := getDetachRecord(va); csiSource != nil {
+			return csiSource.VolumeHandle
+		}
+		return *va.Spec.Source.PersistentVolumeName
+	}
+	if spec := va.Spec.Source.InlineVolumeSpec; spec != nil && spec.CSI != nil {
+		return spec.CSI.VolumeHandle
+	}
+	return va.Name
+}
+
+// pvVolumeKey returns the CSI volume handle of the PV, translated from the
+// in-tree volume source for migrated PVs. The PV name is used when the PV
+// has no handle.
+func (ctrl *CSIAttachController) pvVolumeKey(pv *v1.PersistentVolume) string {
+	if ctrl.translator.IsPVMigratable(pv) {
+		translated, err := ctrl.translator.TranslateInTreePVToCSI(pv)
+		if err != nil {
+			return pv.Name
+		}
+		pv = translated
+	}
+	if pv.Spec.CSI == nil {
+		return pv.Name
+	}
+	return pv.Spec.CSI.VolumeHandle
+}
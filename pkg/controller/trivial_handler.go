@@ -20,6 +20,7 @@ import (
 	v1 "k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 )
@@ -31,6 +32,7 @@ import (
 type trivialHandler struct {
 	client           kubernetes.Interface
 	vaQueue, pvQueue workqueue.RateLimitingInterface
+	eventRecorder    record.EventRecorder
 }
 
 var _ Handler = &trivialHandler{}
@@ -40,9 +42,10 @@ func NewTrivialHandler(client kubernetes.Interface) Handler {
 	return &trivialHandler{client: client}
 }
 
-func (h *trivialHandler) Init(vaQueue workqueue.RateLimitingInterface, pvQueue workqueue.RateLimitingInterface) {
+func (h *trivialHandler) Init(vaQueue workqueue.RateLimitingInterface, pvQueue workqueue.RateLimitingInterface, eventRecorder record.EventRecorder) {
 	h.vaQueue = vaQueue
 	h.pvQueue = pvQueue
+	h.eventRecorder = eventRecorder
 }
 
 func (h *trivialHandler) ReconcileVA() error {
@@ -59,6 +62,7 @@ func (h *trivialHandler) SyncNewOrUpdatedVolumeAttachment(va *storage.VolumeAtta
 			return
 		}
 		klog.V(2).Infof("Marked VolumeAttachment %s as attached", va.Name)
+		recordVAEvent(h.eventRecorder, va, v1.EventTypeNormal, eventReasonAttached, "Volume attached to node %q", va.Spec.NodeName)
 	}
 	h.vaQueue.Forget(va.Name)
 }
@@ -54,6 +54,9 @@ func TestTrivialHandler(t *testing.T) {
 						va(false, "", nil),
 						va(true, "", nil)), "status"),
 			},
+			expectedEvents: []string{
+				"Normal SuccessfulAttachVolume", "Normal SuccessfulAttachVolume",
+			},
 		},
 		{
 			name:      "update -> successful write",
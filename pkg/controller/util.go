@@ -25,11 +25,13 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	jsonpatch "github.com/evanphx/json-patch"
+	"google.golang.org/grpc/status"
 	v1 "k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 )
 
@@ -110,8 +112,68 @@ const (
 	defaultFSType              = "ext4"
 	csiVolAttribsAnnotationKey = "csi.volume.kubernetes.io/volume-attributes"
 	vaNodeIDAnnotation         = "csi.alpha.kubernetes.io/node-id"
+
+	// What the volume was attached with, so it can be detached when its
+	// PV is gone. The secret reference is "<namespace>/<name>" and the
+	// migrated annotation is set only for migrated in-tree volumes.
+	vaVolumeHandleAnnotation     = "csi.alpha.kubernetes.io/volume-handle"
+	vaPublishSecretRefAnnotation = "csi.alpha.kubernetes.io/controller-publish-secret-ref"
+	vaMigratedAnnotation         = "csi.alpha.kubernetes.io/migrated"
+
+	// Node selector of the attacher instance that attached the volume, so
+	// the instance can detach it after the node is deleted.
+	vaNodeSelectorAnnotation = "csi.alpha.kubernetes.io/node-selector"
+
+	// Condition of an attached volume, as reported by the CSI driver.
+	vaVolumeConditionAbnormalAnnotation = "csi.alpha.kubernetes.io/volume-condition-abnormal"
+	vaVolumeConditionMessageAnnotation  = "csi.alpha.kubernetes.io/volume-condition-message"
+
+	// readWriteOncePod is v1.ReadWriteOncePod, which is not available in
+	// k8s.io/api used by the external-attacher yet.
+	readWriteOncePod v1.PersistentVolumeAccessMode = "ReadWriteOncePod"
 )
 
+// Reasons of events reported on VolumeAttachments and PersistentVolumes.
+const (
+	eventReasonAttaching    = "AttachingVolume"
+	eventReasonAttached     = "SuccessfulAttachVolume"
+	eventReasonFailedAttach = "FailedAttachVolume"
+	eventReasonDetached     = "SuccessfulDetachVolume"
+	eventReasonFailedDetach = "FailedDetachVolume"
+
+	eventReasonVolumeConditionAbnormal = "VolumeConditionAbnormal"
+	eventReasonForceDetached           = "ForceDetachedVolume"
+)
+
+// recordVAEvent emits an event on given VolumeAttachment and, when the
+// VolumeAttachment refers to a PersistentVolume, on the PersistentVolume too.
+func recordVAEvent(recorder record.EventRecorder, va *storage.VolumeAttachment, eventType, reason, messageFmt string, args ...interface{}) {
+	if recorder == nil {
+		return
+	}
+	message := fmt.Sprintf(messageFmt, args...)
+	recorder.Event(va, eventType, reason, message)
+	if va.Spec.Source.PersistentVolumeName != nil {
+		// Use a reference, the PV does not need to exist in the informer
+		// cache (or in the API server) at this point.
+		pvRef := &v1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "PersistentVolume",
+			Name:       *va.Spec.Source.PersistentVolumeName,
+		}
+		recorder.Eventf(pvRef, eventType, reason, "%s: %s", va.Name, message)
+	}
+}
+
+// errorCodeSuffix returns " (<gRPC code>)" when given error is a gRPC error,
+// so events tell apart errors returned by the CSI driver from local ones.
+func errorCodeSuffix(err error) string {
+	if st, ok := status.FromError(err); ok {
+		return fmt.Sprintf(" (%s)", st.Code())
+	}
+	return ""
+}
+
 // SanitizeDriverName sanitizes provided driver name.
 func SanitizeDriverName(driver string) string {
 	re := regexp.MustCompile("[^a-zA-Z0-9-]")
@@ -138,8 +200,25 @@ func GetNodeIDFromCSINode(driver string, csiNode *storage.CSINode) (string, bool
 	return "", false
 }
 
-// GetVolumeCapabilities returns volumecapability from PV spec
-func GetVolumeCapabilities(pvSpec *v1.PersistentVolumeSpec) (*csi.VolumeCapability, error) {
+// GetAttachLimitFromCSINode returns the maximum number of volumes of the
+// driver that can be attached to the node, as reported in CSINode.
+func GetAttachLimitFromCSINode(driver string, csiNode *storage.CSINode) (int32, bool) {
+	for _, d := range csiNode.Spec.Drivers {
+		if d.Name == driver {
+			if d.Allocatable == nil || d.Allocatable.Count == nil {
+				return 0, false
+			}
+			return *d.Allocatable.Count, true
+		}
+	}
+	return 0, false
+}
+
+// GetVolumeCapabilities returns volumecapability from PV spec. When the driver
+// has SINGLE_NODE_MULTI_WRITER capability, ReadWriteOnce and ReadWriteOncePod
+// are translated to the more specific SINGLE_NODE_MULTI_WRITER and
+// SINGLE_NODE_SINGLE_WRITER modes.
+func GetVolumeCapabilities(pvSpec *v1.PersistentVolumeSpec, singleNodeMultiWriterCapable bool) (*csi.VolumeCapability, error) {
 	m := map[v1.PersistentVolumeAccessMode]bool{}
 	for _, mode := range pvSpec.AccessModes {
 		m[mode] = true
@@ -177,6 +256,16 @@ func GetVolumeCapabilities(pvSpec *v1.PersistentVolumeSpec) (*csi.VolumeCapabili
 
 	// Translate array of modes into single VolumeCapability
 	switch {
+	case m[readWriteOncePod]:
+		// ReadWriteOncePod must be the only access mode
+		if len(m) > 1 {
+			return nil, fmt.Errorf("CSI does not support ReadWriteOncePod with other access modes on the same PersistentVolume")
+		}
+		if singleNodeMultiWriterCapable {
+			cap.AccessMode.Mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER
+		} else {
+			cap.AccessMode.Mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+		}
 	case m[v1.ReadWriteMany]:
 		// ReadWriteMany trumps everything, regardless what other modes are set
 		cap.AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
@@ -191,7 +280,11 @@ func GetVolumeCapabilities(pvSpec *v1.PersistentVolumeSpec) (*csi.VolumeCapabili
 
 	case m[v1.ReadWriteOnce]:
 		// There is only ReadWriteOnce set
-		cap.AccessMode.Mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+		if singleNodeMultiWriterCapable {
+			cap.AccessMode.Mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER
+		} else {
+			cap.AccessMode.Mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+		}
 
 	default:
 		return nil, fmt.Errorf("unsupported AccessMode combination: %+v", pvSpec.AccessModes)
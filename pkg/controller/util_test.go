@@ -57,13 +57,14 @@ func TestGetVolumeCapabilities(t *testing.T) {
 	filesystemVolumeMode := v1.PersistentVolumeMode(v1.PersistentVolumeFilesystem)
 
 	tests := []struct {
-		name               string
-		volumeMode         *v1.PersistentVolumeMode
-		fsType             string
-		modes              []v1.PersistentVolumeAccessMode
-		mountOptions       []string
-		expectedCapability *csi.VolumeCapability
-		expectError        bool
+		name                          string
+		volumeMode                    *v1.PersistentVolumeMode
+		fsType                        string
+		modes                         []v1.PersistentVolumeAccessMode
+		mountOptions                  []string
+		supportsSingleNodeMultiWriter bool
+		expectedCapability            *csi.VolumeCapability
+		expectError                   bool
 	}{
 		{
 			name:               "RWX",
@@ -124,6 +125,48 @@ func TestGetVolumeCapabilities(t *testing.T) {
 			expectedCapability: nil,
 			expectError:        true, // not possible in CSI
 		},
+		{
+			name:               "RWOP",
+			modes:              []v1.PersistentVolumeAccessMode{readWriteOncePod},
+			expectedCapability: createMountCapability(defaultFSType, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, nil),
+			expectError:        false,
+		},
+		{
+			name:                          "RWOP with SINGLE_NODE_MULTI_WRITER capable driver",
+			modes:                         []v1.PersistentVolumeAccessMode{readWriteOncePod},
+			supportsSingleNodeMultiWriter: true,
+			expectedCapability:            createMountCapability(defaultFSType, csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER, nil),
+			expectError:                   false,
+		},
+		{
+			name:                          "Block RWOP with SINGLE_NODE_MULTI_WRITER capable driver",
+			volumeMode:                    &blockVolumeMode,
+			modes:                         []v1.PersistentVolumeAccessMode{readWriteOncePod},
+			supportsSingleNodeMultiWriter: true,
+			expectedCapability:            createBlockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER),
+			expectError:                   false,
+		},
+		{
+			name:                          "RWO with SINGLE_NODE_MULTI_WRITER capable driver",
+			modes:                         []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			supportsSingleNodeMultiWriter: true,
+			expectedCapability:            createMountCapability(defaultFSType, csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER, nil),
+			expectError:                   false,
+		},
+		{
+			name:                          "RWX with SINGLE_NODE_MULTI_WRITER capable driver",
+			modes:                         []v1.PersistentVolumeAccessMode{v1.ReadWriteMany, v1.ReadWriteOnce},
+			supportsSingleNodeMultiWriter: true,
+			expectedCapability:            createMountCapability(defaultFSType, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, nil),
+			expectError:                   false,
+		},
+		{
+			name:                          "RWOP + RWO",
+			modes:                         []v1.PersistentVolumeAccessMode{readWriteOncePod, v1.ReadWriteOnce},
+			supportsSingleNodeMultiWriter: true,
+			expectedCapability:            nil,
+			expectError:                   true, // RWOP must be the only mode
+		},
 		{
 			name:               "nothing",
 			modes:              []v1.PersistentVolumeAccessMode{},
@@ -145,7 +188,7 @@ func TestGetVolumeCapabilities(t *testing.T) {
 				},
 			},
 		}
-		cap, err := GetVolumeCapabilities(&pv.Spec)
+		cap, err := GetVolumeCapabilities(&pv.Spec, test.supportsSingleNodeMultiWriter)
 
 		if err == nil && test.expectError {
 			t.Errorf("test %s: expected error, got none", test.name)
@@ -0,0 +1,117 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	storage "k8s.io/api/storage/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Names of VolumeAttachment informer indexes.
+const (
+	vaPVNameIndex   = "pvName"
+	vaNodeNameIndex = "nodeName"
+	vaAttacherIndex = "attacher"
+)
+
+var vaIndexers = cache.Indexers{
+	vaPVNameIndex:   vaPVNameIndexFunc,
+	vaNodeNameIndex: vaNodeNameIndexFunc,
+	vaAttacherIndex: vaAttacherIndexFunc,
+}
+
+// vaPVNameIndexFunc indexes VolumeAttachments by name of their PV. Inline
+// volumes are not indexed.
+func vaPVNameIndexFunc(obj interface{}) ([]string, error) {
+	va, ok := obj.(*storage.VolumeAttachment)
+	if !ok || va.Spec.Source.PersistentVolumeName == nil {
+		return nil, nil
+	}
+	return []string{*va.Spec.Source.PersistentVolumeName}, nil
+}
+
+// vaNodeNameIndexFunc indexes VolumeAttachments by name of their node.
+func vaNodeNameIndexFunc(obj interface{}) ([]string, error) {
+	va, ok := obj.(*storage.VolumeAttachment)
+	if !ok {
+		return nil, nil
+	}
+	return []string{va.Spec.NodeName}, nil
+}
+
+// vaAttacherIndexFunc indexes VolumeAttachments by their attacher.
+func vaAttacherIndexFunc(obj interface{}) ([]string, error) {
+	va, ok := obj.(*storage.VolumeAttachment)
+	if !ok {
+		return nil, nil
+	}
+	return []string{va.Spec.Attacher}, nil
+}
+
+// AddVAIndexers adds indexes of VolumeAttachments by PV name, node name and
+// attacher to the VolumeAttachment informer, unless they're already added,
+// e.g. by another controller sharing the informer. It must be called before
+// the informer is started.
+func AddVAIndexers(informer cache.SharedIndexInformer) error {
+	existing := informer.GetIndexer().GetIndexers()
+	missing := cache.Indexers{}
+	for name, indexFunc := range vaIndexers {
+		if _, found := existing[name]; !found {
+			missing[name] = indexFunc
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return informer.AddIndexers(missing)
+}
+
+// listVAsByIndex returns VolumeAttachments with the given value of the index.
+// When the indexer does not have the index, i.e. AddVAIndexers was not called,
+// all VolumeAttachments are scanned.
+func listVAsByIndex(indexer cache.Indexer, indexName, value string) ([]*storage.VolumeAttachment, error) {
+	var objs []interface{}
+	if _, found := indexer.GetIndexers()[indexName]; found {
+		var err error
+		objs, err = indexer.ByIndex(indexName, value)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		indexFunc := vaIndexers[indexName]
+		for _, obj := range indexer.List() {
+			values, err := indexFunc(obj)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range values {
+				if v == value {
+					objs = append(objs, obj)
+					break
+				}
+			}
+		}
+	}
+
+	vas := make([]*storage.VolumeAttachment, 0, len(objs))
+	for _, obj := range objs {
+		if va, ok := obj.(*storage.VolumeAttachment); ok {
+			vas = append(vas, va)
+		}
+	}
+	return vas, nil
+}
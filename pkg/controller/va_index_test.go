@@ -0,0 +1,156 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func newIndexedVA(name, attacher, nodeName string, pvName *string) *storage.VolumeAttachment {
+	return &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: storage.VolumeAttachmentSpec{
+			Attacher: attacher,
+			NodeName: nodeName,
+			Source:   storage.VolumeAttachmentSource{PersistentVolumeName: pvName},
+		},
+	}
+}
+
+func TestListVAsByIndex(t *testing.T) {
+	pv1, pv2 := "pv1", "pv2"
+	vas := []*storage.VolumeAttachment{
+		newIndexedVA("va1", "csi/test", "node1", &pv1),
+		newIndexedVA("va2", "csi/test", "node2", &pv1),
+		newIndexedVA("va3", "csi/other", "node1", &pv2),
+		newIndexedVA("inline", "csi/test", "node1", nil),
+	}
+	tests := []struct {
+		indexName string
+		value     string
+		expected  []string
+	}{
+		{vaPVNameIndex, "pv1", []string{"va1", "va2"}},
+		{vaPVNameIndex, "pv3", nil},
+		{vaNodeNameIndex, "node1", []string{"inline", "va1", "va3"}},
+		{vaAttacherIndex, "csi/other", []string{"va3"}},
+	}
+
+	for _, indexed := range []bool{true, false} {
+		informer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0).Storage().V1().VolumeAttachments().Informer()
+		if indexed {
+			if err := AddVAIndexers(informer); err != nil {
+				t.Fatalf("Failed to add indexers: %s", err)
+			}
+			// Indexers of another controller sharing the informer are
+			// kept.
+			if err := AddVAIndexers(informer); err != nil {
+				t.Fatalf("Failed to add indexers again: %s", err)
+			}
+		}
+		for _, va := range vas {
+			informer.GetStore().Add(va)
+		}
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%s=%s indexed=%v", test.indexName, test.value, indexed), func(t *testing.T) {
+				found, err := listVAsByIndex(informer.GetIndexer(), test.indexName, test.value)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				var names []string
+				for _, va := range found {
+					names = append(names, va.Name)
+				}
+				sort.Strings(names)
+				if fmt.Sprint(names) != fmt.Sprint(test.expected) {
+					t.Errorf("expected %v, got %v", test.expected, names)
+				}
+			})
+		}
+	}
+}
+
+// newBenchmarkIndexer returns an indexer with count VolumeAttachments of
+// different PVs, spread over 100 nodes.
+func newBenchmarkIndexer(b *testing.B, count int, indexed bool) cache.SharedIndexInformer {
+	informer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0).Storage().V1().VolumeAttachments().Informer()
+	if indexed {
+		if err := AddVAIndexers(informer); err != nil {
+			b.Fatalf("Failed to add indexers: %s", err)
+		}
+	}
+	for i := 0; i < count; i++ {
+		pvName := fmt.Sprintf("pv-%d", i)
+		informer.GetStore().Add(newIndexedVA(fmt.Sprintf("va-%d", i), testAttacherName, fmt.Sprintf("node-%d", i%100), &pvName))
+	}
+	return informer
+}
+
+func BenchmarkListVAsByPVName(b *testing.B) {
+	for _, indexed := range []bool{true, false} {
+		b.Run(fmt.Sprintf("indexed=%v", indexed), func(b *testing.B) {
+			indexer := newBenchmarkIndexer(b, 20000, indexed).GetIndexer()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := listVAsByIndex(indexer, vaPVNameIndex, fmt.Sprintf("pv-%d", i%20000)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSyncNewOrUpdatedPersistentVolume(b *testing.B) {
+	for _, indexed := range []bool{true, false} {
+		b.Run(fmt.Sprintf("indexed=%v", indexed), func(b *testing.B) {
+			client := fake.NewSimpleClientset()
+			informerFactory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
+			vaInformer := newBenchmarkIndexer(b, 20000, indexed)
+			opts := testCSIHandlerOptions(client, informerFactory, nil, nil)
+			opts.VAIndexer = vaInformer.GetIndexer()
+			handler := NewCSIHandler(opts)
+			queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+			defer queue.ShutDown()
+			handler.Init(queue, queue, record.NewFakeRecorder(100))
+			// The deleted PV has the finalizer and is used by a
+			// VolumeAttachment, nothing is changed.
+			pvObj := pvWithFinalizer()
+			pvObj.Name = "pv-19999"
+			pvObj.DeletionTimestamp = &metav1.Time{}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handler.SyncNewOrUpdatedPersistentVolume(pvObj)
+			}
+			b.StopTimer()
+			if actions := client.Actions(); len(actions) != 0 {
+				b.Errorf("expected no API calls, got %v", actions)
+			}
+		})
+	}
+}
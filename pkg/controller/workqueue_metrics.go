@@ -0,0 +1,246 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/component-base/metrics"
+)
+
+const (
+	workqueueSubsystem = "workqueue"
+	labelQueueName     = "name"
+)
+
+// Standard workqueue metrics, with the same names as metrics of
+// kube-controller-manager queues.
+var (
+	workqueueDepth = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      workqueueSubsystem,
+			Name:           "depth",
+			Help:           "Current depth of workqueue",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{labelQueueName},
+	)
+
+	workqueueAdds = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      workqueueSubsystem,
+			Name:           "adds_total",
+			Help:           "Total number of adds handled by workqueue",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{labelQueueName},
+	)
+
+	workqueueLatency = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      workqueueSubsystem,
+			Name:           "queue_duration_seconds",
+			Help:           "How long in seconds an item stays in workqueue before being requested.",
+			Buckets:        metrics.ExponentialBuckets(10e-9, 10, 10),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{labelQueueName},
+	)
+
+	workqueueWorkDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      workqueueSubsystem,
+			Name:           "work_duration_seconds",
+			Help:           "How long in seconds processing an item from workqueue takes.",
+			Buckets:        metrics.ExponentialBuckets(10e-9, 10, 10),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{labelQueueName},
+	)
+
+	workqueueUnfinishedWork = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      workqueueSubsystem,
+			Name:           "unfinished_work_seconds",
+			Help:           "How many seconds of work has done that is in progress and hasn't been observed by work_duration. Large values indicate stuck threads. One can deduce the number of stuck threads by observing the rate at which this increases.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{labelQueueName},
+	)
+
+	workqueueLongestRunningProcessor = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      workqueueSubsystem,
+			Name:           "longest_running_processor_seconds",
+			Help:           "How many seconds has the longest running processor for workqueue been running.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{labelQueueName},
+	)
+
+	workqueueRetries = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      workqueueSubsystem,
+			Name:           "retries_total",
+			Help:           "Total number of retries handled by workqueue",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{labelQueueName},
+	)
+)
+
+// workqueueMetricsProvider is the workqueue.MetricsProvider of all queues of
+// the external-attacher. It's nil until RegisterMetrics is called.
+var workqueueMetricsProvider workqueue.MetricsProvider
+
+// registerWorkqueueMetrics registers the workqueue metrics to the given
+// registry and makes client-go queues created later use them.
+func registerWorkqueueMetrics(registry metrics.KubeRegistry) {
+	registry.MustRegister(workqueueDepth)
+	registry.MustRegister(workqueueAdds)
+	registry.MustRegister(workqueueLatency)
+	registry.MustRegister(workqueueWorkDuration)
+	registry.MustRegister(workqueueUnfinishedWork)
+	registry.MustRegister(workqueueLongestRunningProcessor)
+	registry.MustRegister(workqueueRetries)
+	workqueueMetricsProvider = metricsProvider{}
+	workqueue.SetProvider(workqueueMetricsProvider)
+}
+
+// metricsProvider implements workqueue.MetricsProvider with the metrics above.
+type metricsProvider struct{}
+
+var _ workqueue.MetricsProvider = metricsProvider{}
+
+func (metricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return workqueueDepth.WithLabelValues(name)
+}
+
+func (metricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return workqueueAdds.WithLabelValues(name)
+}
+
+func (metricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return workqueueLatency.WithLabelValues(name)
+}
+
+func (metricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return workqueueWorkDuration.WithLabelValues(name)
+}
+
+func (metricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueUnfinishedWork.WithLabelValues(name)
+}
+
+func (metricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueLongestRunningProcessor.WithLabelValues(name)
+}
+
+func (metricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return workqueueRetries.WithLabelValues(name)
+}
+
+// queueMetrics records the standard workqueue metrics of a queue that does not
+// use workqueue.Type, client-go records them only for its own queue. A nil
+// *queueMetrics records nothing. It's not thread safe, the queue must call it
+// under its lock.
+type queueMetrics struct {
+	depth                   workqueue.GaugeMetric
+	adds                    workqueue.CounterMetric
+	latency                 workqueue.HistogramMetric
+	workDuration            workqueue.HistogramMetric
+	unfinishedWorkSeconds   workqueue.SettableGaugeMetric
+	longestRunningProcessor workqueue.SettableGaugeMetric
+
+	addTimes             map[interface{}]time.Time
+	processingStartTimes map[interface{}]time.Time
+}
+
+// newQueueMetrics returns metrics of the queue with the given name, or nil
+// when metrics are not registered.
+func newQueueMetrics(name string) *queueMetrics {
+	mp := workqueueMetricsProvider
+	if mp == nil || name == "" {
+		return nil
+	}
+	return &queueMetrics{
+		depth:                   mp.NewDepthMetric(name),
+		adds:                    mp.NewAddsMetric(name),
+		latency:                 mp.NewLatencyMetric(name),
+		workDuration:            mp.NewWorkDurationMetric(name),
+		unfinishedWorkSeconds:   mp.NewUnfinishedWorkSecondsMetric(name),
+		longestRunningProcessor: mp.NewLongestRunningProcessorSecondsMetric(name),
+		addTimes:                map[interface{}]time.Time{},
+		processingStartTimes:    map[interface{}]time.Time{},
+	}
+}
+
+// add records an item that was added to the queue and that was not waiting in
+// the queue yet.
+func (m *queueMetrics) add(item interface{}) {
+	if m == nil {
+		return
+	}
+	m.adds.Inc()
+	m.depth.Inc()
+	if _, exists := m.addTimes[item]; !exists {
+		m.addTimes[item] = time.Now()
+	}
+}
+
+// get records an item handed out to a worker.
+func (m *queueMetrics) get(item interface{}) {
+	if m == nil {
+		return
+	}
+	m.depth.Dec()
+	m.processingStartTimes[item] = time.Now()
+	if startTime, exists := m.addTimes[item]; exists {
+		m.latency.Observe(time.Since(startTime).Seconds())
+		delete(m.addTimes, item)
+	}
+}
+
+// done records an item processed by a worker.
+func (m *queueMetrics) done(item interface{}) {
+	if m == nil {
+		return
+	}
+	if startTime, exists := m.processingStartTimes[item]; exists {
+		m.workDuration.Observe(time.Since(startTime).Seconds())
+		delete(m.processingStartTimes, item)
+	}
+}
+
+// updateUnfinishedWork records how long the items being processed have been
+// processed.
+func (m *queueMetrics) updateUnfinishedWork() {
+	if m == nil {
+		return
+	}
+	var total, oldest float64
+	for _, startTime := range m.processingStartTimes {
+		age := time.Since(startTime).Seconds()
+		total += age
+		if age > oldest {
+			oldest = age
+		}
+	}
+	m.unfinishedWorkSeconds.Set(total)
+	m.longestRunningProcessor.Set(oldest)
+}
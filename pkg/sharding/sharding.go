@@ -0,0 +1,351 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sharding distributes work among several external-attacher
+// replicas. Work is split into a fixed number of shards and each shard is
+// owned by the replica that holds its Lease.
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// groupLabel marks all Leases of one group of replicas.
+	groupLabel = "sharding.external-attacher.csi.storage.k8s.io/group"
+	// roleLabel distinguishes shard Leases from member Leases.
+	roleLabel = "sharding.external-attacher.csi.storage.k8s.io/role"
+
+	roleShard  = "shard"
+	roleMember = "member"
+)
+
+// ShardOf returns the shard of the given key.
+func ShardOf(key string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// Manager acquires and renews Leases of the shards owned by this replica.
+//
+// Each replica holds a member Lease, so the other replicas know how many
+// replicas share the work. A replica acquires free or expired shard Leases up
+// to its fair share of the shards and releases shards above its fair share,
+// so new replicas get some shards too. Shards of a replica that dies are
+// taken over by the others when their Leases expire.
+type Manager struct {
+	client        kubernetes.Interface
+	namespace     string
+	name          string
+	identity      string
+	shards        int
+	leaseDuration time.Duration
+	retryPeriod   time.Duration
+	onChange      func()
+	now           func() time.Time
+
+	mux sync.RWMutex
+	// owned maps owned shards to time of their last successful renewal.
+	owned map[int]time.Time
+}
+
+// NewManager returns a new Manager. Names of all Leases start with the given
+// name, all replicas that share work must use the same name and number of
+// shards. onChange is called after this replica acquired a shard.
+func NewManager(client kubernetes.Interface, namespace, name, identity string, shards int, leaseDuration, retryPeriod time.Duration, onChange func()) *Manager {
+	return &Manager{
+		client:        client,
+		namespace:     namespace,
+		name:          sanitizeName(name),
+		identity:      identity,
+		shards:        shards,
+		leaseDuration: leaseDuration,
+		retryPeriod:   retryPeriod,
+		onChange:      onChange,
+		now:           time.Now,
+		owned:         map[int]time.Time{},
+	}
+}
+
+// Owns returns true when this replica owns the shard of the given key. A
+// shard whose Lease could not be renewed for the Lease duration is not owned,
+// another replica may have taken it over.
+func (m *Manager) Owns(key string) bool {
+	shard := ShardOf(key, m.shards)
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	renewed, found := m.owned[shard]
+	return found && m.now().Before(renewed.Add(m.leaseDuration))
+}
+
+// Run keeps Leases of the owned shards until ctx is done. It then releases
+// all Leases, so other replicas can take over the shards without waiting for
+// the Leases to expire.
+func (m *Manager) Run(ctx context.Context) {
+	klog.Infof("Starting shard manager %s with %d shards as %s", m.name, m.shards, m.identity)
+	wait.Until(func() {
+		if err := m.sync(ctx); err != nil {
+			klog.Errorf("Failed to sync shard leases: %s", err)
+		}
+	}, m.retryPeriod, ctx.Done())
+	m.release()
+}
+
+// sync renews the member Lease and the owned shard Leases, releases shards
+// above the fair share and acquires free shards up to the fair share.
+func (m *Manager) sync(ctx context.Context) error {
+	leases, err := m.client.CoordinationV1().Leases(m.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{groupLabel: m.groupLabelValue()}).String(),
+	})
+	if err != nil {
+		return err
+	}
+	now := m.now()
+
+	members := map[string]bool{m.identity: true}
+	shardLeases := map[string]*coordinationv1.Lease{}
+	var memberLease *coordinationv1.Lease
+	for i := range leases.Items {
+		lease := &leases.Items[i]
+		switch lease.Labels[roleLabel] {
+		case roleMember:
+			if lease.Name == m.memberLeaseName() {
+				memberLease = lease
+				continue
+			}
+			if m.isExpired(lease, now) {
+				// The replica is gone, clean up after it.
+				if err := m.client.CoordinationV1().Leases(m.namespace).Delete(ctx, lease.Name, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+					klog.V(4).Infof("Failed to delete expired member lease %s: %s", lease.Name, err)
+				}
+				continue
+			}
+			members[holder(lease)] = true
+		case roleShard:
+			shardLeases[lease.Name] = lease
+		}
+	}
+	if err := m.renew(ctx, memberLease, m.memberLeaseName(), roleMember, now); err != nil {
+		return fmt.Errorf("failed to renew member lease: %s", err)
+	}
+	fairShare := (m.shards + len(members) - 1) / len(members)
+
+	owned := map[int]time.Time{}
+	var free []int
+	for shard := 0; shard < m.shards; shard++ {
+		lease := shardLeases[m.shardLeaseName(shard)]
+		switch {
+		case lease != nil && holder(lease) == m.identity && !m.isExpired(lease, now):
+			if err := m.renew(ctx, lease, lease.Name, roleShard, now); err != nil {
+				klog.Warningf("Failed to renew lease of shard %d: %s", shard, err)
+				continue
+			}
+			owned[shard] = now
+		case lease == nil || holder(lease) == "" || m.isExpired(lease, now):
+			free = append(free, shard)
+		}
+	}
+
+	// Release shards above the fair share, other replicas are waiting for
+	// them.
+	for _, shard := range sortedShards(owned) {
+		if len(owned) <= fairShare {
+			break
+		}
+		delete(owned, shard)
+		m.setOwned(owned)
+		if err := m.releaseShard(ctx, shard); err != nil {
+			klog.Warningf("Failed to release lease of shard %d: %s", shard, err)
+		}
+	}
+
+	acquired := false
+	for _, shard := range free {
+		if len(owned) >= fairShare {
+			break
+		}
+		name := m.shardLeaseName(shard)
+		if err := m.renew(ctx, shardLeases[name], name, roleShard, now); err != nil {
+			// Most likely another replica was faster.
+			klog.V(4).Infof("Failed to acquire lease of shard %d: %s", shard, err)
+			continue
+		}
+		klog.Infof("Acquired shard %d", shard)
+		owned[shard] = now
+		acquired = true
+	}
+	m.setOwned(owned)
+	if acquired && m.onChange != nil {
+		m.onChange()
+	}
+	return nil
+}
+
+// renew creates or updates the Lease with this replica as its holder. Update
+// of a Lease changed by another replica fails with a conflict.
+func (m *Manager) renew(ctx context.Context, lease *coordinationv1.Lease, name, role string, now time.Time) error {
+	renewTime := metav1.NewMicroTime(now)
+	duration := int32(m.leaseDuration.Seconds())
+	if lease == nil {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: m.namespace,
+				Labels: map[string]string{
+					groupLabel: m.groupLabelValue(),
+					roleLabel:  role,
+				},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &m.identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+			},
+		}
+		_, err := m.client.CoordinationV1().Leases(m.namespace).Create(ctx, lease, metav1.CreateOptions{})
+		return err
+	}
+	lease = lease.DeepCopy()
+	if holder(lease) != m.identity {
+		transitions := int32(1)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.HolderIdentity = &m.identity
+		lease.Spec.AcquireTime = &renewTime
+		lease.Spec.LeaseTransitions = &transitions
+	}
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &renewTime
+	_, err := m.client.CoordinationV1().Leases(m.namespace).Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// releaseShard clears holder of the shard Lease.
+func (m *Manager) releaseShard(ctx context.Context, shard int) error {
+	lease, err := m.client.CoordinationV1().Leases(m.namespace).Get(ctx, m.shardLeaseName(shard), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if holder(lease) != m.identity {
+		return nil
+	}
+	lease.Spec.HolderIdentity = nil
+	_, err = m.client.CoordinationV1().Leases(m.namespace).Update(ctx, lease, metav1.UpdateOptions{})
+	if err == nil {
+		klog.Infof("Released shard %d", shard)
+	}
+	return err
+}
+
+// release gives up all shards and deletes the member Lease.
+func (m *Manager) release() {
+	m.mux.Lock()
+	owned := m.owned
+	m.owned = map[int]time.Time{}
+	m.mux.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.leaseDuration)
+	defer cancel()
+	for _, shard := range sortedShards(owned) {
+		if err := m.releaseShard(ctx, shard); err != nil {
+			klog.Warningf("Failed to release lease of shard %d: %s", shard, err)
+		}
+	}
+	err := m.client.CoordinationV1().Leases(m.namespace).Delete(ctx, m.memberLeaseName(), metav1.DeleteOptions{})
+	if err != nil && !apierrs.IsNotFound(err) {
+		klog.Warningf("Failed to delete member lease: %s", err)
+	}
+}
+
+func (m *Manager) setOwned(owned map[int]time.Time) {
+	copied := make(map[int]time.Time, len(owned))
+	for shard, renewed := range owned {
+		copied[shard] = renewed
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.owned = copied
+}
+
+func (m *Manager) isExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil {
+		return true
+	}
+	duration := m.leaseDuration
+	if lease.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	return lease.Spec.RenewTime.Add(duration).Before(now)
+}
+
+func (m *Manager) shardLeaseName(shard int) string {
+	return m.name + "-shard-" + strconv.Itoa(shard)
+}
+
+func (m *Manager) memberLeaseName() string {
+	return m.name + "-member-" + sanitizeName(m.identity)
+}
+
+// groupLabelValue returns a short label value that identifies the group,
+// Lease names can be longer than label values.
+func (m *Manager) groupLabelValue() string {
+	h := fnv.New32a()
+	h.Write([]byte(m.name))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+func holder(lease *coordinationv1.Lease) string {
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+// sortedShards returns the owned shards, highest first.
+func sortedShards(owned map[int]time.Time) []int {
+	shards := make([]int, 0, len(owned))
+	for shard := range owned {
+		shards = append(shards, shard)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(shards)))
+	return shards
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]`)
+
+// sanitizeName makes the string usable as a part of a Lease name.
+func sanitizeName(name string) string {
+	return strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(name), "-"), "-.")
+}
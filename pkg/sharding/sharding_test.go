@@ -0,0 +1,160 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharding
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testNamespace = "default"
+	testShards    = 4
+)
+
+func newTestManager(client *fake.Clientset, identity string, now *time.Time) *Manager {
+	m := NewManager(client, testNamespace, "external-attacher-csi.example.com", identity, testShards, 15*time.Second, 5*time.Second, nil)
+	m.now = func() time.Time { return *now }
+	return m
+}
+
+func ownedShards(m *Manager) int {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return len(m.owned)
+}
+
+// ownerOf returns manager that owns key, it fails when the key is owned by
+// none or by more managers.
+func ownerOf(t *testing.T, key string, managers ...*Manager) *Manager {
+	var owner *Manager
+	for _, m := range managers {
+		if !m.Owns(key) {
+			continue
+		}
+		if owner != nil {
+			t.Fatalf("key %q owned by %s and %s", key, owner.identity, m.identity)
+		}
+		owner = m
+	}
+	if owner == nil {
+		t.Fatalf("key %q not owned by any replica", key)
+	}
+	return owner
+}
+
+func TestShardOf(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		key := "volume-" + strconv.Itoa(i)
+		shard := ShardOf(key, testShards)
+		if shard < 0 || shard >= testShards {
+			t.Errorf("ShardOf(%q) = %d, expected shard in [0, %d)", key, shard, testShards)
+		}
+		if again := ShardOf(key, testShards); again != shard {
+			t.Errorf("ShardOf(%q) not stable: %d != %d", key, shard, again)
+		}
+	}
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	now := time.Now()
+	a := newTestManager(client, "replica-a", &now)
+	b := newTestManager(client, "replica-b", &now)
+
+	// A single replica takes all shards.
+	if err := a.sync(ctx); err != nil {
+		t.Fatalf("sync a: %s", err)
+	}
+	if owned := ownedShards(a); owned != testShards {
+		t.Errorf("replica a owns %d shards, expected %d", owned, testShards)
+	}
+
+	// A new replica gets its fair share once the first one releases it.
+	now = now.Add(time.Second)
+	if err := b.sync(ctx); err != nil {
+		t.Fatalf("sync b: %s", err)
+	}
+	if owned := ownedShards(b); owned != 0 {
+		t.Errorf("replica b owns %d shards before a released any, expected 0", owned)
+	}
+	for _, m := range []*Manager{a, b, a, b} {
+		now = now.Add(time.Second)
+		if err := m.sync(ctx); err != nil {
+			t.Fatalf("sync %s: %s", m.identity, err)
+		}
+	}
+	if owned := ownedShards(a); owned != testShards/2 {
+		t.Errorf("replica a owns %d shards, expected %d", owned, testShards/2)
+	}
+	if owned := ownedShards(b); owned != testShards/2 {
+		t.Errorf("replica b owns %d shards, expected %d", owned, testShards/2)
+	}
+	for i := 0; i < 20; i++ {
+		ownerOf(t, "volume-"+strconv.Itoa(i), a, b)
+	}
+
+	// Shards of a dead replica move when their leases expire.
+	for i := 0; i < 2; i++ {
+		now = now.Add(10 * time.Second)
+		if err := b.sync(ctx); err != nil {
+			t.Fatalf("sync b: %s", err)
+		}
+	}
+	if owned := ownedShards(b); owned != testShards {
+		t.Errorf("replica b owns %d shards after a died, expected %d", owned, testShards)
+	}
+	for i := 0; i < 20; i++ {
+		if owner := ownerOf(t, "volume-"+strconv.Itoa(i), a, b); owner != b {
+			t.Errorf("key volume-%d owned by %s, expected replica-b", i, owner.identity)
+		}
+	}
+	if _, err := client.CoordinationV1().Leases(testNamespace).Get(ctx, a.memberLeaseName(), metav1.GetOptions{}); err == nil {
+		t.Errorf("expected member lease of the dead replica to be deleted")
+	}
+}
+
+func TestManagerRelease(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	now := time.Now()
+	a := newTestManager(client, "replica-a", &now)
+	b := newTestManager(client, "replica-b", &now)
+
+	if err := a.sync(ctx); err != nil {
+		t.Fatalf("sync a: %s", err)
+	}
+	a.release()
+	if owned := ownedShards(a); owned != 0 {
+		t.Errorf("replica a owns %d shards after release, expected 0", owned)
+	}
+
+	// Released shards are taken over without waiting for lease expiration.
+	now = now.Add(time.Second)
+	if err := b.sync(ctx); err != nil {
+		t.Fatalf("sync b: %s", err)
+	}
+	if owned := ownedShards(b); owned != testShards {
+		t.Errorf("replica b owns %d shards, expected %d", owned, testShards)
+	}
+}